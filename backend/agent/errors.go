@@ -2,4 +2,11 @@ package main
 
 import "errors"
 
-var unknownOperator = errors.New("неизвестный оператор")
+var (
+	unknownOperator = errors.New("неизвестный оператор")
+	noArgs          = errors.New("у задачи нет аргументов")
+	divisionByZero  = errors.New("деление на ноль")
+	overflow        = errors.New("результат слишком велик")
+	undefinedResult = errors.New("результат не определён")
+	notInteger      = errors.New("остаток от деления определён только для целых чисел")
+)
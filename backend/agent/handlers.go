@@ -2,10 +2,17 @@ package main
 
 import (
 	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"math"
+	"slices"
 )
 
 func Calc(task *pb.TaskToSend) (agentResult *pb.TaskResult, err error) {
-	var result int64
+	var result float64
+	if (task.Operation == "min" || task.Operation == "max") && len(task.Args) == 0 {
+		err = noArgs
+		return
+	}
 	switch task.Operation {
 	case "+":
 		result = task.Arg1 + task.Arg2
@@ -14,11 +21,48 @@ func Calc(task *pb.TaskToSend) (agentResult *pb.TaskResult, err error) {
 	case "*":
 		result = task.Arg1 * task.Arg2
 	case "/":
+		if task.Arg2 == 0 {
+			err = divisionByZero
+			return
+		}
 		result = task.Arg1 / task.Arg2
+	case "^":
+		result = math.Pow(task.Arg1, task.Arg2)
+	case "%":
+		if task.Arg1 != math.Trunc(task.Arg1) || task.Arg2 != math.Trunc(task.Arg2) {
+			err = notInteger
+			return
+		}
+		if task.Arg2 == 0 {
+			err = divisionByZero
+			return
+		}
+		result = math.Mod(task.Arg1, task.Arg2)
+	case pkg.UnaryMinus:
+		result = -task.Arg1
+	case "sqrt":
+		result = math.Sqrt(task.Arg1)
+	case "abs":
+		result = math.Abs(task.Arg1)
+	case "round":
+		result = math.Round(task.Arg1)
+	case "pow":
+		result = math.Pow(task.Arg1, task.Arg2)
+	case "min":
+		result = slices.Min(task.Args)
+	case "max":
+		result = slices.Max(task.Args)
 	default:
 		err = unknownOperator
 		return
 	}
+	if math.IsInf(result, 0) {
+		err = overflow
+		return
+	} else if math.IsNaN(result) {
+		err = undefinedResult
+		return
+	}
 	agentResult = &pb.TaskResult{
 		PairId: task.PairId,
 		Result: result,
@@ -2,6 +2,7 @@ package main
 
 import (
 	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
+	"github.com/Debianov/calc-ya-go-24/pkg"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -88,6 +89,63 @@ func testCalcOk(t *testing.T) {
 				Operation:           "*",
 				PermissibleDuration: "",
 			},
+			{
+				PairId:              0,
+				Arg1:                7,
+				Operation:           pkg.UnaryMinus,
+				PermissibleDuration: "",
+			},
+			{
+				PairId:              0,
+				Arg1:                1.5,
+				Arg2:                2,
+				Operation:           "*",
+				PermissibleDuration: "",
+			},
+			{
+				PairId:              0,
+				Arg1:                2,
+				Arg2:                10,
+				Operation:           "^",
+				PermissibleDuration: "",
+			},
+			{
+				PairId:              0,
+				Arg1:                -7,
+				Arg2:                3,
+				Operation:           "%",
+				PermissibleDuration: "",
+			},
+			{
+				PairId:              0,
+				Arg1:                16,
+				Operation:           "sqrt",
+				PermissibleDuration: "",
+				Args:                []float64{16},
+			},
+			{
+				PairId:              0,
+				Arg1:                3,
+				Arg2:                7,
+				Operation:           "max",
+				PermissibleDuration: "",
+				Args:                []float64{3, 7, 2},
+			},
+			{
+				PairId:              0,
+				Arg1:                3,
+				Arg2:                7,
+				Operation:           "min",
+				PermissibleDuration: "",
+				Args:                []float64{3, 7, 2},
+			},
+			{
+				PairId:              0,
+				Arg1:                -2.5,
+				Operation:           "round",
+				PermissibleDuration: "",
+				Args:                []float64{-2.5},
+			},
 		}
 		expectedStructs = []*pb.TaskResult{
 			{
@@ -104,12 +162,44 @@ func testCalcOk(t *testing.T) {
 			},
 			{
 				PairId: 0,
-				Result: 1,
+				Result: 1.5,
 			},
 			{
 				PairId: 0,
 				Result: 200,
 			},
+			{
+				PairId: 0,
+				Result: -7,
+			},
+			{
+				PairId: 0,
+				Result: 3,
+			},
+			{
+				PairId: 0,
+				Result: 1024,
+			},
+			{
+				PairId: 0,
+				Result: -1,
+			},
+			{
+				PairId: 0,
+				Result: 4,
+			},
+			{
+				PairId: 0,
+				Result: 7,
+			},
+			{
+				PairId: 0,
+				Result: 2,
+			},
+			{
+				PairId: 0,
+				Result: -3,
+			},
 		}
 	)
 	for ind, toSend := range toSendStructs {
@@ -119,7 +209,37 @@ func testCalcOk(t *testing.T) {
 	}
 }
 
+func testCalcNoArgsErr(t *testing.T) {
+	agentResult, err := Calc(&pb.TaskToSend{PairId: 0, Operation: "max"})
+	assert.Equal(t, (*pb.TaskResult)(nil), agentResult)
+	assert.ErrorIs(t, noArgs, err)
+}
+
+func testCalcArithmeticErr(t *testing.T) {
+	var (
+		toSendStructs = []*pb.TaskToSend{
+			{PairId: 0, Arg1: 4, Arg2: 0, Operation: "/"},
+			{PairId: 0, Arg1: 4, Arg2: 0, Operation: "%"},
+			{PairId: 0, Arg1: 10, Arg2: 400, Operation: "^"},
+			{PairId: 0, Arg1: 1e308, Arg2: 1e308, Operation: "*"},
+			{PairId: 0, Arg1: -1, Operation: "sqrt"},
+			{PairId: 0, Arg1: 5.5, Arg2: 2, Operation: "%"},
+			{PairId: 0, Arg1: 5, Arg2: 0.5, Operation: "%"},
+			{PairId: 0, Arg1: 0.5, Arg2: 0, Operation: "%"},
+		}
+		expectedErrs = []error{divisionByZero, divisionByZero, overflow, overflow, undefinedResult, notInteger,
+			notInteger, notInteger}
+	)
+	for ind, toSend := range toSendStructs {
+		agentResult, err := Calc(toSend)
+		assert.Equal(t, (*pb.TaskResult)(nil), agentResult, "case %d", ind)
+		assert.ErrorIs(t, expectedErrs[ind], err, "case %d", ind)
+	}
+}
+
 func TestCalc(t *testing.T) {
 	t.Run("UnknowOperatorErr", testCalcUnknownOperatorErr)
+	t.Run("NoArgsErr", testCalcNoArgsErr)
+	t.Run("ArithmeticErr", testCalcArithmeticErr)
 	t.Run("Ok", testCalcOk)
 }
@@ -46,6 +46,7 @@ func main() {
 					calcResult, err := Calc(task)
 					if err != nil {
 						log.Println(err, task.PairId)
+						calcResult = &pb.TaskResult{PairId: task.PairId, Error: err.Error()}
 					}
 					results <- calcResult
 				}
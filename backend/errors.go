@@ -27,6 +27,40 @@ func (t TaskIDNotExist) Error() string {
 	return fmt.Sprintf("задачи с ID %d не найдена", t.taskId)
 }
 
+type AttemptsExhausted struct {
+	attempts  int
+	operation string
+	pairId    int32
+}
+
+func (a AttemptsExhausted) Error() string {
+	exprId, taskId := pkg.Unpair(int(a.pairId))
+	return fmt.Sprintf("task: %d из expression %d (оператор: %s) не посчитан ни одним агентом за %d попыток",
+		taskId, exprId, a.operation, a.attempts)
+}
+
+// CalcError -- ошибка, которую агент вернул вместо результата Task-а (например, деление на ноль).
+type CalcError struct {
+	reason    string
+	operation string
+	pairId    int32
+}
+
+func (c CalcError) Error() string {
+	exprId, taskId := pkg.Unpair(int(c.pairId))
+	return fmt.Sprintf("агент не смог посчитать task: %d из expression %d, оператор: %s: %s", taskId, exprId,
+		c.operation, c.reason)
+}
+
+type ExprAlreadyFinished struct {
+	exprId int
+	status ExprStatus
+}
+
+func (e ExprAlreadyFinished) Error() string {
+	return fmt.Sprintf("expression %d уже завершено со статусом \"%s\"", e.exprId, e.status)
+}
+
 type NoReadyTask struct {
 }
 
@@ -42,3 +76,12 @@ func (n OneReadyTaskBug) Error() string {
 	return fmt.Sprintf("(bug) разработчиком ожидается, что выданный expr (id %d) будет иметь хотя бы 1 готовый"+
 		" к отправке task.\n", n.ExprId)
 }
+
+// LoginAlreadyExists возвращается при регистрации пользователя с уже занятым логином.
+type LoginAlreadyExists struct {
+	Login string
+}
+
+func (l LoginAlreadyExists) Error() string {
+	return fmt.Sprintf("логин %s уже занят", l.Login)
+}
@@ -113,7 +113,7 @@ func callExpressionsApi(t *testing.T, requestsToExprs JsonPayload) (result []Exp
 		reqBuf      []byte
 		resp        *http.Response
 		respBuf     []byte
-		resultEntry = ExpressionsJsonTitleStub{make([]ExpressionStub, 0)}
+		resultEntry = ExpressionsJsonTitleStub{Expressions: make([]ExpressionStub, 0)}
 	)
 	reqBuf, err = requestsToExprs.Marshal()
 	if err != nil {
@@ -8,8 +8,10 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
 	"log"
-	"strconv"
+	"math"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,7 +22,7 @@ type PairIdHolder interface {
 }
 
 type ResultHolder interface {
-	GetResult() int64
+	GetResult() float64
 }
 
 type CommonTask interface {
@@ -31,14 +33,16 @@ type CommonTask interface {
 // GrpcTask должен реализовывать только TaskWithTime, его stub-ы и orchestrator.TaskToSend
 type GrpcTask interface {
 	CommonTask
-	GetArg1() int64
-	GetArg2() int64
+	GetArg1() float64
+	GetArg2() float64
+	GetArgs() []float64
 	GetPermissibleDuration() string
 }
 
 type GrpcResult interface {
 	PairIdHolder
 	ResultHolder
+	GetError() string
 }
 
 type TaskWithTime struct {
@@ -58,7 +62,7 @@ func (t *TaskWithTime) GetStatus() TaskStatus {
 	return t.task.GetStatus()
 }
 
-func (t *TaskWithTime) GetResult() int64 {
+func (t *TaskWithTime) GetResult() float64 {
 	return t.task.GetResult()
 }
 
@@ -70,12 +74,24 @@ func (t *TaskWithTime) IsReadyToCalc() bool {
 	return t.task.IsReadyToCalc()
 }
 
-func (t *TaskWithTime) GetArg1() int64 {
-	return t.task.arg1.(int64)
+func (t *TaskWithTime) GetArg1() float64 {
+	v, _ := t.task.GetArg1()
+	return v
 }
 
-func (t *TaskWithTime) GetArg2() int64 {
-	return t.task.arg2.(int64)
+// GetArg2 у унарных Task-ов возвращает 0.
+func (t *TaskWithTime) GetArg2() float64 {
+	v, _ := t.task.GetArg2()
+	return v
+}
+
+// GetArgs возвращает все аргументы Task-а, в том числе arg1 и arg2.
+func (t *TaskWithTime) GetArgs() []float64 {
+	var result = make([]float64, t.task.GetArgsCount())
+	for ind := range result {
+		result[ind], _ = t.task.GetArg(ind)
+	}
+	return result
 }
 
 func (t *TaskWithTime) GetPermissibleDuration() string {
@@ -94,9 +110,14 @@ type CommonTasksHandler interface {
 	Add(task InternalTask)
 	Get(ind int) InternalTask
 	Len() int
-	RegisterFirst() (task InternalTask)
-	CountUpdatedTask()
+	PopReady() (task InternalTask, ok bool)
+	ReadyLen() int
+	Complete(task InternalTask, result float64) (isRoot bool)
+	Requeue(task InternalTask)
+	Drop()
+	Restore(calculatedTasks map[int32]float64) (isRootCalculated bool)
 	PopSentTask(taskId int32) (InternalTask, time.Time, bool)
+	PopExpiredTasks(now time.Time) []InternalTask
 }
 
 /*
@@ -105,27 +126,53 @@ InternalTask реализует Task-и, которые обращаются и
 */
 type InternalTask interface {
 	CommonTask
-	GetArg1() (int64, bool)
-	GetArg2() (int64, bool)
+	GetArg1() (float64, bool)
+	GetArg2() (float64, bool)
+	GetArg(ind int) (float64, bool)
+	GetArgsCount() int
+	GetKind() TaskKind
 	GetOperation() string
 	ResultHolder
 	GetStatus() TaskStatus
 	GetPermissibleDuration() time.Duration
 	IsReadyToCalc() bool
 	SetStatus(newStatus TaskStatus)
-	SetArg1(int64)
-	SetArg2(int64)
-	SetResult(result int64) bool
+	SetArg(ind int, value float64)
+	SetResult(result float64) bool
 }
 
+// TaskKind определяет, сколько аргументов использует Task.
+type TaskKind int
+
+const (
+	BinaryTask TaskKind = iota
+	UnaryTask
+	// VariadicTask -- Task с произвольным числом аргументов (min, max). Аргументы передаются агенту только
+	// через Args.
+	VariadicTask
+)
+
 type Task struct {
-	pairId          int32
-	arg1            interface{}
-	arg2            interface{}
-	operation       string
-	permissibleTime time.Duration
-	status          atomic.Value
-	result          atomic.Int64
+	pairId int32
+	/*
+		args хранит float64 или nil, если аргумент -- результат ещё не посчитанного Task-а.
+	*/
+	args []interface{}
+	/*
+		parents[ind] -- Task, результат которого станет args[ind], или nil, если аргумент известен сразу.
+	*/
+	parents []*Task
+	child   *Task // Task, которому нужен результат этого. У корневого Task-а nil.
+	/*
+		waitingArgsCount -- число аргументов, которые ещё не посчитаны. Изменяется только под TasksHandler.mut.
+	*/
+	waitingArgsCount int
+	attempts         int // сколько раз Task выдавался агентам. Изменяется только под Expression.mut.
+	kind             TaskKind
+	operation        string
+	permissibleTime  time.Duration
+	status           atomic.Value
+	result           atomic.Uint64 // float64 в виде math.Float64bits.
 }
 
 func (t *Task) GetPairId() int32 {
@@ -142,8 +189,8 @@ func (t *Task) GetStatus() TaskStatus {
 }
 
 // GetResult потокобезопасен.
-func (t *Task) GetResult() int64 {
-	return t.result.Load()
+func (t *Task) GetResult() float64 {
+	return math.Float64frombits(t.result.Load())
 }
 
 // SetStatus потокобезопасен.
@@ -155,51 +202,74 @@ func (t *Task) IsReadyToCalc() bool {
 	return t.status.Load().(TaskStatus) == ReadyToCalc
 }
 
-func (t *Task) GetArg1() (int64, bool) {
-	v, ok := t.arg1.(int64)
-	return v, ok
+func (t *Task) GetKind() TaskKind {
+	return t.kind
+}
+
+func (t *Task) GetArgsCount() int {
+	return len(t.args)
 }
 
-func (t *Task) GetArg2() (int64, bool) {
-	v, ok := t.arg2.(int64)
+// GetArg возвращает false, если аргумента с индексом ind нет, или он ещё не посчитан.
+func (t *Task) GetArg(ind int) (float64, bool) {
+	if ind >= len(t.args) {
+		return 0, false
+	}
+	v, ok := t.args[ind].(float64)
 	return v, ok
 }
 
-func (t *Task) SetArg1(result int64) {
-	t.arg1 = result
+func (t *Task) GetArg1() (float64, bool) {
+	return t.GetArg(0)
+}
+
+func (t *Task) GetArg2() (float64, bool) {
+	return t.GetArg(1)
 }
 
-func (t *Task) SetArg2(result int64) {
-	t.arg2 = result
+func (t *Task) SetArg(ind int, value float64) {
+	t.args[ind] = value
 }
 
 // SetResult потокобезопасен.
-func (t *Task) SetResult(result int64) bool {
-	return t.result.CompareAndSwap(t.result.Load(), result)
+func (t *Task) SetResult(result float64) bool {
+	return t.result.CompareAndSwap(t.result.Load(), math.Float64bits(result))
 }
 
 func (t *Task) GetPermissibleDuration() time.Duration {
 	return t.permissibleTime
 }
 
+// linkParents связывает Task с Task-ами, от результатов которых он зависит.
+func (t *Task) linkParents(parents []*Task) {
+	t.parents = parents
+	for _, parent := range parents {
+		if parent != nil {
+			parent.child = t
+		}
+	}
+}
+
 /*
-TasksHandler - обёртка над pkg.Stack с дополнительными методами. Нужен для обработки случаев, когда несколько
-Task-ов готовы и нужно продолжить работу других Task-ов, зависящие от первых. В случае, когда все необходимые Task-и
-обновлены, их результаты записываются в зависимый Task, и дальше он отправляется для дальнейшей обработки.
+TasksHandler хранит Task-и выражения как граф зависимостей: каждый Task знает Task-и, от которых он зависит
+(parents), и Task, который зависит от него (child). Task становится готовым, как только посчитаны все его аргументы,
+поэтому независимые подвыражения (например, обе скобки в (1+2)*(3+4)) могут считать разные агенты одновременно.
 Для работы с TaskWithTime встроена отдельная структура.
 */
 type TasksHandler struct {
-	sentTasks                          *sentTasksHandler
-	buf                                []*Task
-	tasksCountBeforeWaitingTask        atomic.Value
-	updatedTasksCountBeforeWaitingTask atomic.Value
-	mut                                sync.Mutex
+	sentTasks *sentTasksHandler
+	buf       []*Task
+	ready     []*Task // Task-и в статусе ReadyToCalc, ещё не выданные агентам.
+	mut       sync.Mutex
 }
 
 func (t *TasksHandler) Add(task InternalTask) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
 	t.buf = append(t.buf, task.(*Task))
+	if task.IsReadyToCalc() {
+		t.ready = append(t.ready, task.(*Task))
+	}
 }
 
 func (t *TasksHandler) Get(ind int) InternalTask {
@@ -208,108 +278,119 @@ func (t *TasksHandler) Get(ind int) InternalTask {
 	return t.buf[ind]
 }
 
-func (t *TasksHandler) delete(ind int) {
-	t.mut.Lock()
-	defer t.mut.Unlock()
-	t.buf = append(t.buf[:ind], t.buf[ind+1:]...)
-}
-
 func (t *TasksHandler) Len() int {
 	t.mut.Lock()
 	defer t.mut.Unlock()
 	return len(t.buf)
 }
 
-func (t *TasksHandler) getTasksCountBeforeWaitingTask() int {
-	return t.tasksCountBeforeWaitingTask.Load().(int)
+// PopReady возвращает готовый Task и больше не выдаёт его. ok равен false, если готовых Task-ов нет.
+func (t *TasksHandler) PopReady() (task InternalTask, ok bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if len(t.ready) == 0 {
+		return nil, false
+	}
+	task = t.ready[0]
+	t.ready = t.ready[1:]
+	return task, true
 }
 
-func (t *TasksHandler) getUpdatedTasksCountBeforeWaitingTask() int {
-	return t.updatedTasksCountBeforeWaitingTask.Load().(int)
+// ReadyLen возвращает число готовых, но ещё не выданных Task-ов.
+func (t *TasksHandler) ReadyLen() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return len(t.ready)
 }
 
-// RegisterFirst возвращает первую задачу, не удаляет её, но запоминает и не выдаёт повторно в дальнейшем.
-// Удаляет в том случае, если задача не будет использоваться для вычисления других задач.
-// Для простого получения задачи используйте Get.
-func (t *TasksHandler) RegisterFirst() (task InternalTask) {
-	task = t.Get(t.getTasksCountBeforeWaitingTask())
-	if task.IsReadyToCalc() {
-		t.addTasksCountBeforeWaitingTask(1)
-		return
-	} else {
-		var expectedTask InternalTask
-		if t.getUpdatedTasksCountBeforeWaitingTask() == t.getTasksCountBeforeWaitingTask() { // цикл в
-			// горутине не требуется, поскольку агент будут самостоятельно тыкать в сервер, чтоб тот проверил на
-			// наличие свободных таск
-			switch t.getTasksCountBeforeWaitingTask() {
-			case 1:
-				if _, ok := task.GetArg1(); ok != true {
-					expectedTask = t.Get(0)
-					t.delete(0)
-					task.SetArg1(expectedTask.GetResult())
-				}
-				t.updatedTasksCountBeforeWaitingTask.Store(0)
-				t.tasksCountBeforeWaitingTask.Store(0)
-			case 2:
-				if _, ok := task.GetArg1(); ok != true {
-					expectedTask = t.Get(0)
-					t.delete(0)
-					task.SetArg1(expectedTask.GetResult())
-				}
-				if _, ok := task.GetArg2(); ok != true {
-					expectedTask = t.Get(0)
-					t.delete(0)
-					task.SetArg2(expectedTask.GetResult())
-				}
-				t.updatedTasksCountBeforeWaitingTask.Store(0)
-				t.tasksCountBeforeWaitingTask.Store(0)
-			default:
-				if t.getTasksCountBeforeWaitingTask() < 3 {
-					break
-				}
-				calculatedTaskOffset := t.getTasksCountBeforeWaitingTask()
-				if _, ok := task.GetArg2(); ok != true {
-					expectedTask = t.Get(calculatedTaskOffset - 1)
-					t.delete(calculatedTaskOffset - 1)
-					task.SetArg2(expectedTask.GetResult())
-				}
-				if _, ok := task.GetArg1(); ok != true {
-					expectedTask = t.Get(calculatedTaskOffset - 2)
-					t.delete(calculatedTaskOffset - 2)
-					task.SetArg1(expectedTask.GetResult())
-				}
-				t.updatedTasksCountBeforeWaitingTask.Store(t.getUpdatedTasksCountBeforeWaitingTask() - 2)
-				t.tasksCountBeforeWaitingTask.Store(t.getTasksCountBeforeWaitingTask() - 2 + 1) // -2 удалённых и
-				// +1 текущий, который теперь ReadyToCalc.
-			}
-			task.SetStatus(ReadyToCalc)
-		}
-		return
+/*
+Complete записывает результат task-а в зависимый от него Task. Если у зависимого Task-а больше не осталось
+непосчитанных аргументов, он становится готовым. Возвращает true, если task -- корневой, т.е. его результат --
+результат всего выражения.
+*/
+func (t *TasksHandler) Complete(task InternalTask, result float64) (isRoot bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.complete(task.(*Task), result)
+}
+
+func (t *TasksHandler) complete(calculatedTask *Task, result float64) (isRoot bool) {
+	t.ready = slices.DeleteFunc(t.ready, func(readyTask *Task) bool { // Task мог быть возвращён в очередь по аренде.
+		return readyTask == calculatedTask
+	})
+	calculatedTask.SetResult(result)
+	calculatedTask.SetStatus(Calculated)
+	var child = calculatedTask.child
+	if child == nil {
+		return true
+	}
+	child.SetArg(slices.Index(child.parents, calculatedTask), result)
+	child.waitingArgsCount--
+	if child.waitingArgsCount == 0 {
+		child.SetStatus(ReadyToCalc)
+		t.ready = append(t.ready, child)
 	}
+	return false
 }
 
-func (t *TasksHandler) addTasksCountBeforeWaitingTask(delta int) {
-	t.tasksCountBeforeWaitingTask.Store(t.getTasksCountBeforeWaitingTask() + delta)
+/*
+Requeue возвращает выданный, но так и не посчитанный Task в число готовых. Если Task уже среди готовых (например, его
+вернула проверка аренды), повторно он не добавляется.
+*/
+func (t *TasksHandler) Requeue(task InternalTask) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	task.SetStatus(ReadyToCalc)
+	if !slices.Contains(t.ready, task.(*Task)) {
+		t.ready = append(t.ready, task.(*Task))
+	}
 }
 
-func (t *TasksHandler) addUpdatedTasksCountBeforeWaitingTasks(delta int) {
-	t.updatedTasksCountBeforeWaitingTask.Store(t.getUpdatedTasksCountBeforeWaitingTask() + delta)
+/*
+Restore отмечает посчитанными Task-и, результаты которых уже известны (например, сохранены в БД до перезапуска
+оркестратора). calculatedTasks отображает pairId Task-а в его результат. Возвращает true, если посчитан корневой
+Task.
+*/
+func (t *TasksHandler) Restore(calculatedTasks map[int32]float64) (isRootCalculated bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for _, task := range t.buf { // в buf Task добавляется после Task-ов, от которых зависит.
+		result, ok := calculatedTasks[task.GetPairId()]
+		if !ok {
+			continue
+		}
+		isRootCalculated = t.complete(task, result)
+	}
+	return
 }
 
-// CountUpdatedTask обновляет число отправленных тасок. Обязателен к вызову, если любой Task, указатель которого
-// хранится в экземпляре этой структуры, был обновлён.
-func (t *TasksHandler) CountUpdatedTask() {
-	t.addUpdatedTasksCountBeforeWaitingTasks(1)
+// Drop забывает все готовые и выданные агентам Task-и: они больше не будут выданы, а их результаты не будут приняты.
+func (t *TasksHandler) Drop() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.ready = nil
+	t.sentTasks.Drop()
 }
 
 func (t *TasksHandler) PopSentTask(taskId int32) (InternalTask, time.Time, bool) {
 	return t.sentTasks.PopSentTask(taskId)
 }
 
-// sentTasksHandler — map для работы с TaskWithTime структурой.
+func (t *TasksHandler) PopExpiredTasks(now time.Time) (result []InternalTask) {
+	for _, task := range t.sentTasks.PopExpiredTasks(now) {
+		result = append(result, task)
+	}
+	return
+}
+
+/*
+sentTasksHandler — map для работы с TaskWithTime структурой. Task-и с истёкшей арендой переносятся из buf в
+reclaimed: их результат ещё может прийти от медленного агента, и тогда к нему применяется LATE_RESULT_POLICY.
+*/
 type sentTasksHandler struct {
-	buf map[int32]TaskWithTime
-	mut sync.Mutex
+	buf       map[int32]TaskWithTime
+	reclaimed map[int32]TaskWithTime
+	mut       sync.Mutex
 }
 
 func (t *sentTasksHandler) WrapWithTime(readyTask InternalTask, timeAtSendingTask time.Time) (result TaskWithTime) {
@@ -319,31 +400,63 @@ func (t *sentTasksHandler) WrapWithTime(readyTask InternalTask, timeAtSendingTas
 	}
 	t.mut.Lock()
 	t.buf[readyTask.GetPairId()] = result
+	delete(t.reclaimed, readyTask.GetPairId())
 	t.mut.Unlock()
 	return
 }
 
+/*
+PopSentTask удаляет и возвращает выданный Task вместе с моментом отправки. Task, аренду которого забрала проверка
+PopExpiredTasks, тоже возвращается, но только один раз.
+*/
 func (t *sentTasksHandler) PopSentTask(taskId int32) (*Task, time.Time, bool) {
 	t.mut.Lock()
 	taskWithTime, ok := t.buf[taskId]
+	if !ok {
+		taskWithTime, ok = t.reclaimed[taskId]
+	}
 	if ok {
 		delete(t.buf, taskId)
+		delete(t.reclaimed, taskId)
 	}
 	t.mut.Unlock()
 	return taskWithTime.GetWrappedTask().(*Task), taskWithTime.GetTimeAtSendingTask(), ok
 }
 
+/*
+PopExpiredTasks удаляет и возвращает Task-и, у которых истекла аренда: с момента отправки прошло больше, чем
+допустимое время выполнения операции.
+*/
+func (t *sentTasksHandler) PopExpiredTasks(now time.Time) (expired []*Task) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for taskId, taskWithTime := range t.buf {
+		if now.Sub(taskWithTime.GetTimeAtSendingTask()) > taskWithTime.task.GetPermissibleDuration() {
+			expired = append(expired, taskWithTime.task)
+			t.reclaimed[taskId] = taskWithTime
+			delete(t.buf, taskId)
+		}
+	}
+	return
+}
+
+func (t *sentTasksHandler) Drop() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	clear(t.buf)
+	clear(t.reclaimed)
+}
+
 func CallSentTasksFabric() *sentTasksHandler {
 	return &sentTasksHandler{
-		buf: make(map[int32]TaskWithTime),
+		buf:       make(map[int32]TaskWithTime),
+		reclaimed: make(map[int32]TaskWithTime),
 	}
 }
 
 func CallTasksHandlerFabric() (newInstance *TasksHandler) {
 	newSentTasks := CallSentTasksFabric()
 	newInstance = &TasksHandler{sentTasks: newSentTasks}
-	newInstance.updatedTasksCountBeforeWaitingTask.Store(0)
-	newInstance.tasksCountBeforeWaitingTask.Store(0)
 	return
 }
 
@@ -366,8 +479,31 @@ const (
 	NoReadyTasks            = "Нет готовых задач"
 	Completed               = "Выполнено"
 	Cancelled               = "Отменено"
+	Failed                  = "Ошибка"
+)
+
+// IsFinished сообщает, что выражение больше не изменится, и его можно переносить в БД.
+func (s ExprStatus) IsFinished() bool {
+	return s == Completed || s == Cancelled || s == Failed
+}
+
+// LateResultPolicy определяет, что делать с результатом, пришедшим позже допустимого времени выполнения операции.
+type LateResultPolicy string
+
+const (
+	// RedispatchLateResult отбрасывает результат и выдаёт Task другому агенту.
+	RedispatchLateResult LateResultPolicy = "redispatch"
+	// AcceptLateResult принимает результат, записывая предупреждение в лог.
+	AcceptLateResult LateResultPolicy = "accept"
+	// FailOnLateResult отменяет выражение, сохраняя причину.
+	FailOnLateResult LateResultPolicy = "fail"
 )
 
+// IsKnown сообщает, что p -- одна из объявленных политик.
+func (p LateResultPolicy) IsKnown() bool {
+	return slices.Contains([]LateResultPolicy{RedispatchLateResult, AcceptLateResult, FailOnLateResult}, p)
+}
+
 /*
 ShortExpression -- урезанная версия Expression для возврата информации о выражении, не включая
 в этот вывод Task-и. Содержит только методы доступа к полям.
@@ -376,8 +512,55 @@ type ShortExpression interface {
 	JsonPayload
 	GetId() int
 	GetStatus() ExprStatus
-	GetResult() int64
+	GetResult() float64
+	GetReason() string
 	GetOwnerId() int64
+	GetSource() string
+	GetTimestamps() ExprTimestamps
+}
+
+/*
+ExprTimestamps -- моменты приёма выражения, выдачи его первого Task-а агенту и завершения. Нулевое время означает,
+что соответствующий момент ещё не наступил.
+*/
+type ExprTimestamps struct {
+	SubmittedAt time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+}
+
+// GetDuration возвращает время вычисления: от выдачи первого Task-а до завершения выражения.
+func (t ExprTimestamps) GetDuration() time.Duration {
+	if t.StartedAt.IsZero() || t.FinishedAt.IsZero() {
+		return 0
+	}
+	return t.FinishedAt.Sub(t.StartedAt)
+}
+
+/*
+ExprTimestampsJson -- поля ExprTimestamps в том виде, в котором они выводятся в JSON выражения. Ещё не наступившие
+моменты и длительность незавершённого выражения не выводятся.
+*/
+type ExprTimestampsJson struct {
+	SubmittedAt *time.Time `json:"submittedAt,omitempty"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Duration    string     `json:"duration,omitempty"`
+}
+
+func (t ExprTimestamps) ToJson() (result ExprTimestampsJson) {
+	var momentOrNil = func(moment time.Time) *time.Time {
+		if moment.IsZero() {
+			return nil
+		}
+		return &moment
+	}
+	result = ExprTimestampsJson{SubmittedAt: momentOrNil(t.SubmittedAt), StartedAt: momentOrNil(t.StartedAt),
+		FinishedAt: momentOrNil(t.FinishedAt)}
+	if !t.FinishedAt.IsZero() {
+		result.Duration = t.GetDuration().String()
+	}
+	return
 }
 
 type CommonExpression interface {
@@ -385,25 +568,39 @@ type CommonExpression interface {
 	GetReadyGrpcTask() (GrpcTask, error)
 	GetTasksHandler() CommonTasksHandler
 	UpdateTask(result GrpcResult, timeAt time.Time) (err error)
+	RequeueExpiredTasks(now time.Time) (err error)
+	Cancel(reason string) (err error)
+	Restore(calculatedTasks map[int32]float64, timestamps ExprTimestamps)
+	GetTree() ast.Node
 	MarshalId() (result []byte, err error)
 	DivideIntoTasks()
 }
 
 type Expression struct {
-	Id           int          `json:"id"`
-	Status       atomic.Value `json:"status"`
-	Result       atomic.Int64 `json:"result"`
+	Id     int           `json:"id"`
+	Status atomic.Value  `json:"status"`
+	Result atomic.Uint64 `json:"result"` // float64 в виде math.Float64bits. Используйте GetResult.
+	/*
+		reason -- причина, по которой выражение не посчитано (статусы Cancelled и Failed). Используйте GetReason.
+	*/
+	reason       atomic.Value
 	userOwnerId  int64
-	postfix      []string
+	source       string // исходный текст выражения, как его прислал пользователь.
+	tree         ast.Node
 	tasksHandler *TasksHandler
+	timestamps   ExprTimestamps // защищён mut. Используйте GetTimestamps.
+	mut          sync.Mutex     // не даёт выдаче и обновлению Task-ов одновременно менять Status.
 }
 
 func (e *Expression) MarshalJSON() (result []byte, err error) {
 	toMarshal := struct {
-		Id     int        `json:"id"`
-		Status ExprStatus `json:"status"`
-		Result int64      `json:"result"`
-	}{e.Id, e.GetStatus(), e.GetResult()}
+		Id         int        `json:"id"`
+		Expression string     `json:"expression,omitempty"`
+		Status     ExprStatus `json:"status"`
+		Result     float64    `json:"result"`
+		Reason     string     `json:"reason,omitempty"`
+		ExprTimestampsJson
+	}{e.Id, e.GetSource(), e.GetStatus(), e.GetResult(), e.GetReason(), e.GetTimestamps().ToJson()}
 	return json.Marshal(&toMarshal)
 }
 
@@ -428,29 +625,58 @@ func (e *Expression) GetStatus() ExprStatus {
 	return e.Status.Load().(ExprStatus)
 }
 
-func (e *Expression) GetResult() int64 {
-	return e.Result.Load()
+func (e *Expression) GetResult() float64 {
+	return math.Float64frombits(e.Result.Load())
+}
+
+// GetReason потокобезопасен.
+func (e *Expression) GetReason() string {
+	reason, _ := e.reason.Load().(string)
+	return reason
 }
 
 func (e *Expression) GetOwnerId() int64 {
 	return e.userOwnerId
 }
 
+func (e *Expression) GetSource() string {
+	return e.source
+}
+
+// GetTimestamps потокобезопасен.
+func (e *Expression) GetTimestamps() ExprTimestamps {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	return e.timestamps
+}
+
+func (e *Expression) GetTree() ast.Node {
+	return e.tree
+}
+
+/*
+GetReadyGrpcTask выдаёт любой готовый Task. Если готовые Task-и успели разобрать другие агенты, возвращается
+NoReadyTask.
+*/
 func (e *Expression) GetReadyGrpcTask() (result GrpcTask, err error) {
-	maybeReadyTask := e.tasksHandler.RegisterFirst()
-	if maybeReadyTask.IsReadyToCalc() {
-		if e.tasksHandler.Len() == 1 {
-			e.setStatus(NoReadyTasks)
-		} else {
-			e.setStatus(Ready)
-		}
-		taskWithTime := e.tasksHandler.sentTasks.WrapWithTime(maybeReadyTask, time.Now())
-		taskWithTime.SetStatus(Sent)
-		return &taskWithTime, nil
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	readyTask, ok := e.tasksHandler.PopReady()
+	if !ok {
+		return nil, NoReadyTask{}
+	}
+	if e.tasksHandler.ReadyLen() == 0 {
+		e.setStatus(NoReadyTasks)
 	} else {
-		return nil, errors.New("(bug) разработчиком ожидается, что выданный expr (Id %d) " +
-			"будет иметь хотя бы 1 готовый к отправке task")
+		e.setStatus(Ready)
+	}
+	readyTask.(*Task).attempts++
+	taskWithTime := e.tasksHandler.sentTasks.WrapWithTime(readyTask, time.Now())
+	if e.timestamps.StartedAt.IsZero() {
+		e.timestamps.StartedAt = taskWithTime.GetTimeAtSendingTask()
 	}
+	taskWithTime.SetStatus(Sent)
+	return &taskWithTime, nil
 }
 
 func (e *Expression) GetTasksHandler() CommonTasksHandler {
@@ -458,57 +684,179 @@ func (e *Expression) GetTasksHandler() CommonTasksHandler {
 }
 
 func (e *Expression) UpdateTask(result GrpcResult, timeAtReceiveTask time.Time) (err error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.GetStatus().IsFinished() {
+		return &ExprAlreadyFinished{e.Id, e.GetStatus()}
+	}
 	task, timeAtSendingTask, ok := e.tasksHandler.PopSentTask(result.GetPairId())
 	if !ok {
 		return &TaskIDNotExist{int(result.GetPairId())}
 	}
+	if result.GetError() != "" { // повторная выдача Task-а не поможет: любой агент получит ту же ошибку.
+		task.SetStatus(Calculated)
+		e.fail(Failed, &CalcError{result.GetError(), task.GetOperation(), task.GetPairId()})
+		return
+	}
 	if factTime := timeAtReceiveTask.Sub(timeAtSendingTask); factTime > task.GetPermissibleDuration() {
-		e.setStatus(Cancelled)
-		return &TimeoutExecution{task.GetPermissibleDuration(), factTime, task.GetOperation(),
-			task.GetPairId()}
+		err = &TimeoutExecution{task.GetPermissibleDuration(), factTime, task.GetOperation(), task.GetPairId()}
+		switch lateResultPolicy {
+		case RedispatchLateResult:
+			if task.(*Task).attempts >= maxAttempts {
+				err = &AttemptsExhausted{task.(*Task).attempts, task.GetOperation(), task.GetPairId()}
+				e.fail(Failed, err)
+				return
+			}
+			e.tasksHandler.Requeue(task)
+			if e.GetStatus() == NoReadyTasks {
+				e.setStatus(Ready)
+			}
+			return
+		case AcceptLateResult:
+			log.Printf("результат принят, несмотря на ошибку: %s", err)
+			err = nil
+		case FailOnLateResult:
+			e.fail(Cancelled, err)
+			return
+		}
+	}
+	if e.tasksHandler.Complete(task, result.GetResult()) {
+		e.complete(task.GetResult())
+	} else if e.tasksHandler.ReadyLen() > 0 {
+		e.setStatus(Ready)
+	} else { // принятый поздний результат мог забрать из очереди Task, который туда вернула проверка аренды.
+		e.setStatus(NoReadyTasks)
+	}
+	return
+}
+
+/*
+RequeueExpiredTasks возвращает в число готовых Task-и, результат которых не пришёл за допустимое время (например,
+агент упал). Если Task уже выдавался TASK_MAX_ATTEMPTS раз, выражение получает статус Failed, и возвращается
+AttemptsExhausted.
+*/
+func (e *Expression) RequeueExpiredTasks(now time.Time) (err error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.GetStatus().IsFinished() {
+		return
+	}
+	for _, task := range e.tasksHandler.PopExpiredTasks(now) {
+		if task.(*Task).attempts >= maxAttempts {
+			err = &AttemptsExhausted{task.(*Task).attempts, task.GetOperation(), task.GetPairId()}
+			e.fail(Failed, err)
+			return
+		}
+		e.tasksHandler.Requeue(task)
 	}
-	task.SetResult(result.GetResult())
-	e.tasksHandler.CountUpdatedTask()
-	if e.tasksHandler.Len() == 1 {
-		e.setStatus(Completed)
-		e.setResult(task.GetResult())
+	if e.GetStatus() == NoReadyTasks && e.tasksHandler.ReadyLen() > 0 {
+		e.setStatus(Ready)
 	}
 	return
 }
 
+/*
+Cancel отменяет выполняющееся выражение: оставшиеся Task-и больше не выдаются агентам, а результаты уже выданных
+отклоняются. Если выражение уже завершено, возвращается ExprAlreadyFinished.
+*/
+func (e *Expression) Cancel(reason string) (err error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if e.GetStatus().IsFinished() {
+		return &ExprAlreadyFinished{e.Id, e.GetStatus()}
+	}
+	e.tasksHandler.Drop()
+	e.fail(Cancelled, errors.New(reason))
+	return
+}
+
+/*
+Restore восстанавливает состояние выражения после перезапуска оркестратора. Вызывается после DivideIntoTasks;
+calculatedTasks -- результаты Task-ов, посчитанных до перезапуска, по их pairId, timestamps -- сохранённые
+моменты приёма и начала вычисления.
+*/
+func (e *Expression) Restore(calculatedTasks map[int32]float64, timestamps ExprTimestamps) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.timestamps.SubmittedAt, e.timestamps.StartedAt = timestamps.SubmittedAt, timestamps.StartedAt
+	if e.tasksHandler.Restore(calculatedTasks) {
+		e.complete(e.tasksHandler.buf[len(e.tasksHandler.buf)-1].GetResult())
+	} else if e.tasksHandler.ReadyLen() == 0 {
+		e.setStatus(NoReadyTasks)
+	}
+}
+
 func (e *Expression) DivideIntoTasks() {
+	var operatorCount int
+	result := e.divideIntoTasks(e.tree, &operatorCount)
+	if e.tasksHandler.Len() == 0 { // выражение без операторов (например, "5" или "-5") считается сразу.
+		operand, _ := result.(float64)
+		e.mut.Lock()
+		e.timestamps.StartedAt = time.Now()
+		e.complete(operand)
+		e.mut.Unlock()
+	}
+	return
+}
+
+/*
+divideIntoTasks обходит node в обратном порядке, поэтому Task добавляется после всех Task-ов, от которых он зависит.
+Возвращает float64, если значение node известно сразу, и *Task, который его посчитает, в противном случае.
+*/
+func (e *Expression) divideIntoTasks(node ast.Node, operatorCount *int) interface{} {
 	var (
-		operatorCount int
-		stack         = pkg.StackFabric[int64]()
+		kind      TaskKind
+		operation string
+		operands  []interface{}
 	)
-	for _, r := range e.postfix { // TODO: сделать структуру в постфиксе уже распарсеной. нам останется пройтись
-		// TODO по ней слева направо и записать всё в порядке <оператор, операнд, операнд>.
-		if pkg.IsNumber(r) {
-			operandInInt, err := strconv.ParseInt(r, 10, 64)
-			if err != nil {
-				log.Panic(err)
-			}
-			stack.Push(operandInInt)
-		} else if pkg.IsOperator(r) {
-			var (
-				newId   = e.generateId(operatorCount)
-				newTask InternalTask
-			)
-			if stack.Len() >= 2 {
-				arg2 := stack.Pop()
-				arg1 := stack.Pop()
-				newTask = CallTaskWithTimeFabric(newId, arg1, arg2, r, e.getPermissibleTime(r), ReadyToCalc)
-			} else if stack.Len() == 1 {
-				newTask = CallTaskWithTimeFabric(newId, nil, stack.Pop(), r, e.getPermissibleTime(r),
-					WaitingOtherTasks)
-			} else {
-				newTask = CallTaskWithTimeFabric(newId, nil, nil, r, e.getPermissibleTime(r), WaitingOtherTasks)
-			}
-			e.tasksHandler.Add(newTask)
-			operatorCount++
+	switch n := node.(type) {
+	case nil:
+		return nil
+	case *ast.Number:
+		return n.Value
+	case *ast.UnaryExpr:
+		arg := e.divideIntoTasks(n.X, operatorCount)
+		if operand, ok := arg.(float64); ok { // унарный минус перед числом не требует отдельного Task-а.
+			return -operand
 		}
+		kind, operation, operands = UnaryTask, pkg.UnaryMinus, []interface{}{arg}
+	case *ast.BinaryExpr:
+		arg1 := e.divideIntoTasks(n.X, operatorCount)
+		arg2 := e.divideIntoTasks(n.Y, operatorCount)
+		kind, operation, operands = BinaryTask, n.Op, []interface{}{arg1, arg2}
+	case *ast.CallExpr:
+		for _, arg := range n.Args {
+			operands = append(operands, e.divideIntoTasks(arg, operatorCount))
+		}
+		switch {
+		case pkg.IsVariadicFunction(n.Func):
+			kind = VariadicTask
+		case len(operands) == 1:
+			kind = UnaryTask
+		default:
+			kind = BinaryTask
+		}
+		operation = n.Func
 	}
-	return
+	var (
+		args    = make([]interface{}, len(operands))
+		parents = make([]*Task, len(operands))
+		status  = ReadyToCalc
+	)
+	for ind, operand := range operands {
+		if parent, ok := operand.(*Task); ok {
+			parents[ind] = parent
+			status = WaitingOtherTasks
+		} else {
+			args[ind] = operand
+		}
+	}
+	task := CallTaskWithArgsFabric(e.generateId(*operatorCount), args, kind, operation,
+		e.getPermissibleTime(operation), status)
+	task.linkParents(parents)
+	e.tasksHandler.Add(task)
+	*operatorCount++
+	return task
 }
 
 func (e *Expression) generateId(operatorCount int) int32 {
@@ -518,9 +866,18 @@ func (e *Expression) generateId(operatorCount int) int32 {
 func (e *Expression) getPermissibleTime(currentOperator string) (result time.Duration) {
 	var (
 		operatorAndEnvNamePairs = map[string]EnvVar{"+": *CallEnvVarFabric("TIME_ADDITION", "2s"),
-			"-": *CallEnvVarFabric("TIME_SUBTRACTION", "2s"),
-			"*": *CallEnvVarFabric("TIME_MULTIPLICATIONS", "2s"),
-			"/": *CallEnvVarFabric("TIME_DIVISIONS", "2s")}
+			"-":            *CallEnvVarFabric("TIME_SUBTRACTION", "2s"),
+			"*":            *CallEnvVarFabric("TIME_MULTIPLICATIONS", "2s"),
+			"/":            *CallEnvVarFabric("TIME_DIVISIONS", "2s"),
+			"^":            *CallEnvVarFabric("TIME_EXPONENTIATION", "2s"),
+			"%":            *CallEnvVarFabric("TIME_MODULO", "2s"),
+			pkg.UnaryMinus: *CallEnvVarFabric("TIME_NEGATION", "2s"),
+			"sqrt":         *CallEnvVarFabric("TIME_SQRT", "2s"),
+			"abs":          *CallEnvVarFabric("TIME_ABS", "2s"),
+			"round":        *CallEnvVarFabric("TIME_ROUND", "2s"),
+			"pow":          *CallEnvVarFabric("TIME_POW", "2s"),
+			"min":          *CallEnvVarFabric("TIME_MIN", "2s"),
+			"max":          *CallEnvVarFabric("TIME_MAX", "2s")}
 		maybeDuration string
 		err           error
 	)
@@ -536,18 +893,56 @@ func (e *Expression) getPermissibleTime(currentOperator string) (result time.Dur
 	return
 }
 
+/*
+lateResultPolicy -- что делать с результатом, пришедшим позже допустимого времени. Как и maxAttempts, задаётся
+оркестратором при запуске через SetLateResultPolicy.
+*/
+var lateResultPolicy = FailOnLateResult
+
+func SetLateResultPolicy(policy LateResultPolicy) {
+	lateResultPolicy = policy
+}
+
+/*
+maxAttempts -- сколько раз один Task может быть выдан агентам. Оркестратор задаёт его через SetMaxAttempts при
+запуске, до выдачи первого Task-а.
+*/
+var maxAttempts = 3
+
+func SetMaxAttempts(attempts int) {
+	maxAttempts = attempts
+}
+
 // setStatus потокобезопасен
 func (e *Expression) setStatus(status ExprStatus) bool {
 	return e.Status.CompareAndSwap(e.Status.Load(), status)
 }
 
+// complete завершает выражение со статусом Completed. Вызывается под mut.
+func (e *Expression) complete(result float64) {
+	e.setResult(result)
+	e.setStatus(Completed)
+	e.timestamps.FinishedAt = time.Now()
+}
+
+// fail завершает выражение со статусом status, запоминая reason. Вызывается под mut.
+func (e *Expression) fail(status ExprStatus, reason error) {
+	e.reason.Store(reason.Error())
+	e.setStatus(status)
+	e.timestamps.FinishedAt = time.Now()
+}
+
 // setResult потокобезопасен
-func (e *Expression) setResult(result int64) bool {
-	return e.Result.CompareAndSwap(e.Result.Load(), result)
+func (e *Expression) setResult(result float64) bool {
+	return e.Result.CompareAndSwap(e.Result.Load(), math.Float64bits(result))
 }
 
 type ExpressionsJsonTitle struct {
 	Expressions []ShortExpression `json:"expressions"`
+	/*
+		NextCursor передаётся в следующем запросе, чтобы получить следующую страницу. Пустой, если страница последняя.
+	*/
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 func (e *ExpressionsJsonTitle) Marshal() (result []byte, err error) {
@@ -564,17 +959,23 @@ func (e *ExpressionJsonTitle) Marshal() (result []byte, err error) {
 	return
 }
 
-func CallExpressionFabric(postfix []string, id int, ownerId int64, status ExprStatus, tasksHandler *TasksHandler) (newInstance *Expression) {
-	newInstance = &Expression{postfix: postfix, Id: id, userOwnerId: ownerId, tasksHandler: tasksHandler}
+func CallExpressionFabric(tree ast.Node, source string, id int, ownerId int64, status ExprStatus,
+	tasksHandler *TasksHandler) (newInstance *Expression) {
+	newInstance = &Expression{tree: tree, source: source, Id: id, userOwnerId: ownerId, tasksHandler: tasksHandler}
 	newInstance.Status.Swap(status)
+	newInstance.timestamps.SubmittedAt = time.Now()
 	return
 }
 
-func CallShortExpressionFabric(exprId int, ownerId int64, status ExprStatus, result int64) (newInstance *Expression) {
+func CallShortExpressionFabric(exprId int, ownerId int64, status ExprStatus, result float64,
+	reason string, source string, timestamps ExprTimestamps) (newInstance *Expression) {
 	newInstance = &Expression{Id: exprId}
 	newInstance.userOwnerId = ownerId
 	newInstance.setStatus(status)
 	newInstance.setResult(result)
+	newInstance.reason.Store(reason)
+	newInstance.source = source
+	newInstance.timestamps = timestamps
 	return
 }
 
@@ -588,8 +989,8 @@ const (
 )
 
 type AgentResult struct {
-	Id     int   `json:"id"`
-	Result int64 `json:"result"`
+	Id     int     `json:"id"`
+	Result float64 `json:"result"`
 }
 
 func (a *AgentResult) Marshal() (result []byte, err error) {
@@ -598,57 +999,48 @@ func (a *AgentResult) Marshal() (result []byte, err error) {
 }
 
 /*
-CallTaskFabric arg1 и arg2 должны быть либо nil, либо int(8/32/64)
+CallTaskFabric создаёт бинарный Task. arg1 и arg2 должны быть либо nil, либо int(32/64), либо float64
 */
 func CallTaskFabric(pairId int32, arg1 interface{}, arg2 interface{}, operation string,
 	status TaskStatus) (newInstance *Task) {
-	var (
-		finalArg1 interface{}
-		finalArg2 interface{}
-		err       error
-	)
-	finalArg1, err = convertToInt64Interface(arg1)
-	if err != nil {
-		panic(err)
-	}
-	finalArg2, err = convertToInt64Interface(arg2)
-	if err != nil {
-		panic(err)
-	}
-	newInstance = &Task{
-		pairId:    pairId,
-		arg1:      finalArg1,
-		arg2:      finalArg2,
-		operation: operation,
-	}
-	newInstance.SetStatus(status)
-	return newInstance
+	return CallTaskWithArgsFabric(pairId, []interface{}{arg1, arg2}, BinaryTask, operation, 0, status)
 }
 
 /*
-CallTaskWithTimeFabric arg1 и arg2 должны быть либо nil, либо int(8/32/64)
+CallTaskWithTimeFabric создаёт бинарный Task. arg1 и arg2 должны быть либо nil, либо int(32/64), либо float64
 */
 func CallTaskWithTimeFabric(pairId int32, arg1 interface{}, arg2 interface{}, operation string,
+	permissibleTime time.Duration, status TaskStatus) (newInstance *Task) {
+	return CallTaskWithArgsFabric(pairId, []interface{}{arg1, arg2}, BinaryTask, operation, permissibleTime, status)
+}
+
+/*
+CallTaskWithArgsFabric создаёт Task любого вида. Каждый из args должен быть либо nil, либо int(32/64), либо
+float64.
+*/
+func CallTaskWithArgsFabric(pairId int32, args []interface{}, kind TaskKind, operation string,
 	permissibleTime time.Duration, status TaskStatus) (newInstance *Task) {
 	var (
-		finalArg1 interface{}
-		finalArg2 interface{}
-		err       error
+		finalArgs        = make([]interface{}, len(args))
+		waitingArgsCount int
+		err              error
 	)
-	finalArg1, err = convertToInt64Interface(arg1)
-	if err != nil {
-		panic(err)
-	}
-	finalArg2, err = convertToInt64Interface(arg2)
-	if err != nil {
-		panic(err)
+	for ind, arg := range args {
+		finalArgs[ind], err = convertToFloat64Interface(arg)
+		if err != nil {
+			panic(err)
+		}
+		if finalArgs[ind] == nil {
+			waitingArgsCount++
+		}
 	}
 	newInstance = &Task{
-		pairId:          pairId,
-		arg1:            finalArg1,
-		arg2:            finalArg2,
-		operation:       operation,
-		permissibleTime: permissibleTime,
+		pairId:           pairId,
+		args:             finalArgs,
+		waitingArgsCount: waitingArgsCount,
+		kind:             kind,
+		operation:        operation,
+		permissibleTime:  permissibleTime,
 	}
 	newInstance.SetStatus(status)
 	return newInstance
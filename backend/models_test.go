@@ -0,0 +1,364 @@
+package backend
+
+import (
+	"encoding/json"
+	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+calcSequentially раздаёт Task-и expr по одному, как это делал бы единственный агент, и возвращает итоговое
+выражение. calcFunc используется вместо агента.
+*/
+func calcSequentially(t *testing.T, expr *Expression, calcFunc func(task GrpcTask) float64) {
+	for expr.GetStatus() != Completed {
+		task, err := expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: calcFunc(task)}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func calcStub(task GrpcTask) (result float64) {
+	switch task.GetOperation() {
+	case "+":
+		result = task.GetArg1() + task.GetArg2()
+	case "-":
+		result = task.GetArg1() - task.GetArg2()
+	case "*":
+		result = task.GetArg1() * task.GetArg2()
+	case "/":
+		result = task.GetArg1() / task.GetArg2()
+	case "^":
+		result = math.Pow(task.GetArg1(), task.GetArg2())
+	case "%":
+		result = math.Mod(task.GetArg1(), task.GetArg2())
+	case pkg.UnaryMinus:
+		result = -task.GetArg1()
+	case "sqrt":
+		result = math.Sqrt(task.GetArg1())
+	case "abs":
+		result = math.Abs(task.GetArg1())
+	case "round":
+		result = math.Round(task.GetArg1())
+	case "pow":
+		result = math.Pow(task.GetArg1(), task.GetArg2())
+	case "min":
+		result = slices.Min(task.GetArgs())
+	case "max":
+		result = slices.Max(task.GetArgs())
+	}
+	return
+}
+
+func TestDivideIntoTasks(t *testing.T) {
+	var (
+		expressions = []string{"-(1+2)*4", "5-(1+2)", "2-3*4", "(1+2)*(3+4)", "-(2*3)-(-4)", "2+2*4", "3--2",
+			"1.5*2", "7/2", "-0.5+.25", "2^3^2", "-2^2", "2*3^2", "7%3+1", "2^-1", "(1+1)^(1+2)",
+			"sqrt(16)+max(3, 7, 2)", "max(1, 2*3, 2+2)", "min(5, 1+1, -abs(-3))", "pow(2, 1+2)", "round(2.5)*sqrt(4)",
+			"max(1, min(2, 3), sqrt(4))-1", "max(2+3)"}
+		expectedResults = []float64{-12, 2, -10, 21, -2, 10, 5, 3, 3.5, -0.25, 512, -4, 18, 2, 0.5, 8,
+			11, 6, -3, 8, 6, 1, 5}
+	)
+	for ind, expression := range expressions {
+		tree, err := pkg.Parse(expression)
+		if err != nil {
+			t.Fatalf("case %d: %s", ind, err)
+		}
+		expr := CallExpressionFabric(tree, "", ind, 0, Ready, CallTasksHandlerFabric())
+		expr.DivideIntoTasks()
+		calcSequentially(t, expr, calcStub)
+		assert.Equal(t, expectedResults[ind], expr.GetResult(), "case %d", ind)
+	}
+}
+
+func TestDivideIntoTasksWithoutOperators(t *testing.T) {
+	tree, _ := pkg.Parse("-5")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	assert.Equal(t, ExprStatus(Completed), expr.GetStatus())
+	assert.Equal(t, float64(-5), expr.GetResult())
+	assert.Equal(t, 0, expr.GetTasksHandler().Len())
+}
+
+func TestGetReadyGrpcTaskIndependentTasks(t *testing.T) {
+	tree, _ := pkg.Parse("(1+2)*(3+4)")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	firstTask, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ExprStatus(Ready), expr.GetStatus())
+	secondTask, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ExprStatus(NoReadyTasks), expr.GetStatus())
+	_, err = expr.GetReadyGrpcTask()
+	assert.ErrorAs(t, err, &NoReadyTask{})
+	for _, task := range []GrpcTask{secondTask, firstTask} {
+		err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: calcStub(task)}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, ExprStatus(Ready), expr.GetStatus())
+	lastTask, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []float64{3, 7}, lastTask.GetArgs())
+}
+
+func TestCalcByConcurrentAgents(t *testing.T) {
+	tree, _ := pkg.Parse("((1+2)*(3+4)-(5+6)*(7-8))/(max(1, 2+2, 3)+sqrt(16)*(10-9))")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for expr.GetStatus() != Completed {
+				task, err := expr.GetReadyGrpcTask()
+				if err != nil {
+					continue
+				}
+				err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: calcStub(task)}, time.Now())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, float64(4), expr.GetResult())
+}
+
+func TestRequeueExpiredTasks(t *testing.T) {
+	tree, _ := pkg.Parse("-(1+2)")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := expr.GetReadyGrpcTask(); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, expr.RequeueExpiredTasks(time.Now()))
+		assert.Equal(t, ExprStatus(NoReadyTasks), expr.GetStatus())
+		err := expr.RequeueExpiredTasks(time.Now().Add(time.Minute))
+		if attempt < 3 {
+			assert.NoError(t, err)
+			assert.Equal(t, ExprStatus(Ready), expr.GetStatus())
+		} else {
+			var exhausted *AttemptsExhausted
+			assert.ErrorAs(t, err, &exhausted)
+			assert.Equal(t, ExprStatus(Failed), expr.GetStatus())
+		}
+	}
+}
+
+func testUpdateTaskLateResult(t *testing.T, policy LateResultPolicy) (expr *Expression, err error) {
+	t.Cleanup(func() {
+		SetLateResultPolicy(FailOnLateResult)
+	})
+	SetLateResultPolicy(policy)
+	tree, _ := pkg.Parse("2*3")
+	expr = CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	task, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: 6}, time.Now().Add(time.Minute))
+	return
+}
+
+func TestUpdateTaskLateResult(t *testing.T) {
+	t.Run("Redispatch", func(t *testing.T) {
+		expr, err := testUpdateTaskLateResult(t, RedispatchLateResult)
+		var timeoutErr *TimeoutExecution
+		assert.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, ExprStatus(Ready), expr.GetStatus())
+		task, err := expr.GetReadyGrpcTask()
+		if assert.NoError(t, err) {
+			assert.NoError(t, expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: 6}, time.Now()))
+			assert.Equal(t, ExprStatus(Completed), expr.GetStatus())
+		}
+	})
+	t.Run("Accept", func(t *testing.T) {
+		expr, err := testUpdateTaskLateResult(t, AcceptLateResult)
+		assert.NoError(t, err)
+		assert.Equal(t, ExprStatus(Completed), expr.GetStatus())
+		assert.Equal(t, float64(6), expr.GetResult())
+	})
+	t.Run("Fail", func(t *testing.T) {
+		expr, err := testUpdateTaskLateResult(t, FailOnLateResult)
+		var timeoutErr *TimeoutExecution
+		assert.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, ExprStatus(Cancelled), expr.GetStatus())
+		assert.Equal(t, err.Error(), expr.GetReason())
+	})
+}
+
+/*
+testLateResultAfterLeaseExpired выдаёт Task, забирает его проверкой аренды и только после этого присылает его
+результат.
+*/
+func testLateResultAfterLeaseExpired(t *testing.T, policy LateResultPolicy) (expr *Expression, err error) {
+	t.Cleanup(func() {
+		SetLateResultPolicy(FailOnLateResult)
+	})
+	SetLateResultPolicy(policy)
+	tree, _ := pkg.Parse("2*3")
+	expr = CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	task, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = expr.RequeueExpiredTasks(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: 6}, time.Now().Add(2*time.Minute))
+	return
+}
+
+func TestLateResultAfterLeaseExpired(t *testing.T) {
+	t.Run("Redispatch", func(t *testing.T) {
+		expr, err := testLateResultAfterLeaseExpired(t, RedispatchLateResult)
+		var timeoutErr *TimeoutExecution
+		assert.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, ExprStatus(Ready), expr.GetStatus())
+		assert.Equal(t, 1, expr.tasksHandler.ReadyLen())
+	})
+	t.Run("Accept", func(t *testing.T) {
+		expr, err := testLateResultAfterLeaseExpired(t, AcceptLateResult)
+		assert.NoError(t, err)
+		assert.Equal(t, ExprStatus(Completed), expr.GetStatus())
+		assert.Equal(t, float64(6), expr.GetResult())
+		assert.Zero(t, expr.tasksHandler.ReadyLen())
+	})
+	t.Run("Fail", func(t *testing.T) {
+		expr, err := testLateResultAfterLeaseExpired(t, FailOnLateResult)
+		var timeoutErr *TimeoutExecution
+		assert.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, ExprStatus(Cancelled), expr.GetStatus())
+	})
+	t.Run("OnlyOnce", func(t *testing.T) {
+		expr, _ := testLateResultAfterLeaseExpired(t, RedispatchLateResult)
+		var pairId = expr.tasksHandler.Get(0).GetPairId()
+		err := expr.UpdateTask(&pb.TaskResult{PairId: pairId, Result: 6}, time.Now())
+		var notExist *TaskIDNotExist
+		assert.ErrorAs(t, err, &notExist)
+	})
+}
+
+func TestUpdateTaskCalcError(t *testing.T) {
+	tree, _ := pkg.Parse("(1+1)*(4/0)")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	var tasks []GrpcTask
+	for range 2 {
+		task, err := expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	divisionTask := tasks[slices.IndexFunc(tasks, func(task GrpcTask) bool { return task.GetOperation() == "/" })]
+	err := expr.UpdateTask(&pb.TaskResult{PairId: divisionTask.GetPairId(), Error: "деление на ноль"}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, ExprStatus(Failed), expr.GetStatus())
+	assert.Contains(t, expr.GetReason(), "деление на ноль")
+}
+
+func TestRestore(t *testing.T) {
+	tree, _ := pkg.Parse("(1+2)*(3+4)-5")
+	expr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	var calculatedTasks = make(map[int32]float64)
+	task, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calculatedTasks[task.GetPairId()] = calcStub(task)
+
+	restoredExpr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	restoredExpr.DivideIntoTasks()
+	restoredExpr.Restore(calculatedTasks, ExprTimestamps{})
+	assert.Equal(t, 1, restoredExpr.GetTasksHandler().ReadyLen())
+	calcSequentially(t, restoredExpr, calcStub)
+	assert.Equal(t, float64(16), restoredExpr.GetResult())
+
+	for ind := range restoredExpr.GetTasksHandler().Len() {
+		task := restoredExpr.GetTasksHandler().Get(ind)
+		calculatedTasks[task.GetPairId()] = task.GetResult()
+	}
+	completedExpr := CallExpressionFabric(tree, "", 0, 0, Ready, CallTasksHandlerFabric())
+	completedExpr.DivideIntoTasks()
+	completedExpr.Restore(calculatedTasks, ExprTimestamps{})
+	assert.Equal(t, ExprStatus(Completed), completedExpr.GetStatus())
+	assert.Equal(t, float64(16), completedExpr.GetResult())
+}
+
+func TestExprTimestamps(t *testing.T) {
+	t.Run("WithTasks", func(t *testing.T) {
+		tree, _ := pkg.Parse("1+2")
+		expr := CallExpressionFabric(tree, "1+2", 0, 0, Ready, CallTasksHandlerFabric())
+		expr.DivideIntoTasks()
+		timestamps := expr.GetTimestamps()
+		assert.False(t, timestamps.SubmittedAt.IsZero())
+		assert.True(t, timestamps.StartedAt.IsZero())
+		task, err := expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamps = expr.GetTimestamps()
+		assert.False(t, timestamps.StartedAt.IsZero())
+		assert.True(t, timestamps.FinishedAt.IsZero())
+		assert.Empty(t, timestamps.ToJson().Duration)
+		err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: 3}, time.Now())
+		if assert.NoError(t, err) {
+			timestamps = expr.GetTimestamps()
+			assert.False(t, timestamps.FinishedAt.IsZero())
+			assert.Equal(t, timestamps.FinishedAt.Sub(timestamps.StartedAt), timestamps.GetDuration())
+		}
+		var toUnmarshal ExpressionStub
+		result, _ := expr.Marshal()
+		if assert.NoError(t, json.Unmarshal(result, &toUnmarshal)) {
+			assert.Equal(t, "1+2", toUnmarshal.Expression)
+			assert.NotNil(t, toUnmarshal.StartedAt)
+			assert.Equal(t, timestamps.GetDuration().String(), toUnmarshal.Duration)
+		}
+	})
+	t.Run("WithoutOperators", func(t *testing.T) {
+		tree, _ := pkg.Parse("5")
+		expr := CallExpressionFabric(tree, "5", 0, 0, Ready, CallTasksHandlerFabric())
+		expr.DivideIntoTasks()
+		timestamps := expr.GetTimestamps()
+		assert.False(t, timestamps.StartedAt.IsZero())
+		assert.False(t, timestamps.FinishedAt.IsZero())
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		tree, _ := pkg.Parse("1+2")
+		expr := CallExpressionFabric(tree, "1+2", 0, 0, Ready, CallTasksHandlerFabric())
+		expr.DivideIntoTasks()
+		assert.NoError(t, expr.Cancel("отменено пользователем"))
+		timestamps := expr.GetTimestamps()
+		assert.True(t, timestamps.StartedAt.IsZero())
+		assert.False(t, timestamps.FinishedAt.IsZero())
+		assert.Equal(t, time.Duration(0), timestamps.GetDuration())
+	})
+}
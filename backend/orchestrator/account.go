@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+ChangePasswordJson -- тело запроса смены пароля. Token нужен только в API v1, в v2 токен передаётся в заголовке
+Authorization.
+*/
+type ChangePasswordJson struct {
+	JwtTokenJsonWrapper
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (c *ChangePasswordJson) Marshal() (result []byte, err error) {
+	return json.Marshal(c)
+}
+
+// DeleteAccountJson -- тело запроса удаления аккаунта. Token, как и в ChangePasswordJson, нужен только в API v1.
+type DeleteAccountJson struct {
+	JwtTokenJsonWrapper
+	Password string `json:"password"`
+}
+
+func (d *DeleteAccountJson) Marshal() (result []byte, err error) {
+	return json.Marshal(d)
+}
+
+type SessionJson struct {
+	Id        int64     `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type SessionsJsonTitle struct {
+	Sessions []SessionJson `json:"sessions"`
+}
+
+func (s *SessionsJsonTitle) Marshal() (result []byte, err error) {
+	return json.Marshal(s)
+}
+
+/*
+readJsonBody читает тело запроса с Content-Type: application/json в requestStruct. Если это не удалось, readJsonBody
+сам отвечает ошибкой и возвращает false.
+*/
+func readJsonBody(w http.ResponseWriter, r *http.Request, requestStruct any) (ok bool) {
+	if !hasJsonBody(r) {
+		writeUnsupportedMediaType(w)
+		return
+	}
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err = json.Unmarshal(buf, requestStruct); err != nil {
+		writeBadJson(w, err)
+		return
+	}
+	return true
+}
+
+/*
+checkPassword сверяет password с паролем пользователя из БД через DbUser.Is. Неудачи учитываются в loginThrottler
+вместе с неудачными входами, иначе пароль можно было бы подбирать через смену пароля или удаление аккаунта. При
+несовпадении или блокировке ответ уже записан в w.
+*/
+func checkPassword(w http.ResponseWriter, r *http.Request, user backend.CommonUser, password string) (ok bool) {
+	var ip = clientIp(r)
+	if lockedFor := loginThrottler.LockedFor(user.GetLogin(), ip, time.Now()); lockedFor > 0 {
+		auditLog.Printf("login=%q ip=%s проверка пароля отклонена: попытки заблокированы ещё на %s", user.GetLogin(),
+			ip, lockedFor.Round(time.Second))
+		writeTooManyAttempts(w, lockedFor)
+		return
+	}
+	userFromDb, err := db.SelectUser(user.GetLogin())
+	if err != nil || userFromDb.GetId() != user.GetId() ||
+		!userFromDb.Is(&backend.JsonUser{Login: user.GetLogin(), Password: password}) {
+		var attempt = loginThrottler.RecordFailure(user.GetLogin(), ip, time.Now())
+		auditLog.Printf("login=%q ip=%s неудачная проверка пароля №%d: %s", user.GetLogin(), ip, attempt,
+			failureReason(err))
+		writeError(w, http.StatusForbidden, ErrorWrongPassword, "неверный пароль", nil)
+		return
+	}
+	loginThrottler.RecordSuccess(user.GetLogin())
+	return true
+}
+
+/*
+changePassword меняет пароль пользователя и отзывает все его сессии: токены, выпущенные до смены пароля, перестают
+приниматься. В ответ выдаётся пара токенов новой сессии.
+*/
+func changePassword(w http.ResponseWriter, r *http.Request, user backend.CommonUser,
+	requestStruct *ChangePasswordJson) {
+	if !checkPassword(w, r, user, requestStruct.OldPassword) {
+		return
+	}
+	var newUser = &backend.JsonUser{Login: user.GetLogin(), Password: requestStruct.NewPassword}
+	if err := passwordPolicy.Check(newUser.GetPassword()); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidCredentials, err.Error(), nil)
+		return
+	}
+	dbUser, err := backend.WrapIntoDbUser(newUser)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err = db.UpdatePassword(user.GetId(), dbUser.GetHashedPassword()); err != nil {
+		log.Panic(err)
+	}
+	if err = db.RevokeUserSessions(user.GetId(), time.Now()); err != nil {
+		log.Panic(err)
+	}
+	startSession(w, selectAccount(user.GetId()))
+}
+
+/*
+deleteAccount удаляет пользователя вместе с его выражениями и сессиями. Выполняющиеся выражения пользователя
+отменяются и убираются из exprsList до удаления из БД, чтобы их результаты больше не записывались.
+*/
+func deleteAccount(w http.ResponseWriter, r *http.Request, user backend.CommonUser, password string) {
+	if !checkPassword(w, r, user, password) {
+		return
+	}
+	for _, expr := range exprsList.GetAll() {
+		if expr.GetOwnerId() == user.GetId() {
+			_ = expr.Cancel("аккаунт удалён") // ошибка означает, что выражение уже посчитано.
+			exprsList.Remove(expr)
+		}
+	}
+	if err := db.DeleteUser(user.GetId()); err != nil {
+		log.Panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeSessions(w http.ResponseWriter, user backend.CommonUser) {
+	sessions, err := db.SelectUserSessions(user.GetId(), time.Now())
+	if err != nil {
+		log.Panic(err)
+	}
+	var sessionsJson = SessionsJsonTitle{Sessions: make([]SessionJson, 0, len(sessions))}
+	for _, session := range sessions {
+		sessionsJson.Sessions = append(sessionsJson.Sessions, SessionJson{Id: session.Id,
+			CreatedAt: session.CreatedAt, ExpiresAt: session.ExpiresAt})
+	}
+	sessionsInBytes, err := sessionsJson.Marshal()
+	if err != nil {
+		log.Panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(sessionsInBytes); err != nil {
+		log.Println(err)
+	}
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeRouteNotFound(w, r)
+		return
+	}
+	var requestStruct ChangePasswordJson
+	if !readJsonBody(w, r, &requestStruct) {
+		return
+	}
+	user, err := ParseJwt(requestStruct.Token)
+	if err != nil {
+		writeUnauthorized(w)
+		return
+	}
+	changePassword(w, r, user, &requestStruct)
+}
+
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeRouteNotFound(w, r)
+		return
+	}
+	var requestStruct DeleteAccountJson
+	if !readJsonBody(w, r, &requestStruct) {
+		return
+	}
+	user, err := ParseJwt(requestStruct.Token)
+	if err != nil {
+		writeUnauthorized(w)
+		return
+	}
+	deleteAccount(w, r, user, requestStruct.Password)
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeRouteNotFound(w, r)
+		return
+	}
+	if user, ok := parseToken(w, r); ok {
+		writeSessions(w, user)
+	}
+}
+
+func changePasswordV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	var requestStruct ChangePasswordJson
+	if readJsonBody(w, r, &requestStruct) {
+		changePassword(w, r, user, &requestStruct)
+	}
+}
+
+func deleteAccountV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	var requestStruct DeleteAccountJson
+	if readJsonBody(w, r, &requestStruct) {
+		deleteAccount(w, r, user, requestStruct.Password)
+	}
+}
+
+func sessionsV2Handler(w http.ResponseWriter, _ *http.Request, user backend.CommonUser) {
+	writeSessions(w, user)
+}
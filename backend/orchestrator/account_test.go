@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAccount(t *testing.T) {
+	t.Cleanup(func() {
+		db = callStubDbWithRegisteredUserFabric(testUser)
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	db = CallMemoryDbFabric()
+	exprsList = CallEmptyExpressionListFabric()
+	assert.Equal(t, http.StatusCreated, serveWithBody(http.MethodPost, "/api/v1/register",
+		`{"login": "account", "password": "qwerty"}`).Code)
+	var (
+		first  = requestTokens(t, "/api/v1/login", `{"login": "account", "password": "qwerty"}`)
+		second = requestTokens(t, "/api/v1/login", `{"login": "account", "password": "qwerty"}`)
+	)
+
+	t.Run("Sessions", func(t *testing.T) {
+		w := serveWithBody(http.MethodPost, "/api/v1/account/sessions", `{"token": "`+first.Token+`"}`)
+		var sessions SessionsJsonTitle
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions)) {
+			assert.Len(t, sessions.Sessions, 2)
+		}
+		assert.NoError(t, db.RevokeSession(hashRefreshToken(second.RefreshToken), time.Now()))
+		w = serveWithBearer(http.MethodGet, "/api/v2/account/sessions", first.Token, "")
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions)) {
+			assert.Len(t, sessions.Sessions, 1)
+		}
+	})
+	t.Run("ChangePassword", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/account/password", `{"token": "`+first.Token+
+			`", "oldPassword": "wrong1", "newPassword": "newPassword"}`), http.StatusForbidden, ErrorWrongPassword)
+		assertErrorJson(t, serveWithBearer(http.MethodPut, "/api/v2/account/password", first.Token,
+			`{"oldPassword": "qwerty", "newPassword": "new"}`), http.StatusBadRequest, ErrorInvalidCredentials)
+		assertErrorJson(t, serveWithBearer(http.MethodPut, "/api/v2/account/password", "",
+			`{"oldPassword": "qwerty", "newPassword": "newPassword"}`), http.StatusUnauthorized, ErrorUnauthorized)
+
+		w := serveWithBearer(http.MethodPut, "/api/v2/account/password", first.Token,
+			`{"oldPassword": "qwerty", "newPassword": "newPassword"}`)
+		var tokens TokensJson
+		if !assert.Equal(t, http.StatusOK, w.Code) || !assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens)) {
+			return
+		}
+		first = tokens
+		assert.Equal(t, http.StatusOK, getExpressionsCode(first.Token))
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login",
+			`{"login": "account", "password": "qwerty"}`), http.StatusUnauthorized, ErrorUnauthorized)
+		requestTokens(t, "/api/v1/login", `{"login": "account", "password": "newPassword"}`)
+	})
+	t.Run("ChangePasswordRevokesSessions", func(t *testing.T) {
+		var stale = requestTokens(t, "/api/v1/login", `{"login": "account", "password": "newPassword"}`)
+		w := serveWithBody(http.MethodPost, "/api/v1/account/password", `{"token": "`+stale.Token+
+			`", "oldPassword": "newPassword", "newPassword": "qwerty123"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(stale.Token))
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(first.Token))
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+		assert.Equal(t, http.StatusOK, getExpressionsCode(first.Token))
+	})
+	t.Run("PasswordCheckThrottled", func(t *testing.T) {
+		useLoginThrottler(t, CallLoginThrottlerFabric(1, 100, time.Minute, time.Hour))
+		assertErrorJson(t, serveWithBearer(http.MethodDelete, "/api/v2/account", first.Token,
+			`{"password": "wrong"}`), http.StatusForbidden, ErrorWrongPassword)
+		assertErrorJson(t, serveWithBearer(http.MethodPut, "/api/v2/account/password", first.Token,
+			`{"oldPassword": "qwerty123", "newPassword": "newPassword"}`), http.StatusTooManyRequests,
+			ErrorTooManyAttempts)
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login",
+			`{"login": "account", "password": "qwerty123"}`), http.StatusTooManyRequests, ErrorTooManyAttempts)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		w := serveWithBearer(http.MethodPost, "/api/v2/calculate", first.Token, `{"expression": "2+2*2"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, exprsList.GetAll(), 1)
+
+		assertErrorJson(t, serveWithBearer(http.MethodDelete, "/api/v2/account", first.Token,
+			`{"password": "qwerty"}`), http.StatusForbidden, ErrorWrongPassword)
+		w = serveWithBody(http.MethodDelete, "/api/v1/account", `{"token": "`+first.Token+
+			`", "password": "qwerty123"}`)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Empty(t, exprsList.GetAll())
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(first.Token))
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login",
+			`{"login": "account", "password": "qwerty123"}`), http.StatusUnauthorized, ErrorUnauthorized)
+	})
+	t.Run("WrongMethod", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/account", "{}"), http.StatusNotFound,
+			ErrorNotFound)
+		assertErrorJson(t, serveWithBearer(http.MethodPost, "/api/v2/account/password", first.Token, "{}"),
+			http.StatusMethodNotAllowed, ErrorMethodNotAllowed)
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Role -- роль пользователя. Роль хранится в таблице users и попадает в токен доступа (claim role).
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// ParseRole проверяет, что role -- одна из известных ролей.
+func ParseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleUser, RoleAdmin:
+		return Role(role), nil
+	}
+	return "", fmt.Errorf("неизвестная роль %q, ожидается %s или %s", role, RoleUser, RoleAdmin)
+}
+
+/*
+Account -- пользователь вместе с ролью и моментом отключения, но без пароля. Нулевой DisabledAt означает, что
+пользователь не отключён.
+*/
+type Account struct {
+	Id         int64
+	Login      string
+	Role       Role
+	DisabledAt time.Time
+}
+
+func (a Account) IsDisabled() bool {
+	return !a.DisabledAt.IsZero()
+}
+
+// selectAccount возвращает Account пользователя userId, который должен существовать.
+func selectAccount(userId int64) Account {
+	account, err := db.SelectAccount(userId)
+	if err != nil {
+		log.Panic(err)
+	}
+	return account
+}
+
+type AccountJson struct {
+	Id         int64      `json:"id"`
+	Login      string     `json:"login"`
+	Role       Role       `json:"role"`
+	DisabledAt *time.Time `json:"disabledAt,omitempty"`
+}
+
+type AccountsJsonTitle struct {
+	Users []AccountJson `json:"users"`
+}
+
+func (a *AccountsJsonTitle) Marshal() (result []byte, err error) {
+	return json.Marshal(a)
+}
+
+// AdminExpressionJson -- выражение в API администратора. В отличие от API пользователя, в нём указан владелец.
+type AdminExpressionJson struct {
+	OwnerId    int64                   `json:"ownerId"`
+	Expression backend.ShortExpression `json:"expression"`
+}
+
+func (a *AdminExpressionJson) Marshal() (result []byte, err error) {
+	return json.Marshal(a)
+}
+
+type AdminExpressionsJsonTitle struct {
+	Expressions []AdminExpressionJson `json:"expressions"`
+}
+
+func (a *AdminExpressionsJsonTitle) Marshal() (result []byte, err error) {
+	return json.Marshal(a)
+}
+
+/*
+withAdminAuth, как и withBearerAuth, пропускает только запросы с действительным токеном, но дополнительно требует
+роль RoleAdmin в токене. Остальным пользователям отвечает 403.
+*/
+func withAdminAuth(handler func(w http.ResponseWriter, r *http.Request, admin backend.CommonUser)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, role, err := parseBearerToken(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeUnauthorized(w)
+			return
+		}
+		if role != RoleAdmin {
+			writeError(w, http.StatusForbidden, ErrorForbidden, "нужна роль администратора", nil)
+			return
+		}
+		handler(w, r, user)
+	})
+}
+
+func adminUsersHandler(w http.ResponseWriter, _ *http.Request, _ backend.CommonUser) {
+	accounts, err := db.SelectAccounts()
+	if err != nil {
+		log.Panic(err)
+	}
+	var accountsJson = AccountsJsonTitle{Users: make([]AccountJson, 0, len(accounts))}
+	for _, account := range accounts {
+		var accountJson = AccountJson{Id: account.Id, Login: account.Login, Role: account.Role}
+		if account.IsDisabled() {
+			accountJson.DisabledAt = &account.DisabledAt
+		}
+		accountsJson.Users = append(accountsJson.Users, accountJson)
+	}
+	writeJsonPayload(w, &accountsJson)
+}
+
+// adminExpressionsHandler отвечает выполняющимися выражениями всех пользователей по возрастанию id.
+func adminExpressionsHandler(w http.ResponseWriter, _ *http.Request, _ backend.CommonUser) {
+	var exprs = exprsList.GetAll()
+	slices.SortFunc(exprs, func(a backend.CommonExpression, b backend.CommonExpression) int {
+		return cmp.Compare(a.GetId(), b.GetId())
+	})
+	var exprsJson = AdminExpressionsJsonTitle{Expressions: make([]AdminExpressionJson, 0, len(exprs))}
+	for _, expr := range exprs {
+		exprsJson.Expressions = append(exprsJson.Expressions, AdminExpressionJson{OwnerId: expr.GetOwnerId(),
+			Expression: expr})
+	}
+	writeJsonPayload(w, &exprsJson)
+}
+
+func adminExpressionHandler(w http.ResponseWriter, r *http.Request, _ backend.CommonUser) {
+	if expr, ok := getRunningExpr(w, r); ok {
+		writeJsonPayload(w, &AdminExpressionJson{OwnerId: expr.GetOwnerId(), Expression: expr})
+	}
+}
+
+/*
+adminCancelHandler отменяет выполняющееся выражение любого пользователя, например зависшее, и переносит его в БД.
+*/
+func adminCancelHandler(w http.ResponseWriter, r *http.Request, _ backend.CommonUser) {
+	expr, ok := getRunningExpr(w, r)
+	if !ok {
+		return
+	}
+	if err := expr.Cancel("отменено администратором"); err != nil { // выражение успело посчитаться.
+		writeExprFinished(w, expr.GetId())
+		return
+	}
+	if err := finishExpr(expr); err != nil {
+		log.Panic(err)
+	}
+	writeJsonPayload(w, &AdminExpressionJson{OwnerId: expr.GetOwnerId(), Expression: expr})
+}
+
+/*
+getRunningExpr находит в exprsList выражение с id из пути запроса. Завершённые выражения в exprsList не хранятся,
+поэтому на них, как и на несуществующие, getRunningExpr отвечает 404.
+*/
+func getRunningExpr(w http.ResponseWriter, r *http.Request) (expr backend.CommonExpression, ok bool) {
+	exprId, ok := parseExprId(w, r)
+	if !ok {
+		return
+	}
+	if expr, ok = exprsList.Get(exprId); !ok {
+		writeNotFound(w, fmt.Sprintf("выполняющееся выражение %d не найдено", exprId))
+	}
+	return
+}
+
+/*
+adminDisableHandler отключает пользователя: войти под ним больше нельзя, а его сессии отзываются, поэтому уже
+выпущенные токены перестают приниматься. Свой аккаунт отключить нельзя, чтобы не остаться без администратора.
+*/
+func adminDisableHandler(w http.ResponseWriter, r *http.Request, admin backend.CommonUser) {
+	userId, ok := parseUserId(w, r)
+	if !ok {
+		return
+	}
+	if userId == admin.GetId() {
+		writeError(w, http.StatusBadRequest, ErrorInvalidParams, "нельзя отключить свой аккаунт", nil)
+		return
+	}
+	var now = time.Now()
+	if !updateDisabledAt(w, userId, now) {
+		return
+	}
+	if err := db.RevokeUserSessions(userId, now); err != nil {
+		log.Panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminEnableHandler снова разрешает вход отключённому пользователю.
+func adminEnableHandler(w http.ResponseWriter, r *http.Request, _ backend.CommonUser) {
+	if userId, ok := parseUserId(w, r); ok && updateDisabledAt(w, userId, time.Time{}) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// updateDisabledAt вызывает db.UpdateDisabledAt. Если пользователя нет, отвечает 404 и возвращает false.
+func updateDisabledAt(w http.ResponseWriter, userId int64, disabledAt time.Time) (ok bool) {
+	err := db.UpdateDisabledAt(userId, disabledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeNotFound(w, fmt.Sprintf("пользователь %d не найден", userId))
+		return
+	} else if err != nil {
+		log.Panic(err)
+	}
+	return true
+}
+
+// parseUserId читает id пользователя из пути запроса. Если id не число, parseUserId отвечает 400 и возвращает false.
+func parseUserId(w http.ResponseWriter, r *http.Request) (userId int64, ok bool) {
+	userId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidId, "id пользователя должен быть целым числом", nil)
+		return
+	}
+	return userId, true
+}
+
+func writeJsonPayload(w http.ResponseWriter, payload backend.JsonPayload) {
+	payloadInBytes, err := payload.Marshal()
+	if err != nil {
+		log.Panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(payloadInBytes); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeAccountDisabled(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, ErrorAccountDisabled, "аккаунт отключён администратором", nil)
+}
+
+/*
+runRoleCommand выполняет команду оркестратора role <логин> user|admin: назначает пользователю роль. Сессии
+пользователя отзываются, чтобы токены со старой ролью перестали приниматься.
+*/
+func runRoleCommand(d DbWrapper, args []string, out io.Writer) (err error) {
+	if len(args) != 2 {
+		return errors.New("использование: role <логин> user|admin")
+	}
+	role, err := ParseRole(args[1])
+	if err != nil {
+		return
+	}
+	user, err := d.SelectUser(args[0])
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("пользователь %s не найден", args[0])
+	} else if err != nil {
+		return
+	}
+	if err = d.UpdateRole(user.GetId(), role); err != nil {
+		return
+	}
+	if err = d.RevokeUserSessions(user.GetId(), time.Now()); err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(out, "пользователю %s назначена роль %s\n", user.GetLogin(), role)
+	return
+}
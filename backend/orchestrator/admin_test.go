@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	t.Cleanup(func() {
+		db = callStubDbWithRegisteredUserFabric(testUser)
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	db = CallMemoryDbFabric()
+	exprsList = CallEmptyExpressionListFabric()
+	var ids = make(map[string]int64)
+	for _, login := range []string{"admin", "user"} {
+		w := serveWithBody(http.MethodPost, "/api/v1/register", `{"login": "`+login+`", "password": "qwerty"}`)
+		var userId UserIdJson
+		if !assert.Equal(t, http.StatusCreated, w.Code) || !assert.NoError(t, json.Unmarshal(w.Body.Bytes(),
+			&userId)) {
+			return
+		}
+		ids[login] = userId.Id
+	}
+	var (
+		beforeRole = requestTokens(t, "/api/v1/login", `{"login": "admin", "password": "qwerty"}`)
+		user       = requestTokens(t, "/api/v1/login", `{"login": "user", "password": "qwerty"}`)
+		out        bytes.Buffer
+	)
+	t.Run("RoleCommand", func(t *testing.T) {
+		assert.Error(t, runRoleCommand(db, []string{"admin", "root"}, &out))
+		assert.Error(t, runRoleCommand(db, []string{"nobody", "admin"}, &out))
+		assert.Error(t, runRoleCommand(db, []string{"admin"}, &out))
+		if assert.NoError(t, runRoleCommand(db, []string{"admin", "admin"}, &out)) {
+			assert.Contains(t, out.String(), "admin")
+		}
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(beforeRole.Token))
+	})
+	var admin = requestTokens(t, "/api/v2/login", `{"login": "admin", "password": "qwerty"}`)
+
+	t.Run("Forbidden", func(t *testing.T) {
+		assertErrorJson(t, serveWithBearer(http.MethodGet, "/api/v2/admin/users", user.Token, ""),
+			http.StatusForbidden, ErrorForbidden)
+		assertErrorJson(t, serveWithBearer(http.MethodGet, "/api/v2/admin/expressions", "", ""),
+			http.StatusUnauthorized, ErrorUnauthorized)
+	})
+	t.Run("Users", func(t *testing.T) {
+		w := serveWithBearer(http.MethodGet, "/api/v2/admin/users", admin.Token, "")
+		var accounts AccountsJsonTitle
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &accounts)) {
+			assert.Equal(t, []AccountJson{{Id: ids["admin"], Login: "admin", Role: RoleAdmin},
+				{Id: ids["user"], Login: "user", Role: RoleUser}}, accounts.Users)
+		}
+	})
+	t.Run("Expressions", func(t *testing.T) {
+		w := serveWithBearer(http.MethodPost, "/api/v2/calculate", user.Token, `{"expression": "2+2*2"}`)
+		var exprId struct {
+			Id int `json:"id"`
+		}
+		if !assert.Equal(t, http.StatusCreated, w.Code) || !assert.NoError(t, json.Unmarshal(w.Body.Bytes(),
+			&exprId)) {
+			return
+		}
+		var exprPath = "/api/v2/admin/expressions/" + strconv.Itoa(exprId.Id)
+
+		w = serveWithBearer(http.MethodGet, "/api/v2/admin/expressions", admin.Token, "")
+		var exprs struct {
+			Expressions []struct {
+				OwnerId    int64 `json:"ownerId"`
+				Expression struct {
+					Id     int    `json:"id"`
+					Status string `json:"status"`
+				} `json:"expression"`
+			} `json:"expressions"`
+		}
+		if assert.Equal(t, http.StatusOK, w.Code) && assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &exprs)) &&
+			assert.Len(t, exprs.Expressions, 1) {
+			assert.Equal(t, ids["user"], exprs.Expressions[0].OwnerId)
+			assert.Equal(t, exprId.Id, exprs.Expressions[0].Expression.Id)
+		}
+		assert.Equal(t, http.StatusOK, serveWithBearer(http.MethodGet, exprPath, admin.Token, "").Code)
+
+		w = serveWithBearer(http.MethodDelete, exprPath, admin.Token, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "отменено администратором")
+		assert.Empty(t, exprsList.GetAll())
+		assertErrorJson(t, serveWithBearer(http.MethodDelete, exprPath, admin.Token, ""), http.StatusNotFound,
+			ErrorNotFound)
+		assertErrorJson(t, serveWithBearer(http.MethodGet, "/api/v2/admin/expressions/x", admin.Token, ""),
+			http.StatusBadRequest, ErrorInvalidId)
+	})
+	t.Run("DisableAndEnable", func(t *testing.T) {
+		var userPath = "/api/v2/admin/users/" + strconv.FormatInt(ids["user"], 10) + "/disabled"
+		assertErrorJson(t, serveWithBearer(http.MethodPut, "/api/v2/admin/users/"+
+			strconv.FormatInt(ids["admin"], 10)+"/disabled", admin.Token, ""), http.StatusBadRequest,
+			ErrorInvalidParams)
+		assertErrorJson(t, serveWithBearer(http.MethodPut, "/api/v2/admin/users/1000/disabled", admin.Token, ""),
+			http.StatusNotFound, ErrorNotFound)
+
+		assert.Equal(t, http.StatusNoContent, serveWithBearer(http.MethodPut, userPath, admin.Token, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(user.Token))
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/refresh", `{"refreshToken": "`+
+			user.RefreshToken+`"}`), http.StatusUnauthorized, ErrorUnauthorized)
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login",
+			`{"login": "user", "password": "qwerty"}`), http.StatusForbidden, ErrorAccountDisabled)
+
+		assert.Equal(t, http.StatusNoContent, serveWithBearer(http.MethodDelete, userPath, admin.Token, "").Code)
+		requestTokens(t, "/api/v1/login", `{"login": "user", "password": "qwerty"}`)
+	})
+	t.Run("RefreshKeepsRole", func(t *testing.T) {
+		refreshed := requestTokens(t, "/api/v2/refresh", `{"refreshToken": "`+admin.RefreshToken+`"}`)
+		assert.Equal(t, http.StatusOK, serveWithBearer(http.MethodGet, "/api/v2/admin/users", refreshed.Token,
+			"").Code)
+	})
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
 	"log"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func GetDefaultHttpServer(handler http.Handler) *http.Server {
@@ -14,18 +19,179 @@ func GetDefaultGrpcServer() *GrpcTaskServer {
 	return &GrpcTaskServer{Addr: "127.0.0.1:5000"}
 }
 
-func GetDefaultSqlServer() *sql.DB {
-	var db, err = sql.Open("sqlite3", "calc.db")
+/*
+GetDefaultDbDsn возвращает DB_DSN: путь к файлу SQLite (по умолчанию calc.db), postgres://... для PostgreSQL или
+memory:// для MemoryDb.
+*/
+func GetDefaultDbDsn() string {
+	var dsn, _ = backend.CallEnvVarFabric("DB_DSN", "calc.db").Get()
+	return dsn
+}
+
+/*
+CallDefaultDbWrapperFabric создаёт хранилище, заданное DB_DSN: MemoryDb для memory://, иначе Db.
+*/
+func CallDefaultDbWrapperFabric() DbWrapper {
+	if GetDefaultDbDsn() == memoryDsn {
+		return CallMemoryDbFabric()
+	}
+	return CallDbFabric()
+}
+
+// GetDefaultSqlServer открывает SQL-БД, заданную DB_DSN.
+func GetDefaultSqlServer() (*sql.DB, sqlDialect) {
+	var (
+		dsn     = GetDefaultDbDsn()
+		dialect = getDialect(dsn)
+	)
+	var db, err = sql.Open(dialect.driverName, dsn)
 	if err != nil {
 		log.Panic(err)
 	}
-	return db
+	return db, dialect
+}
+
+/*
+GetDefaultReplicaId возвращает имя реплики оркестратора (REPLICA_ID). После перезапуска реплика восстанавливает
+только те выражения, которые выполняла сама.
+*/
+func GetDefaultReplicaId() string {
+	var replicaId, _ = backend.CallEnvVarFabric("REPLICA_ID", "").Get()
+	return replicaId
 }
 
-func GetTestSqlServer() *sql.DB {
-	var db, err = sql.Open("sqlite3", "testCalc.db")
+// GetTestSqlServer открывает testCalc.db в каталоге dir. Тесты передают t.TempDir(), чтобы не трогать calc.db.
+func GetTestSqlServer(dir string) *sql.DB {
+	var db, err = sql.Open("sqlite3", filepath.Join(dir, "testCalc.db"))
 	if err != nil {
 		log.Panic(err)
 	}
 	return db
 }
+
+/*
+GetTestPostgresServer открывает PostgreSQL из TEST_POSTGRES_DSN. Если переменная не задана, возвращается false, и
+тесты с PostgreSQL пропускаются.
+*/
+func GetTestPostgresServer() (*sql.DB, bool) {
+	var dsn, ok = backend.CallEnvVarFabric("TEST_POSTGRES_DSN", "").Get()
+	if !ok || dsn == "" {
+		return nil, false
+	}
+	var db, err = sql.Open(postgresDialect.driverName, dsn)
+	if err != nil {
+		log.Panic(err)
+	}
+	return db, true
+}
+
+// getBoolEnv читает логическую переменную среды key.
+func getBoolEnv(key string, defaultValue string) (result bool) {
+	result, err := parseBoolEnv(key, defaultValue)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// parseBoolEnv, в отличие от getBoolEnv, возвращает ошибку, а не паникует.
+func parseBoolEnv(key string, defaultValue string) (result bool, err error) {
+	var maybeEnabled, _ = backend.CallEnvVarFabric(key, defaultValue).Get()
+	if result, err = strconv.ParseBool(maybeEnabled); err != nil {
+		return false, fmt.Errorf("%s должен быть true или false, получено %q", key, maybeEnabled)
+	}
+	return
+}
+
+// getIntEnv читает целочисленную переменную среды key.
+func getIntEnv(key string, defaultValue string) (result int) {
+	result, err := parseIntEnv(key, defaultValue)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// parseIntEnv, в отличие от getIntEnv, возвращает ошибку, а не паникует.
+func parseIntEnv(key string, defaultValue string) (result int, err error) {
+	var maybeInt, _ = backend.CallEnvVarFabric(key, defaultValue).Get()
+	if result, err = strconv.Atoi(maybeInt); err != nil {
+		return 0, fmt.Errorf("%s должен быть целым числом, получено %q", key, maybeInt)
+	}
+	return
+}
+
+// getDurationEnv читает переменную среды key в формате time.ParseDuration.
+func getDurationEnv(key string, defaultValue string) (result time.Duration) {
+	result, err := parseDurationEnv(key, defaultValue)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// parseDurationEnv, в отличие от getDurationEnv, возвращает ошибку, а не паникует.
+func parseDurationEnv(key string, defaultValue string) (result time.Duration, err error) {
+	var maybeDuration, _ = backend.CallEnvVarFabric(key, defaultValue).Get()
+	if result, err = time.ParseDuration(maybeDuration); err != nil {
+		return 0, fmt.Errorf("%s должен быть в формате <число><ns/us/ms/s/m/h>, получено %q", key, maybeDuration)
+	}
+	return
+}
+
+// GetDefaultMaxAttempts читает TASK_MAX_ATTEMPTS: сколько раз один Task может быть выдан агентам (по умолчанию 3).
+func GetDefaultMaxAttempts() (maxAttempts int, err error) {
+	var maybeAttempts, _ = backend.CallEnvVarFabric("TASK_MAX_ATTEMPTS", "3").Get()
+	if maxAttempts, err = strconv.Atoi(maybeAttempts); err != nil || maxAttempts < 1 {
+		return 0, fmt.Errorf("TASK_MAX_ATTEMPTS должен быть целым числом не меньше 1, получено %q", maybeAttempts)
+	}
+	return
+}
+
+/*
+GetDefaultLateResultPolicy читает LATE_RESULT_POLICY: что делать с результатом, пришедшим позже допустимого времени
+(по умолчанию fail).
+*/
+func GetDefaultLateResultPolicy() (policy backend.LateResultPolicy, err error) {
+	var maybePolicy, _ = backend.CallEnvVarFabric("LATE_RESULT_POLICY", string(backend.FailOnLateResult)).Get()
+	if policy = backend.LateResultPolicy(maybePolicy); !policy.IsKnown() {
+		return "", fmt.Errorf("LATE_RESULT_POLICY должен быть одним из %s, %s, %s, получено %q",
+			backend.RedispatchLateResult, backend.AcceptLateResult, backend.FailOnLateResult, maybePolicy)
+	}
+	return
+}
+
+/*
+configureTasks передаёт backend настройки выдачи Task-ов. Вызывается один раз при запуске оркестратора, чтобы
+ошибка в переменных среды останавливала его сразу, а не при обработке результата агента.
+*/
+func configureTasks() (err error) {
+	maxAttempts, err := GetDefaultMaxAttempts()
+	if err != nil {
+		return
+	}
+	policy, err := GetDefaultLateResultPolicy()
+	if err != nil {
+		return
+	}
+	backend.SetMaxAttempts(maxAttempts)
+	backend.SetLateResultPolicy(policy)
+	return
+}
+
+/*
+configureAccounts, как и configureTasks, один раз при запуске читает настройки пользователей, чтобы ошибка в них
+останавливала оркестратор, а не превращалась в ответы 500 на регистрацию, вход и смену пароля.
+*/
+func configureAccounts() (err error) {
+	policy, err := GetDefaultPasswordPolicy()
+	if err != nil {
+		return
+	}
+	ttl, err := GetDefaultRefreshTtl()
+	if err != nil {
+		return
+	}
+	passwordPolicy, refreshTtl = policy, ttl
+	return
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAccountsConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		ttl, err := GetDefaultRefreshTtl()
+		assert.NoError(t, err)
+		assert.Equal(t, refreshTtl, ttl)
+	})
+	t.Run("InvalidRefreshTtl", func(t *testing.T) {
+		for _, value := range []string{"month", "0s", "-1h"} {
+			t.Setenv("JWT_REFRESH_TTL", value)
+			_, err := GetDefaultRefreshTtl()
+			assert.ErrorContains(t, err, "JWT_REFRESH_TTL", value)
+		}
+	})
+	t.Run("FailsOnInvalidEnv", func(t *testing.T) {
+		t.Setenv("PASSWORD_REQUIRE_LETTER", "yes please")
+		assert.ErrorContains(t, configureAccounts(), "PASSWORD_REQUIRE_LETTER")
+	})
+}
+
+func TestTasksConfig(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		maxAttempts, err := GetDefaultMaxAttempts()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, maxAttempts)
+		policy, err := GetDefaultLateResultPolicy()
+		assert.NoError(t, err)
+		assert.Equal(t, backend.FailOnLateResult, policy)
+	})
+	t.Run("InvalidMaxAttempts", func(t *testing.T) {
+		for _, value := range []string{"three", "0", "-1"} {
+			t.Setenv("TASK_MAX_ATTEMPTS", value)
+			_, err := GetDefaultMaxAttempts()
+			assert.ErrorContains(t, err, "TASK_MAX_ATTEMPTS", value)
+		}
+	})
+	t.Run("InvalidLateResultPolicy", func(t *testing.T) {
+		t.Setenv("LATE_RESULT_POLICY", "retry")
+		_, err := GetDefaultLateResultPolicy()
+		assert.ErrorContains(t, err, "LATE_RESULT_POLICY")
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxLoginLength = 64
+	// maxPasswordBytes -- предел bcrypt: более длинный пароль HashMan не захеширует.
+	maxPasswordBytes = 72
+)
+
+/*
+PasswordPolicy -- требования к паролю при регистрации и смене пароля. Задаются переменными среды
+PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE_LETTER, PASSWORD_REQUIRE_DIGIT и PASSWORD_REQUIRE_SPECIAL (см.
+GetDefaultPasswordPolicy).
+*/
+type PasswordPolicy struct {
+	MinLength      int
+	RequireLetter  bool
+	RequireDigit   bool
+	RequireSpecial bool
+}
+
+/*
+Check возвращает ошибку, перечисляющую все нарушенные требования, или nil. Длина считается в символах, предел bcrypt
+-- в байтах.
+*/
+func (p PasswordPolicy) Check(password string) error {
+	if password == "" {
+		return errors.New("пароль не может быть пустым")
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("пароль длиннее %d байт", maxPasswordBytes)
+	}
+	var (
+		violations                    []string
+		hasLetter, hasDigit, hasOther bool
+	)
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("быть не короче %d символов", p.MinLength))
+	}
+	if p.RequireLetter && !hasLetter {
+		violations = append(violations, "содержать букву")
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, "содержать цифру")
+	}
+	if p.RequireSpecial && !hasOther {
+		violations = append(violations, "содержать символ, отличный от буквы и цифры")
+	}
+	if violations != nil {
+		return errors.New("пароль должен " + strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// GetDefaultPasswordPolicy читает PasswordPolicy из переменных среды. По умолчанию требуется только длина от 6 символов.
+func GetDefaultPasswordPolicy() (policy PasswordPolicy, err error) {
+	if policy.MinLength, err = parseIntEnv("PASSWORD_MIN_LENGTH", "6"); err != nil {
+		return
+	}
+	if policy.MinLength < 0 {
+		return policy, fmt.Errorf("PASSWORD_MIN_LENGTH не может быть отрицательным, получено %d", policy.MinLength)
+	}
+	for _, setting := range []struct {
+		key   string
+		value *bool
+	}{{"PASSWORD_REQUIRE_LETTER", &policy.RequireLetter}, {"PASSWORD_REQUIRE_DIGIT", &policy.RequireDigit},
+		{"PASSWORD_REQUIRE_SPECIAL", &policy.RequireSpecial}} {
+		if *setting.value, err = parseBoolEnv(setting.key, "false"); err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+passwordPolicy -- действующие требования к паролю. Оркестратор задаёт их при запуске через configureAccounts.
+*/
+var passwordPolicy = PasswordPolicy{MinLength: 6}
+
+// checkLogin проверяет, что логин не пуст, не длиннее maxLoginLength символов и не содержит пробельных символов.
+func checkLogin(login string) error {
+	if login == "" {
+		return errors.New("логин не может быть пустым")
+	}
+	if utf8.RuneCountInString(login) > maxLoginLength {
+		return fmt.Errorf("логин длиннее %d символов", maxLoginLength)
+	}
+	if strings.IndexFunc(login, unicode.IsSpace) != -1 {
+		return errors.New("логин не может содержать пробельные символы")
+	}
+	return nil
+}
+
+// checkCredentials проверяет логин и пароль регистрирующегося пользователя до хеширования пароля.
+func checkCredentials(user backend.UserWithPassword) error {
+	if err := checkLogin(user.GetLogin()); err != nil {
+		return err
+	}
+	return passwordPolicy.Check(user.GetPassword())
+}
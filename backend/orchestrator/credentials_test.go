@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// usePasswordPolicy подменяет passwordPolicy на время теста.
+func usePasswordPolicy(t *testing.T, policy PasswordPolicy) {
+	var previous = passwordPolicy
+	t.Cleanup(func() {
+		passwordPolicy = previous
+	})
+	passwordPolicy = policy
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		policy, err := GetDefaultPasswordPolicy()
+		assert.NoError(t, err)
+		assert.Equal(t, PasswordPolicy{MinLength: 6}, policy)
+		assert.Equal(t, passwordPolicy, policy)
+		assert.NoError(t, policy.Check("qwerty"))
+		assert.NoError(t, policy.Check("пароль"))
+		assert.EqualError(t, policy.Check("qwert"), "пароль должен быть не короче 6 символов")
+	})
+	t.Run("FromEnv", func(t *testing.T) {
+		t.Setenv("PASSWORD_MIN_LENGTH", "10")
+		t.Setenv("PASSWORD_REQUIRE_LETTER", "true")
+		t.Setenv("PASSWORD_REQUIRE_DIGIT", "true")
+		t.Setenv("PASSWORD_REQUIRE_SPECIAL", "true")
+		policy, err := GetDefaultPasswordPolicy()
+		assert.NoError(t, err)
+		assert.Equal(t, PasswordPolicy{MinLength: 10, RequireLetter: true, RequireDigit: true, RequireSpecial: true},
+			policy)
+		assert.NoError(t, policy.Check("qwerty-123"))
+		assert.EqualError(t, policy.Check("12345"), "пароль должен быть не короче 10 символов, содержать букву, "+
+			"содержать символ, отличный от буквы и цифры")
+	})
+	t.Run("InvalidEnv", func(t *testing.T) {
+		var invalidValues = map[string]string{"PASSWORD_MIN_LENGTH": "six", "PASSWORD_REQUIRE_DIGIT": "yes please"}
+		for key, value := range invalidValues {
+			t.Run(key, func(t *testing.T) {
+				t.Setenv(key, value)
+				_, err := GetDefaultPasswordPolicy()
+				assert.ErrorContains(t, err, key)
+			})
+		}
+		t.Setenv("PASSWORD_MIN_LENGTH", "-1")
+		_, err := GetDefaultPasswordPolicy()
+		assert.ErrorContains(t, err, "PASSWORD_MIN_LENGTH")
+	})
+}
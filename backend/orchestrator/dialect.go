@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+/*
+sqlDialect описывает различия SQLite и PostgreSQL, которые нужно учитывать в запросах и миграциях. Запросы,
+одинаковые для обеих БД, пишутся один раз: обе понимают параметры $1, $2, ..., ON CONFLICT и RETURNING.
+*/
+type sqlDialect struct {
+	driverName string
+	/*
+		serialKey, floatType и bigintType подставляются в DDL миграций вместо {{serialKey}}, {{float}} и {{bigint}}.
+	*/
+	serialKey  string
+	floatType  string
+	bigintType string
+	/*
+		hasColumnQuery возвращает количество колонок $2 в таблице $1.
+	*/
+	hasColumnQuery string
+	/*
+		reserveExprIdQuery выдаёт новый id выражения, не повторяющийся между репликами оркестратора.
+	*/
+	reserveExprIdQuery string
+	/*
+		isUniqueViolation сообщает, что запрос нарушил ограничение UNIQUE (например, логин уже занят).
+	*/
+	isUniqueViolation func(err error) bool
+}
+
+func (s sqlDialect) ddl(query string) string {
+	return strings.NewReplacer("{{serialKey}}", s.serialKey, "{{float}}", s.floatType,
+		"{{bigint}}", s.bigintType).Replace(query)
+}
+
+var sqliteDialect = sqlDialect{
+	driverName: "sqlite3",
+	serialKey:  "INTEGER PRIMARY KEY AUTOINCREMENT",
+	floatType:  "REAL",
+	bigintType: "INTEGER",
+	hasColumnQuery: `
+	SELECT COUNT(*) FROM pragma_table_info($1) WHERE name=$2
+	`,
+	reserveExprIdQuery: `
+	INSERT INTO expr_ids DEFAULT VALUES RETURNING id
+	`,
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr sqlite3.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	},
+}
+
+var postgresDialect = sqlDialect{
+	driverName: "postgres",
+	serialKey:  "BIGSERIAL PRIMARY KEY",
+	floatType:  "DOUBLE PRECISION",
+	bigintType: "BIGINT",
+	hasColumnQuery: `
+	SELECT COUNT(*) FROM information_schema.columns
+	WHERE table_schema=current_schema() AND table_name=$1 AND column_name=lower($2::text)
+	`,
+	reserveExprIdQuery: `
+	SELECT nextval('expr_ids')
+	`,
+	isUniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505" // unique_violation.
+	},
+}
+
+/*
+getDialect выбирает БД по DSN: postgres://... и postgresql://... -- PostgreSQL, всё остальное -- путь к файлу SQLite.
+*/
+func getDialect(dsn string) sqlDialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExprsSort -- поле, по которому упорядочивается список выражений.
+type ExprsSort string
+
+const (
+	SortById ExprsSort = "id"
+	/*
+		SortByFinishedAt упорядочивает по моменту завершения, выражения с одинаковым моментом -- по id. У
+		незавершённых выражений момент завершения нулевой, поэтому по возрастанию они идут первыми.
+	*/
+	SortByFinishedAt ExprsSort = "finishedAt"
+)
+
+const (
+	defaultExprsLimit = 100
+	maxExprsLimit     = 1000
+)
+
+/*
+ExprsCursor -- позиция в упорядоченном списке выражений: страница начинается с выражений, идущих после выражения с
+этими id и моментом завершения.
+*/
+type ExprsCursor struct {
+	Id         int
+	FinishedAt time.Time
+}
+
+/*
+ExprsFilter описывает, какие выражения пользователя и в каком порядке нужно вернуть. Нулевые поля выборку не
+ограничивают: нулевой ExprsFilter возвращает все выражения по возрастанию id.
+*/
+type ExprsFilter struct {
+	Statuses      []backend.ExprStatus
+	SubmittedFrom time.Time // включительно.
+	SubmittedTo   time.Time // не включительно.
+	SortBy        ExprsSort
+	Desc          bool
+	After         *ExprsCursor
+	Limit         int
+}
+
+func (f ExprsFilter) cursorOf(expr backend.ShortExpression) ExprsCursor {
+	return ExprsCursor{Id: expr.GetId(), FinishedAt: expr.GetTimestamps().FinishedAt}
+}
+
+// compare сравнивает позиции выражений в порядке, заданном SortBy и Desc.
+func (f ExprsFilter) compare(a ExprsCursor, b ExprsCursor) (result int) {
+	if f.SortBy == SortByFinishedAt {
+		result = cmp.Compare(timeToDb(a.FinishedAt), timeToDb(b.FinishedAt))
+	}
+	if result == 0 {
+		result = cmp.Compare(a.Id, b.Id)
+	}
+	if f.Desc {
+		result = -result
+	}
+	return
+}
+
+// Match сообщает, подходит ли выражение под фильтр без учёта Limit.
+func (f ExprsFilter) Match(expr backend.ShortExpression) bool {
+	var submittedAt = expr.GetTimestamps().SubmittedAt
+	if len(f.Statuses) != 0 && !slices.Contains(f.Statuses, expr.GetStatus()) {
+		return false
+	}
+	if !f.SubmittedFrom.IsZero() && submittedAt.Before(f.SubmittedFrom) {
+		return false
+	}
+	if !f.SubmittedTo.IsZero() && !submittedAt.Before(f.SubmittedTo) {
+		return false
+	}
+	return f.After == nil || f.compare(f.cursorOf(expr), *f.After) > 0
+}
+
+func (f ExprsFilter) sort(exprs []backend.ShortExpression) {
+	slices.SortFunc(exprs, func(a backend.ShortExpression, b backend.ShortExpression) int {
+		return f.compare(f.cursorOf(a), f.cursorOf(b))
+	})
+}
+
+/*
+Apply отбирает подходящие выражения, упорядочивает их и оставляет не больше Limit. Нужен хранилищам, которые не
+умеют фильтровать сами.
+*/
+func (f ExprsFilter) Apply(exprs []backend.ShortExpression) (result []backend.ShortExpression) {
+	for _, expr := range exprs {
+		if f.Match(expr) {
+			result = append(result, expr)
+		}
+	}
+	f.sort(result)
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[:f.Limit]
+	}
+	return
+}
+
+/*
+encodeCursor превращает позицию в строку для nextCursor. Порядок сортировки входит в строку, чтобы курсор нельзя
+было применить к списку, упорядоченному иначе.
+*/
+func (f ExprsFilter) encodeCursor(cursor ExprsCursor) string {
+	var raw = fmt.Sprintf("%s:%t:%d:%d", f.sortBy(), f.Desc, timeToDb(cursor.FinishedAt), cursor.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func (f ExprsFilter) parseCursor(encoded string) (cursor ExprsCursor, err error) {
+	var (
+		raw         []byte
+		parts       []string
+		finishedAt  int64
+		errBadValue = errors.New("неверный cursor")
+	)
+	if raw, err = base64.RawURLEncoding.DecodeString(encoded); err != nil {
+		return cursor, errBadValue
+	}
+	parts = strings.Split(string(raw), ":")
+	if len(parts) != 4 {
+		return cursor, errBadValue
+	}
+	if parts[0] != string(f.sortBy()) || parts[1] != strconv.FormatBool(f.Desc) {
+		return cursor, errors.New("cursor получен для другого порядка сортировки")
+	}
+	if finishedAt, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return cursor, errBadValue
+	}
+	if cursor.Id, err = strconv.Atoi(parts[3]); err != nil {
+		return cursor, errBadValue
+	}
+	cursor.FinishedAt = timeFromDb(finishedAt)
+	return
+}
+
+func (f ExprsFilter) sortBy() ExprsSort {
+	if f.SortBy == "" {
+		return SortById
+	}
+	return f.SortBy
+}
@@ -6,14 +6,15 @@ replace github.com/Debianov/calc-ya-go-24 v0.0.0-20250302045807-432e7a102e57 =>
 
 require (
 	github.com/Debianov/calc-ya-go-24 v0.0.0-20250302045807-432e7a102e57
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/stretchr/testify v1.10.0
 	google.golang.org/grpc v1.72.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.38.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
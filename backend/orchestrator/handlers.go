@@ -2,34 +2,40 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/Debianov/calc-ya-go-24/backend"
 	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
 	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
 	"log"
 	"net/http"
-	"slices"
 	"strconv"
 	"time"
 )
 
 var (
-	db            DbWrapper             = CallDbFabric()
-	lastExprId, _                       = db.GetLastExprId()
-	exprsList     CommonExpressionsList = CallExpressionListWithLastIdFabric(lastExprId + 1)
+	// db создаётся в main после разбора команды, чтобы migrate и role не меняли схему БД.
+	db             DbWrapper
+	exprsList      CommonExpressionsList = CallEmptyExpressionListFabric()
+	jwtKeyring                           = CallDefaultJwtKeyringFabric()
+	loginThrottler                       = CallDefaultLoginThrottlerFabric()
 )
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusNotFound)
+		writeRouteNotFound(w, r)
 		return
 	}
-	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(http.StatusNotFound)
+	if !hasJsonBody(r) {
+		writeUnsupportedMediaType(w)
 		return
 	}
 	var (
@@ -44,31 +50,52 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.Unmarshal(reqBuf, &jsonUser)
 	if err != nil {
-		log.Panic(err)
+		writeBadJson(w, err)
+		return
+	}
+	if err = checkCredentials(jsonUser); err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidCredentials, err.Error(), nil)
+		return
 	}
 	dbUser, err = backend.WrapIntoDbUser(jsonUser)
 	if err != nil {
 		log.Panic(err)
 	}
 	var (
-		lastId int64
+		lastId        int64
+		alreadyExists backend.LoginAlreadyExists
 	)
 	lastId, err = db.InsertUser(dbUser)
+	if errors.As(err, &alreadyExists) {
+		writeError(w, http.StatusConflict, ErrorLoginTaken, alreadyExists.Error(), nil)
+		return
+	} else if err != nil {
+		log.Panic(err)
+	}
+	dbUser.SetId(lastId)
+	var (
+		userIdJson    = UserIdJson{Id: dbUser.GetId()}
+		userIdInBytes []byte
+	)
+	userIdInBytes, err = userIdJson.Marshal()
 	if err != nil {
 		log.Panic(err)
-	} else {
-		dbUser.SetId(lastId)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write(userIdInBytes); err != nil {
+		log.Println(err)
 	}
 	return
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusNotFound)
+		writeRouteNotFound(w, r)
 		return
 	}
-	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(http.StatusNotFound)
+	if !hasJsonBody(r) {
+		writeUnsupportedMediaType(w)
 		return
 	}
 	var (
@@ -83,36 +110,139 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.Unmarshal(reqBuf, jsonUser)
 	if err != nil {
-		log.Panic(err)
+		writeBadJson(w, err)
+		return
 	}
 	var (
+		ip         = clientIp(r)
 		userFromDb backend.UserWithHashedPassword
 	)
+	if lockedFor := loginThrottler.LockedFor(jsonUser.GetLogin(), ip, time.Now()); lockedFor > 0 {
+		auditLog.Printf("login=%q ip=%s отклонено: попытки заблокированы ещё на %s", jsonUser.GetLogin(), ip,
+			lockedFor.Round(time.Second))
+		writeTooManyAttempts(w, lockedFor)
+		return
+	}
 	userFromDb, err = db.SelectUser(jsonUser.GetLogin())
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		// сравниваем с ненастоящим хешем, чтобы время ответа не выдавало, есть ли логин.
+		userFromDb = backend.CallDbUserFabric(0, jsonUser.GetLogin(), dummyPasswordHash())
+	}
+	if !userFromDb.Is(jsonUser) || err != nil { // не сообщаем, существует ли логин.
+		// время берётся после проверки пароля, чтобы она не сокращала блокировку.
+		var attempt = loginThrottler.RecordFailure(jsonUser.GetLogin(), ip, time.Now())
+		auditLog.Printf("login=%q ip=%s неудачная попытка №%d: %s", jsonUser.GetLogin(), ip, attempt,
+			failureReason(err))
+		writeError(w, http.StatusUnauthorized, ErrorUnauthorized, "неверный логин или пароль", nil)
 		return
 	}
-	if !userFromDb.Is(jsonUser) {
-		w.WriteHeader(http.StatusUnauthorized)
+	loginThrottler.RecordSuccess(jsonUser.GetLogin())
+	var account = selectAccount(userFromDb.GetId())
+	if account.IsDisabled() {
+		auditLog.Printf("login=%q ip=%s отклонено: аккаунт отключён", jsonUser.GetLogin(), ip)
+		writeAccountDisabled(w)
 		return
 	}
+	startSession(w, account)
+	return
+}
+
+// startSession создаёт сессию account и отвечает парой её токенов.
+func startSession(w http.ResponseWriter, account Account) {
 	var (
-		jwtToken        string
-		jwtTokenWrapper JwtTokenJsonWrapper
-		jwtTokenInBuf   []byte
+		refreshToken, refreshHash = generateRefreshToken()
+		now                       = time.Now()
+		session                   = Session{UserId: account.Id, Login: account.Login, CreatedAt: now,
+			ExpiresAt: now.Add(refreshTtl)}
+		err error
 	)
-	jwtToken, err = GenerateJwt(userFromDb)
+	session.Id, err = db.InsertSession(session.UserId, refreshHash, session.CreatedAt, session.ExpiresAt)
 	if err != nil {
 		log.Panic(err)
 	}
-	jwtTokenWrapper.Token = jwtToken
-	jwtTokenInBuf, err = jwtTokenWrapper.Marshal()
-	_, err = w.Write(jwtTokenInBuf)
+	writeTokens(w, session, account.Role, refreshToken)
+}
+
+/*
+refreshHandler обменивает токен обновления на новую пару токенов. Старый токен обновления после этого недействителен,
+поэтому повторно его использовать нельзя.
+*/
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	oldRefreshToken, ok := parseRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	var (
+		refreshToken, refreshHash = generateRefreshToken()
+		now                       = time.Now()
+	)
+	session, err := db.RotateSession(hashRefreshToken(oldRefreshToken), refreshHash, now,
+		now.Add(refreshTtl))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeInvalidRefreshToken(w)
+		return
+	} else if err != nil {
+		log.Panic(err)
+	}
+	var account = selectAccount(session.UserId) // роль берётся из БД: она могла измениться после входа.
+	if account.IsDisabled() {
+		writeAccountDisabled(w)
+		return
+	}
+	writeTokens(w, session, account.Role, refreshToken)
+}
+
+// logoutHandler отзывает сессию токена обновления; выпущенные для неё токены доступа перестают приниматься.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken, ok := parseRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	err := db.RevokeSession(hashRefreshToken(refreshToken), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		writeInvalidRefreshToken(w)
+		return
+	} else if err != nil {
+		log.Panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseRefreshToken читает RefreshTokenJson из тела запроса. Если это не удалось, ответ уже записан в w.
+func parseRefreshToken(w http.ResponseWriter, r *http.Request) (refreshToken string, ok bool) {
+	if r.Method != http.MethodPost {
+		writeRouteNotFound(w, r)
+		return
+	}
+	var requestStruct RefreshTokenJson
+	if !readJsonBody(w, r, &requestStruct) {
+		return
+	}
+	return requestStruct.RefreshToken, true
+}
+
+func writeInvalidRefreshToken(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, ErrorUnauthorized, "токен обновления недействителен", nil)
+}
+
+// writeTokens выпускает токен доступа с ролью role для session и отвечает им вместе с refreshToken.
+func writeTokens(w http.ResponseWriter, session Session, role Role, refreshToken string) {
+	var (
+		user       = backend.CallDbUserFabric(session.UserId, session.Login, "")
+		tokensJson = TokensJson{RefreshToken: refreshToken}
+		err        error
+	)
+	if tokensJson.Token, err = GenerateJwt(user, role, session.Id); err != nil {
+		log.Panic(err)
+	}
+	tokensInBytes, err := tokensJson.Marshal()
 	if err != nil {
 		log.Panic(err)
 	}
-	return
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(tokensInBytes); err != nil {
+		log.Println(err)
+	}
 }
 
 func calcHandler(w http.ResponseWriter, r *http.Request) {
@@ -120,11 +250,11 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		err error
 	)
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusNotFound)
+		writeRouteNotFound(w, r)
 		return
 	}
-	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(http.StatusNotFound)
+	if !hasJsonBody(r) {
+		writeUnsupportedMediaType(w)
 		return
 	}
 	var (
@@ -140,19 +270,42 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.Unmarshal(buf, &requestStruct)
 	if err != nil {
-		log.Panic(err)
+		writeBadJson(w, err)
+		return
 	}
 	user, err = ParseJwt(requestStruct.Token)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
-	postfix, ok := pkg.GeneratePostfix(requestStruct.Expression)
-	if !ok {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+	calculate(w, user, requestStruct.Expression)
+}
+
+// calculate разбирает выражение пользователя и ставит его в очередь на вычисление.
+func calculate(w http.ResponseWriter, user backend.CommonUser, expression string) {
+	tree, err := pkg.Parse(expression)
+	if err != nil {
+		var parseErr *pkg.ParseError
+		if !errors.As(err, &parseErr) {
+			log.Panic(err)
+		}
+		writeError(w, http.StatusUnprocessableEntity, ErrorInvalidExpression, "выражение не разобрано: "+
+			parseErr.Error(), parseErr)
 		return
 	}
-	expr, _ := exprsList.AddExprFabric(user.GetId(), postfix)
+	exprId, err := db.ReserveExprId()
+	if err != nil {
+		log.Panic(err)
+	}
+	expr := exprsList.AddExprFabric(exprId, user.GetId(), expression, tree)
+	if expr.GetStatus() == backend.Completed { // выражение без операторов не порождает задач для агента.
+		err = finishExpr(expr)
+	} else {
+		err = db.InsertExpr(expr) // если агенты успеют посчитать выражение раньше, БД его не перезапишет.
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 	exprIdInJson, err := expr.MarshalId()
 	if err != nil {
 		log.Panic(err)
@@ -164,62 +317,71 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func parseToken(r *http.Request) (user backend.CommonUser, err error) {
+/*
+parseToken читает пользователя из токена в теле запроса API v1. Если тело или токен неверны, parseToken сам отвечает
+ошибкой и возвращает false.
+*/
+func parseToken(w http.ResponseWriter, r *http.Request) (user backend.CommonUser, ok bool) {
 	var (
 		tokenBuf []byte
 		jwtToken JwtTokenJsonWrapper
+		err      error
 	)
 	tokenBuf, err = io.ReadAll(r.Body)
 	if err != nil {
-		return
+		log.Panic(err)
 	}
 	err = json.Unmarshal(tokenBuf, &jwtToken)
 	if err != nil {
+		writeBadJson(w, err)
 		return
 	}
 	user, err = ParseJwt(jwtToken.Token)
 	if err != nil {
+		writeUnauthorized(w)
 		return
 	}
-	return
+	return user, true
 }
 
 func expressionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusNotFound)
+		writeRouteNotFound(w, r)
 		return
 	}
 	var (
-		err  error
-		user backend.CommonUser
+		err           error
+		user          backend.CommonUser
+		reqBuf        []byte
+		requestStruct ExpressionsRequestJson
 	)
-	user, err = parseToken(r)
+	reqBuf, err = io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		log.Panic(err)
+	}
+	if err = json.Unmarshal(reqBuf, &requestStruct); err != nil {
+		writeBadJson(w, err)
 		return
 	}
-	var (
-		exprs         []backend.ShortExpression
-		exprsFromDb   []backend.ShortExpression
-		exprsFromList []backend.CommonExpression
-	)
-	exprsFromList = exprsList.GetAllOwned(user.GetId())
-	for _, expr := range exprsFromList {
-		exprs = append(exprs, expr)
+	if user, err = ParseJwt(requestStruct.Token); err != nil {
+		writeUnauthorized(w)
+		return
 	}
-	exprsFromDb, err = db.SelectAllExprs(user.GetId())
+	writeExpressionsPage(w, user, &requestStruct)
+}
+
+// writeExpressionsPage отвечает страницей выражений пользователя, заданной параметрами requestStruct.
+func writeExpressionsPage(w http.ResponseWriter, user backend.CommonUser, requestStruct *ExpressionsRequestJson) {
+	filter, err := requestStruct.ToFilter()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidParams, err.Error(), nil)
+		return
+	}
+	var exprsJsonHandler = backend.ExpressionsJsonTitle{}
+	exprsJsonHandler.Expressions, exprsJsonHandler.NextCursor, err = selectExprsPage(user.GetId(), filter)
 	if err != nil {
 		log.Panic(err)
 	}
-	exprs = append(exprs, exprsFromDb...)
-	slices.SortFunc(exprs, func(expression backend.ShortExpression, expression2 backend.ShortExpression) int {
-		if expression.GetId() >= expression2.GetId() {
-			return 0
-		} else {
-			return -1
-		}
-	})
-	var exprsJsonHandler = backend.ExpressionsJsonTitle{Expressions: exprs}
 	exprsHandlerInBytes, err := exprsJsonHandler.Marshal()
 	if err != nil {
 		log.Panic(err)
@@ -230,33 +392,128 @@ func expressionsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+selectExprsPage возвращает страницу выражений пользователя и курсор следующей страницы. Выполняющиеся выражения
+берутся из exprsList: в БД их статус может быть устаревшим. Поэтому страница может оказаться короче filter.Limit,
+даже если курсор следующей страницы не пустой.
+*/
+func selectExprsPage(userOwnerId int64, filter ExprsFilter) (page []backend.ShortExpression, nextCursor string,
+	err error) {
+	var (
+		limit       = filter.Limit
+		exprsFromDb []backend.ShortExpression
+		boundary    *ExprsCursor // последняя позиция, до которой просмотрены все выражения из БД.
+	)
+	filter.Limit = limit + 1
+	if exprsFromDb, err = db.SelectAllExprs(userOwnerId, filter); err != nil {
+		return
+	}
+	if len(exprsFromDb) > limit {
+		exprsFromDb = exprsFromDb[:limit]
+		var last = filter.cursorOf(exprsFromDb[limit-1])
+		boundary = &last
+	}
+	for _, expr := range exprsFromDb {
+		if _, running := exprsList.GetOwned(userOwnerId, expr.GetId()); !running {
+			page = append(page, expr)
+		}
+	}
+	for _, expr := range exprsList.GetAllOwned(userOwnerId) {
+		if filter.Match(expr) && (boundary == nil || filter.compare(filter.cursorOf(expr), *boundary) <= 0) {
+			page = append(page, expr)
+		}
+	}
+	filter.sort(page)
+	if len(page) > limit {
+		page = page[:limit]
+		var last = filter.cursorOf(page[limit-1])
+		boundary = &last
+	}
+	if boundary != nil {
+		nextCursor = filter.encodeCursor(*boundary)
+	}
+	return
+}
+
 func expressionIdHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeRouteNotFound(w, r)
+		return
+	}
+	user, ok := parseToken(w, r)
+	if !ok {
+		return
+	}
+	exprId, ok := parseExprId(w, r)
+	if !ok {
 		return
 	}
+	if r.Method == http.MethodDelete {
+		cancelExpression(w, user, exprId)
+		return
+	}
+	writeExpression(w, user, exprId)
+}
+
+// parseExprId читает id выражения из пути запроса. Если id не число, parseExprId отвечает 400 и возвращает false.
+func parseExprId(w http.ResponseWriter, r *http.Request) (exprId int, ok bool) {
+	exprId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidId, "id выражения должен быть целым числом", nil)
+		return
+	}
+	return exprId, true
+}
+
+// writeExpression отвечает выражением пользователя с данным id или 404, если такого выражения у него нет.
+func writeExpression(w http.ResponseWriter, user backend.CommonUser, exprId int) {
 	var (
 		err   error
-		user  backend.CommonUser
 		expr  backend.ShortExpression
 		exist bool
 	)
-	user, err = parseToken(r)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	if expr, exist = exprsList.GetOwned(user.GetId(), exprId); !exist { // в БД статус выполняющихся
+		// выражений не обновляется, поэтому сначала проверяется exprsList.
+		if expr, err = db.SelectExpr(user.GetId(), exprId); err != nil {
+			writeExprNotFound(w, exprId)
+			return
+		}
 	}
-	id := r.PathValue("id")
-	idInInt, err := strconv.ParseInt(id, 10, 64)
+	var exprJsonHandler = backend.ExpressionJsonTitle{Expression: expr}
+	exprHandlerInBytes, err := json.Marshal(&exprJsonHandler)
 	if err != nil {
 		log.Panic(err)
 	}
-	expr, err = db.SelectExpr(user.GetId(), int(idInInt))
+	_, err = w.Write(exprHandlerInBytes)
 	if err != nil {
-		if expr, exist = exprsList.GetOwned(user.GetId(), int(idInInt)); !exist {
-			w.WriteHeader(404)
-			return
+		log.Panic(err)
+	}
+}
+
+/*
+cancelExpression отменяет выполняющееся выражение пользователя и переносит его в БД. Если выражение уже
+завершилось, возвращается 409.
+*/
+func cancelExpression(w http.ResponseWriter, user backend.CommonUser, exprId int) {
+	var (
+		expr  backend.CommonExpression
+		exist bool
+		err   error
+	)
+	if expr, exist = exprsList.GetOwned(user.GetId(), exprId); !exist {
+		if _, err = db.SelectExpr(user.GetId(), exprId); err == nil {
+			writeExprFinished(w, exprId)
+		} else {
+			writeExprNotFound(w, exprId)
 		}
+		return
+	}
+	if err = expr.Cancel("отменено пользователем"); err != nil { // выражение успело посчитаться.
+		writeExprFinished(w, exprId)
+		return
+	}
+	if err = finishExpr(expr); err != nil {
+		log.Panic(err)
 	}
 	var exprJsonHandler = backend.ExpressionJsonTitle{Expression: expr}
 	exprHandlerInBytes, err := json.Marshal(&exprJsonHandler)
@@ -269,6 +526,15 @@ func expressionIdHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func writeExprNotFound(w http.ResponseWriter, exprId int) {
+	writeNotFound(w, fmt.Sprintf("выражение %d не найдено", exprId))
+}
+
+func writeExprFinished(w http.ResponseWriter, exprId int) {
+	writeError(w, http.StatusConflict, ErrorExpressionFinished, fmt.Sprintf("выражение %d уже завершено", exprId),
+		nil)
+}
+
 func panicMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -281,19 +547,36 @@ func panicMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func writeInternalServerError(w http.ResponseWriter) {
-	w.WriteHeader(500)
-	return
-}
-
 func getHandler() (handler http.Handler) {
 	var mux = http.NewServeMux()
 	mux.HandleFunc("/api/v1/register", registerHandler)
 	mux.HandleFunc("/api/v1/login", loginHandler)
+	mux.HandleFunc("/api/v1/refresh", refreshHandler)
+	mux.HandleFunc("/api/v1/logout", logoutHandler)
+	mux.HandleFunc("/api/v1/account", accountHandler)
+	mux.HandleFunc("/api/v1/account/password", changePasswordHandler)
+	mux.HandleFunc("/api/v1/account/sessions", sessionsHandler)
 	mux.HandleFunc("/api/v1/calculate", calcHandler)
 	mux.HandleFunc("/api/v1/expressions", expressionsHandler)
 	mux.HandleFunc("/api/v1/expressions/{id}", expressionIdHandler)
-	handler = panicMiddleware(mux)
+	mux.HandleFunc("POST /api/v2/register", registerHandler)
+	mux.HandleFunc("POST /api/v2/login", loginHandler)
+	mux.HandleFunc("POST /api/v2/refresh", refreshHandler)
+	mux.HandleFunc("POST /api/v2/logout", logoutHandler)
+	mux.Handle("POST /api/v2/calculate", withBearerAuth(calcV2Handler))
+	mux.Handle("GET /api/v2/expressions", withBearerAuth(expressionsV2Handler))
+	mux.Handle("GET /api/v2/expressions/{id}", withBearerAuth(expressionV2Handler))
+	mux.Handle("DELETE /api/v2/expressions/{id}", withBearerAuth(cancelV2Handler))
+	mux.Handle("DELETE /api/v2/account", withBearerAuth(deleteAccountV2Handler))
+	mux.Handle("PUT /api/v2/account/password", withBearerAuth(changePasswordV2Handler))
+	mux.Handle("GET /api/v2/account/sessions", withBearerAuth(sessionsV2Handler))
+	mux.Handle("GET /api/v2/admin/users", withAdminAuth(adminUsersHandler))
+	mux.Handle("PUT /api/v2/admin/users/{id}/disabled", withAdminAuth(adminDisableHandler))
+	mux.Handle("DELETE /api/v2/admin/users/{id}/disabled", withAdminAuth(adminEnableHandler))
+	mux.Handle("GET /api/v2/admin/expressions", withAdminAuth(adminExpressionsHandler))
+	mux.Handle("GET /api/v2/admin/expressions/{id}", withAdminAuth(adminExpressionHandler))
+	mux.Handle("DELETE /api/v2/admin/expressions/{id}", withAdminAuth(adminCancelHandler))
+	handler = panicMiddleware(muxErrorsMiddleware(mux))
 	return
 }
 
@@ -302,17 +585,28 @@ func (g *GrpcTaskServer) GetTask(_ context.Context, _ *pb.Empty) (result *pb.Tas
 	if expr == nil {
 		return nil, status.Error(codes.NotFound, "нет готовых задач")
 	}
-	var taskWithTime backend.GrpcTask
+	var (
+		taskWithTime backend.GrpcTask
+		isFirstTask  = expr.GetTimestamps().StartedAt.IsZero()
+	)
 	taskWithTime, err = expr.GetReadyGrpcTask()
-	if err != nil {
+	if errors.As(err, &backend.NoReadyTask{}) { // готовые Task-и успели разобрать другие агенты.
+		return nil, status.Error(codes.NotFound, "нет готовых задач")
+	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, "%s", err)
 	} else {
+		if isFirstTask { // сохраняем момент начала вычисления на случай перезапуска оркестратора.
+			if dbErr := db.InsertExpr(expr); dbErr != nil {
+				log.Println(dbErr)
+			}
+		}
 		result = &pb.TaskToSend{
 			PairId:              taskWithTime.GetPairId(),
 			Arg1:                taskWithTime.GetArg1(),
 			Arg2:                taskWithTime.GetArg2(),
 			Operation:           taskWithTime.GetOperation(),
 			PermissibleDuration: taskWithTime.GetPermissibleDuration(),
+			Args:                taskWithTime.GetArgs(),
 		}
 		return result, status.Error(codes.OK, "")
 	}
@@ -326,14 +620,61 @@ func (g *GrpcTaskServer) SendTask(_ context.Context, req *pb.TaskResult) (_ *pb.
 		return nil, status.Error(codes.NotFound, "ID выражения, соответствующей этой задаче, не найдено")
 	}
 	err = expr.UpdateTask(req, timeAtReceiveTask)
+	var alreadyFinished *backend.ExprAlreadyFinished
+	if errors.As(err, &alreadyFinished) { // например, пользователь отменил выражение, пока агент считал.
+		return nil, status.Errorf(codes.FailedPrecondition, "%s", err)
+	} else if err != nil {
+		if expr.GetStatus().IsFinished() { // политика FailOnLateResult или исчерпаны попытки.
+			if dbErr := finishExpr(expr); dbErr != nil {
+				log.Println(dbErr)
+			}
+		}
+		return nil, status.Errorf(codes.Aborted, "%s", err)
+	}
+	if expr.GetStatus().IsFinished() {
+		err = finishExpr(expr)
+	} else if req.GetError() == "" {
+		err = db.InsertTask(req)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Aborted, "%s", err)
 	}
-	if expr.GetStatus() == backend.Completed {
-		if err = db.InsertExpr(expr); err != nil {
-			return nil, status.Errorf(codes.Aborted, "%s", err)
+	return &pb.Empty{}, status.Error(codes.OK, "")
+}
+
+/*
+finishExpr сохраняет итог завершённого выражения в БД, удаляет результаты его Task-ов, которые были нужны только
+для восстановления после перезапуска, и убирает выражение из exprsList.
+*/
+func finishExpr(expr backend.CommonExpression) (err error) {
+	if err = db.InsertExpr(expr); err != nil {
+		return
+	}
+	if err = db.DeleteTasks(expr.GetId()); err != nil {
+		return
+	}
+	exprsList.Remove(expr)
+	return
+}
+
+/*
+restoreExprsList возвращает в exprsList выражения, которые выполнялись до перезапуска оркестратора.
+*/
+func restoreExprsList() (err error) {
+	var storedExprs []StoredExpr
+	if storedExprs, err = db.SelectRunningExprs(); err != nil {
+		return
+	}
+	for _, stored := range storedExprs {
+		var tree ast.Node
+		if tree, err = pkg.Parse(stored.Tree); err != nil {
+			return
+		}
+		if expr := exprsList.RestoreExpr(stored, tree); expr.GetStatus().IsFinished() {
+			if err = finishExpr(expr); err != nil {
+				return
+			}
 		}
-		exprsList.Remove(expr)
 	}
-	return &pb.Empty{}, status.Error(codes.OK, "")
+	return
 }
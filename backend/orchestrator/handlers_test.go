@@ -7,6 +7,7 @@ import (
 	"errors"
 	"github.com/Debianov/calc-ya-go-24/backend"
 	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
+	"github.com/Debianov/calc-ya-go-24/pkg"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -15,7 +16,9 @@ import (
 	"net/http/httptest"
 	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var compareTemplate = "ожидается \"%s\", получен \"%s\""
@@ -90,6 +93,33 @@ func defaultCmpFunc(t *testing.T, w *httptest.ResponseRecorder,
 	}
 }
 
+/*
+exprTimestampsCmpFunc сравнивает ответ с одним выражением так же, как defaultCmpFunc, но без моментов времени и
+длительности: они зависят от момента запуска теста. Проверяется только, что моменты приёма и завершения выведены.
+*/
+func exprTimestampsCmpFunc(t *testing.T, w *httptest.ResponseRecorder,
+	casesHandler backend.CasesHandler, currentTestCase backend.ByteCase) {
+	if casesHandler.GetExpectedHttpCode() != w.Code {
+		t.Errorf(compareTemplate, strconv.Itoa(casesHandler.GetExpectedHttpCode()),
+			strconv.Itoa(w.Code))
+	}
+	var realExpr backend.ExpressionJsonTitleStub
+	if err := json.Unmarshal(w.Body.Bytes(), &realExpr); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, realExpr.Expression.SubmittedAt)
+	assert.NotNil(t, realExpr.Expression.FinishedAt)
+	assert.NotEmpty(t, realExpr.Expression.Duration)
+	realExpr.Expression.ExprTimestampsJson = backend.ExprTimestampsJson{}
+	realExprInBytes, err := realExpr.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(currentTestCase.Expected, realExprInBytes) != 0 {
+		t.Errorf(compareTemplate, currentTestCase.Expected, realExprInBytes)
+	}
+}
+
 /*
 testByStructCompareThroughHttpHandler переводит case-ы в backend.ByteCase, но
 сравнивает структуры, что может быть принципиально важно, если идёт тестирование
@@ -169,7 +199,13 @@ var testUser = backend.UserStub{
 	Password: "qwerty",
 	Id:       0,
 }
-var token, _ = GenerateJwt(&testUser)
+var token, _ = GenerateJwt(&testUser, RoleUser, 0)
+
+// invalidExpressionJson -- ожидаемый ответ calcHandler на выражение, которое не удалось разобрать.
+func invalidExpressionJson(parseErr *pkg.ParseError) *ErrorJson {
+	return &ErrorJson{Code: ErrorInvalidExpression, Message: "выражение не разобрано: " + parseErr.Error(),
+		Details: parseErr}
+}
 
 func TestCalcHandler(t *testing.T) {
 	t.Cleanup(func() {
@@ -181,8 +217,9 @@ func TestCalcHandler(t *testing.T) {
 	t.Run("201Code", func(t *testing.T) {
 		var (
 			requestsToTest = []*backend.RequestJsonStub{{Token: token, Expression: "2+2*4"},
-				{Token: token, Expression: "4*2+3*5"}}
-			expectedResponses = []*backend.ExpressionJsonStub{{ID: 0}, {ID: 1}}
+				{Token: token, Expression: "4*2+3*5"}, {Token: token, Expression: "-5+3"},
+				{Token: token, Expression: "2*(-4)"}, {Token: token, Expression: "3--2"}}
+			expectedResponses = []*backend.ExpressionJsonStub{{ID: 0}, {ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
 			commonHttpCase    = backend.HttpCasesHandler[*backend.RequestJsonStub, *backend.ExpressionJsonStub]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTarget: "/api/v1/calculate", ExpectedHttpCode: http.StatusCreated}
@@ -191,11 +228,15 @@ func TestCalcHandler(t *testing.T) {
 	})
 	t.Run("422Code", func(t *testing.T) {
 		var (
-			requestsToTest = []*backend.RequestJsonStub{{Token: token, Expression: "2++2*4"},
+			requestsToTest = []*backend.RequestJsonStub{{Token: token, Expression: "2++*4"},
 				{Token: token, Expression: "4*(2+3"}, {Token: token, Expression: "8+2/3)"},
 				{Token: token, Expression: "4*()2+3"}}
-			expectedResponses = []backend.EmptyJson{{}, {}, {}, {}}
-			commonHttpCase    = backend.HttpCasesHandler[*backend.RequestJsonStub, backend.EmptyJson]{RequestsToSend: requestsToTest,
+			expectedResponses = []*ErrorJson{
+				invalidExpressionJson(&pkg.ParseError{Kind: pkg.UnexpectedToken, Pos: 3, Token: "*"}),
+				invalidExpressionJson(&pkg.ParseError{Kind: pkg.MismatchedParentheses, Pos: 2, Token: "("}),
+				invalidExpressionJson(&pkg.ParseError{Kind: pkg.MismatchedParentheses, Pos: 5, Token: ")"}),
+				invalidExpressionJson(&pkg.ParseError{Kind: pkg.UnexpectedToken, Pos: 3, Token: ")"})}
+			commonHttpCase = backend.HttpCasesHandler[*backend.RequestJsonStub, *ErrorJson]{RequestsToSend: requestsToTest,
 				ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost, UrlTarget: "/api/v1/calculate",
 				ExpectedHttpCode: http.StatusUnprocessableEntity}
 		)
@@ -204,8 +245,8 @@ func TestCalcHandler(t *testing.T) {
 	t.Run("404Code", func(t *testing.T) {
 		var (
 			requestsToTest    = []*backend.RequestJsonStub{{Token: token, Expression: "2+2*4"}}
-			expectedResponses = []*backend.EmptyJson{{}}
-			commonHttpCase    = backend.HttpCasesHandler[*backend.RequestJsonStub, *backend.EmptyJson]{RequestsToSend: requestsToTest,
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "маршрут GET /api/v1/calculate не найден"}}
+			commonHttpCase    = backend.HttpCasesHandler[*backend.RequestJsonStub, *ErrorJson]{RequestsToSend: requestsToTest,
 				ExpectedResponses: expectedResponses, HttpMethod: http.MethodGet, UrlTarget: "/api/v1/calculate",
 				ExpectedHttpCode: http.StatusNotFound}
 		)
@@ -236,7 +277,7 @@ func testExpressionsHandler200(t *testing.T) {
 		expectedExpressions = formExpectedExpressions(expectedExpressionsFromList, expectedExpressionsFromDb)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.ExpressionsJsonTitleStub{{expectedExpressions}}
+			expectedResponses = []*backend.ExpressionsJsonTitleStub{{Expressions: expectedExpressions}}
 			commonHttpCase    = backend.HttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.ExpressionsJsonTitleStub]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTarget: "/api/v1/expressions", ExpectedHttpCode: http.StatusOK}
@@ -255,7 +296,7 @@ func testExpressionsHandler200(t *testing.T) {
 		exprsList = callExprsListStubFabric(testUser.GetId(), expectedExpressions...)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.ExpressionsJsonTitleStub{{expectedExpressions}}
+			expectedResponses = []*backend.ExpressionsJsonTitleStub{{Expressions: expectedExpressions}}
 			commonHttpCase    = backend.HttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.ExpressionsJsonTitleStub]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTarget: "/api/v1/expressions", ExpectedHttpCode: http.StatusOK}
@@ -273,13 +314,45 @@ func testExpressionsHandler200(t *testing.T) {
 		db.(*DbStub).InsertExprs(testUser.GetId(), expectedExpressions)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.ExpressionsJsonTitleStub{{expectedExpressions}}
+			expectedResponses = []*backend.ExpressionsJsonTitleStub{{Expressions: expectedExpressions}}
 			commonHttpCase    = backend.HttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.ExpressionsJsonTitleStub]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTarget: "/api/v1/expressions", ExpectedHttpCode: http.StatusOK}
 		)
 		testThroughHttpHandler(expressionsHandler, t, commonHttpCase, defaultCmpFunc)
 	})
+	t.Run("Pages", func(t *testing.T) {
+		t.Cleanup(func() {
+			exprsList = CallEmptyExpressionListFabric()
+			db.(*DbStub).FlushExprs()
+		})
+		db.(*DbStub).InsertExprs(testUser.GetId(), []backend.ExpressionStub{{Id: 1, Status: backend.Completed},
+			{Id: 2, Status: backend.Ready}, {Id: 3, Status: backend.Completed}, {Id: 4, Status: backend.Cancelled}})
+		exprsList = callExprsListStubFabric(testUser.GetId(), backend.ExpressionStub{Id: 0, Status: backend.Ready},
+			backend.ExpressionStub{Id: 2, Status: backend.NoReadyTasks})
+		var (
+			request = ExpressionsRequestJson{JwtTokenJsonWrapper: JwtTokenJsonWrapper{Token: token}, Limit: 2}
+			pages   [][]int
+		)
+		for range 4 {
+			var page = requestExpressionsPage(t, &request)
+			pages = append(pages, idsOfExpressionStubs(page.Expressions))
+			if page.NextCursor == "" {
+				break
+			}
+			request.Cursor = page.NextCursor
+		}
+		assert.Equal(t, [][]int{{0, 1}, {2, 3}, {4}}, pages)
+		request = ExpressionsRequestJson{JwtTokenJsonWrapper: JwtTokenJsonWrapper{Token: token},
+			Statuses: []backend.ExprStatus{backend.NoReadyTasks}} // в БД статус выражения 2 устарел.
+		assert.Equal(t, []int{2}, idsOfExpressionStubs(requestExpressionsPage(t, &request).Expressions))
+		request = ExpressionsRequestJson{JwtTokenJsonWrapper: JwtTokenJsonWrapper{Token: token}, Limit: 3,
+			Order: "desc"}
+		var page = requestExpressionsPage(t, &request)
+		assert.Equal(t, []int{4, 3, 2}, idsOfExpressionStubs(page.Expressions))
+		request.Cursor = page.NextCursor
+		assert.Equal(t, []int{1, 0}, idsOfExpressionStubs(requestExpressionsPage(t, &request).Expressions))
+	})
 	t.Run("EmptyStorages", func(t *testing.T) {
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
@@ -292,6 +365,64 @@ func testExpressionsHandler200(t *testing.T) {
 	})
 }
 
+func testExpressionsHandler400(t *testing.T) {
+	var (
+		cursor = ExprsFilter{}.encodeCursor(ExprsCursor{Id: 1})
+		cases  = map[string]ExpressionsRequestJson{
+			"NegativeLimit":  {Limit: -1},
+			"TooBigLimit":    {Limit: maxExprsLimit + 1},
+			"UnknownStatus":  {Statuses: []backend.ExprStatus{"Считается"}},
+			"UnknownSort":    {Sort: "result"},
+			"UnknownOrder":   {Order: "random"},
+			"BrokenCursor":   {Cursor: "не курсор"},
+			"CursorForOther": {Cursor: cursor, Order: "desc"},
+		}
+	)
+	for name, request := range cases {
+		t.Run(name, func(t *testing.T) {
+			request.Token = token
+			reqBuf, err := request.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				w   = httptest.NewRecorder()
+				req = httptest.NewRequest(http.MethodPost, "/api/v1/expressions", bytes.NewReader(reqBuf))
+			)
+			expressionsHandler(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+// requestExpressionsPage отправляет запрос списка выражений и разбирает успешный ответ.
+func requestExpressionsPage(t *testing.T, request *ExpressionsRequestJson) (page backend.ExpressionsJsonTitleStub) {
+	reqBuf, err := request.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		w   = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, "/api/v1/expressions", bytes.NewReader(reqBuf))
+	)
+	req.Header.Set("Content-Type", "application/json")
+	expressionsHandler(w, req)
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		return
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func idsOfExpressionStubs(exprs []backend.ExpressionStub) (ids []int) {
+	for _, expr := range exprs {
+		ids = append(ids, expr.GetId())
+	}
+	return
+}
+
 func testExpressionsHandler404(t *testing.T) {
 	t.Run("WrongHttpMethod", func(t *testing.T) {
 		t.Cleanup(func() {
@@ -303,8 +434,8 @@ func testExpressionsHandler404(t *testing.T) {
 		exprsList = callExprsListStubFabric(testUser.GetId(), expressionToList...)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.EmptyJson{{}}
-			commonHttpCase    = backend.HttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.EmptyJson]{
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "маршрут GET /api/v1/expressions не найден"}}
+			commonHttpCase    = backend.HttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodGet,
 				UrlTarget:        "/api/v1/expressions",
 				ExpectedHttpCode: http.StatusNotFound}
@@ -316,6 +447,7 @@ func testExpressionsHandler404(t *testing.T) {
 func TestExpressionHandler(t *testing.T) {
 	exprsList = CallEmptyExpressionListFabric()
 	t.Run("200Code", testExpressionsHandler200)
+	t.Run("400Code", testExpressionsHandler400)
 	t.Run("404Code", testExpressionsHandler404)
 }
 
@@ -330,7 +462,7 @@ func testExpressionIdHandler200(t *testing.T) {
 		db.(*DbStub).InsertExprs(testUser.GetId(), expectedExpressions)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.ExpressionJsonTitleStub{{expectedExpressions[0]}}
+			expectedResponses = []*backend.ExpressionJsonTitleStub{{Expression: expectedExpressions[0]}}
 			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub,
 				*backend.ExpressionJsonTitleStub]{RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses,
 				HttpMethod: http.MethodPost, UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/0",
@@ -348,7 +480,7 @@ func testExpressionIdHandler200(t *testing.T) {
 		exprsList = callExprsListStubFabric(testUser.GetId(), expectedExpressions...)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.ExpressionJsonTitleStub{{expectedExpressions[0]}}
+			expectedResponses = []*backend.ExpressionJsonTitleStub{{Expression: expectedExpressions[0]}}
 			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub,
 				*backend.ExpressionJsonTitleStub]{RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses,
 				HttpMethod: http.MethodPost, UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/0",
@@ -369,8 +501,8 @@ func testExpressionIdHandler404(t *testing.T) {
 		exprsList = callExprsListStubFabric(testUser.GetId(), expressionToList...)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.EmptyJson{{}}
-			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.EmptyJson]{
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "выражение 1 не найдено"}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/1",
 				ExpectedHttpCode: http.StatusNotFound}
@@ -387,8 +519,8 @@ func testExpressionIdHandler404(t *testing.T) {
 		exprsList = callExprsListStubFabric(testUser.GetId(), expectedExpressions...)
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.EmptyJson{{}}
-			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.EmptyJson]{
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "маршрут GET /api/v1/expressions/0 не найден"}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodGet,
 				UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/0",
 				ExpectedHttpCode: http.StatusNotFound}
@@ -398,8 +530,8 @@ func testExpressionIdHandler404(t *testing.T) {
 	t.Run("EmptyStorages", func(t *testing.T) {
 		var (
 			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
-			expectedResponses = []*backend.EmptyJson{{}}
-			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *backend.EmptyJson]{
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "выражение 0 не найдено"}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
 				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodPost,
 				UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/0",
 				ExpectedHttpCode: http.StatusNotFound}
@@ -408,10 +540,69 @@ func testExpressionIdHandler404(t *testing.T) {
 	})
 }
 
+func testExpressionIdHandlerCancel(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+		db.(*DbStub).FlushExprs()
+	})
+	db = callStubDbFabric()
+	exprsList = CallEmptyExpressionListFabric()
+	var tree, _ = pkg.Parse("(1+2)*(3+4)")
+	expr := exprsList.AddExprFabric(0, testUser.GetId(), "(1+2)*(3+4)", tree)
+	task, err := expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("200Code", func(t *testing.T) {
+		var (
+			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
+			expectedResponses = []*backend.ExpressionJsonTitleStub{{Expression: backend.ExpressionStub{Id: 0,
+				Expression: "(1+2)*(3+4)", Status: backend.Cancelled, Reason: "отменено пользователем"}}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub,
+				*backend.ExpressionJsonTitleStub]{RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses,
+				HttpMethod: http.MethodDelete, UrlTemplate: "/api/v1/expressions/{id}",
+				UrlTarget: "/api/v1/expressions/0", ExpectedHttpCode: http.StatusOK}
+		)
+		testThroughServeMux(expressionIdHandler, t, serverMuxHttpCase, exprTimestampsCmpFunc)
+		_, ok := exprsList.Get(expr.GetId())
+		assert.False(t, ok)
+		savedExpr, err := db.SelectExpr(testUser.GetId(), expr.GetId())
+		if assert.NoError(t, err) {
+			assert.Equal(t, backend.ExprStatus(backend.Cancelled), savedExpr.GetStatus())
+		}
+		err = expr.UpdateTask(&pb.TaskResult{PairId: task.GetPairId(), Result: 3}, time.Now())
+		var alreadyFinished *backend.ExprAlreadyFinished
+		assert.ErrorAs(t, err, &alreadyFinished)
+	})
+	t.Run("409Code", func(t *testing.T) {
+		var (
+			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
+			expectedResponses = []*ErrorJson{{Code: ErrorExpressionFinished, Message: "выражение 0 уже завершено"}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
+				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodDelete,
+				UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/0",
+				ExpectedHttpCode: http.StatusConflict}
+		)
+		testThroughServeMux(expressionIdHandler, t, serverMuxHttpCase, defaultCmpFunc)
+	})
+	t.Run("404Code", func(t *testing.T) {
+		var (
+			requestsToTest    = []*backend.JwtTokenJsonWrapperStub{{Token: token}}
+			expectedResponses = []*ErrorJson{{Code: ErrorNotFound, Message: "выражение 1 не найдено"}}
+			serverMuxHttpCase = backend.ServerMuxHttpCasesHandler[*backend.JwtTokenJsonWrapperStub, *ErrorJson]{
+				RequestsToSend: requestsToTest, ExpectedResponses: expectedResponses, HttpMethod: http.MethodDelete,
+				UrlTemplate: "/api/v1/expressions/{id}", UrlTarget: "/api/v1/expressions/1",
+				ExpectedHttpCode: http.StatusNotFound}
+		)
+		testThroughServeMux(expressionIdHandler, t, serverMuxHttpCase, defaultCmpFunc)
+	})
+}
+
 func TestExpressionIdHandler(t *testing.T) {
 	exprsList = CallEmptyExpressionListFabric()
 	t.Run("200Code", testExpressionIdHandler200)
 	t.Run("404Code", testExpressionIdHandler404)
+	t.Run("Cancel", testExpressionIdHandlerCancel)
 }
 
 func TestPanicMiddlewareGood(t *testing.T) {
@@ -526,6 +717,7 @@ func testGetTaskOkCode(t *testing.T) {
 			Arg2:                arg2,
 			Operation:           expectedTask.GetOperation(),
 			PermissibleDuration: expectedTask.GetPermissibleDuration().String(),
+			Args:                []float64{arg1, arg2},
 		}
 	)
 	assert.EqualExportedValues(t, wrappedExpectedTask, result)
@@ -583,7 +775,7 @@ func testSendTaskOkCode(t *testing.T) {
 	})
 	var (
 		g              = GetDefaultGrpcServer()
-		expectedResult = int64(15)
+		expectedResult = float64(15)
 		expectedPairId = int32(0)
 		toSend         = &pb.TaskResult{
 			PairId: expectedPairId,
@@ -605,10 +797,155 @@ func testSendTaskOkCode(t *testing.T) {
 	assert.Equal(t, expectedResult, taskToCheck.GetResult())
 }
 
+func testSendTaskLateResultPersisted(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	backend.SetLateResultPolicy(backend.FailOnLateResult)
+	t.Setenv("TIME_ADDITION", "1ns")
+	var (
+		g       = GetDefaultGrpcServer()
+		tree, _ = pkg.Parse("1+2")
+		stubDb  = callStubDbFabric()
+		task    backend.GrpcTask
+		err     error
+	)
+	db = stubDb
+	exprsList = CallEmptyExpressionListFabric()
+	expr := exprsList.AddExprFabric(0, testUser.GetId(), "1+2", tree)
+	task, err = expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	_, err = g.SendTask(context.TODO(), &pb.TaskResult{PairId: task.GetPairId(), Result: 3})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, ok := exprsList.Get(expr.GetId())
+	assert.False(t, ok)
+	savedExpr, err := stubDb.SelectExpr(testUser.GetId(), expr.GetId())
+	if assert.NoError(t, err) {
+		assert.Equal(t, backend.ExprStatus(backend.Cancelled), savedExpr.GetStatus())
+		assert.NotEmpty(t, savedExpr.GetReason())
+	}
+}
+
+func testSendTaskLateResultAfterLeaseExpired(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	backend.SetLateResultPolicy(backend.FailOnLateResult)
+	t.Setenv("TIME_ADDITION", "1ns")
+	var (
+		g       = GetDefaultGrpcServer()
+		tree, _ = pkg.Parse("1+2")
+		stubDb  = callStubDbFabric()
+		task    backend.GrpcTask
+		err     error
+	)
+	db = stubDb
+	exprsList = CallEmptyExpressionListFabric()
+	expr := exprsList.AddExprFabric(0, testUser.GetId(), "1+2", tree)
+	task, err = expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	requeueExpiredTasks(time.Now())
+	assert.Equal(t, backend.ExprStatus(backend.Ready), expr.GetStatus())
+	_, err = g.SendTask(context.TODO(), &pb.TaskResult{PairId: task.GetPairId(), Result: 3})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.NotContains(t, status.Convert(err).Message(), "не найдена")
+	savedExpr, err := stubDb.SelectExpr(testUser.GetId(), expr.GetId())
+	if assert.NoError(t, err) {
+		assert.Equal(t, backend.ExprStatus(backend.Cancelled), savedExpr.GetStatus())
+	}
+}
+
+func testSendTaskCalcErrorPersisted(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	var (
+		g       = GetDefaultGrpcServer()
+		tree, _ = pkg.Parse("1/0")
+		stubDb  = callStubDbFabric()
+		task    backend.GrpcTask
+		err     error
+	)
+	db = stubDb
+	exprsList = CallEmptyExpressionListFabric()
+	expr := exprsList.AddExprFabric(0, testUser.GetId(), "1/0", tree)
+	task, err = expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.SendTask(context.TODO(), &pb.TaskResult{PairId: task.GetPairId(), Error: "деление на ноль"})
+	assert.Equal(t, codes.OK, status.Code(err))
+	_, ok := exprsList.Get(expr.GetId())
+	assert.False(t, ok)
+	savedExpr, err := stubDb.SelectExpr(testUser.GetId(), expr.GetId())
+	if assert.NoError(t, err) {
+		assert.Equal(t, backend.ExprStatus(backend.Failed), savedExpr.GetStatus())
+		assert.Contains(t, savedExpr.GetReason(), "деление на ноль")
+	}
+}
+
 func TestSendTask(t *testing.T) {
 	t.Run("NotFoundCode", testSendTaskNotFoundCode)
 	t.Run("AbortedCode", testSendTaskAbortedCode)
 	t.Run("OkCode", testSendTaskOkCode)
+	t.Run("LateResultPersisted", testSendTaskLateResultPersisted)
+	t.Run("LateResultAfterLeaseExpired", testSendTaskLateResultAfterLeaseExpired)
+	t.Run("CalcErrorPersisted", testSendTaskCalcErrorPersisted)
+}
+
+func TestRequeueExpiredTasks(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	var (
+		tree, _   = pkg.Parse("1+2")
+		stubDb    = callStubDbFabric()
+		expr      backend.CommonExpression
+		firstTask backend.GrpcTask
+		err       error
+	)
+	db = stubDb
+	exprsList = CallEmptyExpressionListFabric()
+	expr = exprsList.AddExprFabric(0, testUser.GetId(), "1+2", tree)
+	firstTask, err = expr.GetReadyGrpcTask()
+	if err != nil {
+		t.Fatal(err)
+	}
+	requeueExpiredTasks(time.Now())
+	assert.Equal(t, backend.ExprStatus(backend.NoReadyTasks), expr.GetStatus())
+	for range 2 {
+		requeueExpiredTasks(time.Now().Add(time.Minute))
+		assert.Equal(t, backend.ExprStatus(backend.Ready), expr.GetStatus())
+		_, err = expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = expr.UpdateTask(&pb.TaskResult{PairId: firstTask.GetPairId(), Result: 3}, time.Now())
+	assert.NoError(t, err) // результат от агента, который не уложился в аренду, но всё же ответил, принимается.
+	assert.Equal(t, backend.ExprStatus(backend.Completed), expr.GetStatus())
+
+	exprsList = CallEmptyExpressionListFabric()
+	expr = exprsList.AddExprFabric(0, testUser.GetId(), "1+2", tree)
+	for range 3 {
+		_, err = expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		requeueExpiredTasks(time.Now().Add(time.Minute))
+	}
+	_, ok := exprsList.Get(expr.GetId())
+	assert.False(t, ok)
+	savedExpr, err := stubDb.SelectExpr(testUser.GetId(), expr.GetId())
+	if assert.NoError(t, err) {
+		assert.Equal(t, backend.ExprStatus(backend.Failed), savedExpr.GetStatus())
+	}
 }
 
 func testRegisterHandlerNewUser(t *testing.T) {
@@ -621,18 +958,57 @@ func testRegisterHandlerNewUser(t *testing.T) {
 	})
 	db = callStubDbFabric()
 	var (
-		requestsToTest    = []*backend.UserStub{{Login: "hhh", Password: "qwertyqwerty"}}
-		expectedResponses = []*backend.EmptyJson{{}}
-		commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *backend.EmptyJson]{RequestsToSend: requestsToTest,
+		requestsToTest    = []*backend.UserStub{{Login: "hhh", Password: "qwertyqwerty"}, {Login: "ggg", Password: "qwerty"}}
+		expectedResponses = []*UserIdJson{{Id: 1}, {Id: 2}}
+		commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *UserIdJson]{RequestsToSend: requestsToTest,
+			ExpectedResponses: expectedResponses, HttpMethod: "POST", UrlTarget: "/api/v1/register",
+			ExpectedHttpCode: http.StatusCreated}
+	)
+	testThroughHttpHandler(registerHandler, t, commonHttpCase, defaultCmpFunc)
+}
+
+func testRegisterHandlerRegisteredUser(t *testing.T) {
+	db = callStubDbWithRegisteredUserFabric(testUser)
+	var (
+		requestsToTest    = []*backend.UserStub{{Login: testUser.Login, Password: "anotherPassword"}}
+		expectedResponses = []*ErrorJson{{Code: ErrorLoginTaken, Message: "логин " + testUser.Login + " уже занят"}}
+		commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *ErrorJson]{RequestsToSend: requestsToTest,
+			ExpectedResponses: expectedResponses, HttpMethod: "POST", UrlTarget: "/api/v1/register",
+			ExpectedHttpCode: http.StatusConflict}
+	)
+	testThroughHttpHandler(registerHandler, t, commonHttpCase, defaultCmpFunc)
+}
+
+func testRegisterHandlerInvalidCredentials(t *testing.T) {
+	usePasswordPolicy(t, PasswordPolicy{MinLength: 6, RequireDigit: true})
+	db = callStubDbFabric()
+	var (
+		requestsToTest = []*backend.UserStub{{Login: "", Password: "qwerty1"},
+			{Login: strings.Repeat("л", maxLoginLength+1), Password: "qwerty1"}, {Login: "h h", Password: "qwerty1"},
+			{Login: "hhh", Password: ""}, {Login: "hhh", Password: strings.Repeat("1", maxPasswordBytes+1)},
+			{Login: "hhh", Password: "qwertyqwerty"}, {Login: "hhh", Password: "q1"}}
+		expectedResponses = []*ErrorJson{
+			{Code: ErrorInvalidCredentials, Message: "логин не может быть пустым"},
+			{Code: ErrorInvalidCredentials, Message: "логин длиннее 64 символов"},
+			{Code: ErrorInvalidCredentials, Message: "логин не может содержать пробельные символы"},
+			{Code: ErrorInvalidCredentials, Message: "пароль не может быть пустым"},
+			{Code: ErrorInvalidCredentials, Message: "пароль длиннее 72 байт"},
+			{Code: ErrorInvalidCredentials, Message: "пароль должен содержать цифру"},
+			{Code: ErrorInvalidCredentials, Message: "пароль должен быть не короче 6 символов"},
+		}
+		commonHttpCase = backend.HttpCasesHandler[*backend.UserStub, *ErrorJson]{RequestsToSend: requestsToTest,
 			ExpectedResponses: expectedResponses, HttpMethod: "POST", UrlTarget: "/api/v1/register",
-			ExpectedHttpCode: http.StatusOK}
+			ExpectedHttpCode: http.StatusBadRequest}
 	)
 	testThroughHttpHandler(registerHandler, t, commonHttpCase, defaultCmpFunc)
+	_, err := db.SelectUser("hhh")
+	assert.Error(t, err)
 }
 
 func TestRegisterHandler(t *testing.T) {
 	t.Run("NewUser", testRegisterHandlerNewUser)
-	//	t.Run("RegisteredUser", )
+	t.Run("RegisteredUser", testRegisterHandlerRegisteredUser)
+	t.Run("InvalidCredentials", testRegisterHandlerInvalidCredentials)
 }
 
 func TestLoginHandler(t *testing.T) {
@@ -655,8 +1031,8 @@ func TestLoginHandler(t *testing.T) {
 	t.Run("UnregisteredUserLogin", func(t *testing.T) {
 		var (
 			requestsToTest    = []*backend.UserStub{unregisteredUser}
-			expectedResponses = []backend.EmptyJson{{}}
-			commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, backend.EmptyJson]{RequestsToSend: requestsToTest,
+			expectedResponses = []*ErrorJson{{Code: ErrorUnauthorized, Message: "неверный логин или пароль"}}
+			commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *ErrorJson]{RequestsToSend: requestsToTest,
 				ExpectedResponses: expectedResponses, HttpMethod: "POST", UrlTarget: "/api/v1/login",
 				ExpectedHttpCode: http.StatusUnauthorized}
 		)
@@ -665,8 +1041,8 @@ func TestLoginHandler(t *testing.T) {
 	t.Run("RegisteredUserLoginWithWrongPassword", func(t *testing.T) {
 		var (
 			requestsToTest    = []*backend.UserStub{registeredUserWithWrongPassword}
-			expectedResponses = []*backend.EmptyJson{{}}
-			commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *backend.EmptyJson]{RequestsToSend: requestsToTest,
+			expectedResponses = []*ErrorJson{{Code: ErrorUnauthorized, Message: "неверный логин или пароль"}}
+			commonHttpCase    = backend.HttpCasesHandler[*backend.UserStub, *ErrorJson]{RequestsToSend: requestsToTest,
 				ExpectedResponses: expectedResponses, HttpMethod: "POST", UrlTarget: "/api/v1/login",
 				ExpectedHttpCode: http.StatusUnauthorized}
 		)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+API v2 повторяет v1 по смыслу, но следует REST: чтение -- GET, токен передаётся в заголовке Authorization: Bearer, а
+на неподходящий метод http.ServeMux отвечает 405 с заголовком Allow (для этого маршруты v2 регистрируются вместе с
+методом, см. getHandler).
+*/
+
+// CalcRequestJson -- тело запроса POST /api/v2/calculate.
+type CalcRequestJson struct {
+	Expression string `json:"expression"`
+}
+
+func (c *CalcRequestJson) Marshal() (result []byte, err error) {
+	return json.Marshal(c)
+}
+
+// parseBearerToken достаёт пользователя и его роль из заголовка Authorization: Bearer <JWT>.
+func parseBearerToken(r *http.Request) (user backend.CommonUser, role Role, err error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, "", errors.New("нет заголовка Authorization: Bearer")
+	}
+	return ParseJwtWithRole(strings.TrimSpace(token))
+}
+
+/*
+withBearerAuth пропускает к handler только запросы с действительным токеном в Authorization: Bearer, остальным
+отвечает 401.
+*/
+func withBearerAuth(handler func(w http.ResponseWriter, r *http.Request, user backend.CommonUser)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, err := parseBearerToken(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeUnauthorized(w)
+			return
+		}
+		handler(w, r, user)
+	})
+}
+
+func calcV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	if !hasJsonBody(r) {
+		writeUnsupportedMediaType(w)
+		return
+	}
+	var requestStruct CalcRequestJson
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err = json.Unmarshal(buf, &requestStruct); err != nil {
+		writeBadJson(w, err)
+		return
+	}
+	calculate(w, user, requestStruct.Expression)
+}
+
+func expressionsV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	requestStruct, err := parseExpressionsQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorInvalidParams, err.Error(), nil)
+		return
+	}
+	writeExpressionsPage(w, user, requestStruct)
+}
+
+/*
+parseExpressionsQuery читает параметры списка выражений из строки запроса. Параметры называются так же, как поля
+ExpressionsRequestJson, status можно повторять.
+*/
+func parseExpressionsQuery(query url.Values) (requestStruct *ExpressionsRequestJson, err error) {
+	requestStruct = &ExpressionsRequestJson{Cursor: query.Get("cursor"), Sort: ExprsSort(query.Get("sort")),
+		Order: query.Get("order")}
+	if limit := query.Get("limit"); limit != "" {
+		if requestStruct.Limit, err = strconv.Atoi(limit); err != nil {
+			return requestStruct, errors.New("limit должен быть целым числом")
+		}
+	}
+	for _, status := range query["status"] {
+		requestStruct.Statuses = append(requestStruct.Statuses, backend.ExprStatus(status))
+	}
+	if requestStruct.SubmittedFrom, err = parseQueryTime(query, "submittedFrom"); err != nil {
+		return
+	}
+	requestStruct.SubmittedTo, err = parseQueryTime(query, "submittedTo")
+	return
+}
+
+// parseQueryTime читает из строки запроса момент в формате RFC 3339. Если параметра нет, возвращается nil.
+func parseQueryTime(query url.Values, param string) (moment *time.Time, err error) {
+	var value = query.Get(param)
+	if value == "" {
+		return
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s должен быть в формате RFC 3339", param)
+	}
+	return &parsed, nil
+}
+
+func expressionV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	if exprId, ok := parseExprId(w, r); ok {
+		writeExpression(w, user, exprId)
+	}
+}
+
+func cancelV2Handler(w http.ResponseWriter, r *http.Request, user backend.CommonUser) {
+	if exprId, ok := parseExprId(w, r); ok {
+		cancelExpression(w, user, exprId)
+	}
+}
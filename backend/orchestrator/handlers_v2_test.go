@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// serveV2 отправляет запрос в getHandler от имени testUser.
+func serveV2(method string, target string, body io.Reader) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	getHandler().ServeHTTP(w, req)
+	return
+}
+
+func TestV2Handlers(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	db = callStubDbWithRegisteredUserFabric(testUser)
+	exprsList = CallEmptyExpressionListFabric()
+
+	t.Run("Calculate", func(t *testing.T) {
+		reqBuf, _ := (&CalcRequestJson{Expression: "2+2*2"}).Marshal()
+		w := serveV2(http.MethodPost, "/api/v2/calculate", bytes.NewReader(reqBuf))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.JSONEq(t, `{"id":0}`, w.Body.String())
+	})
+	t.Run("CalculateWrongContentType", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/calculate", bytes.NewReader([]byte("2+2")))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		getHandler().ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+	t.Run("Expressions", func(t *testing.T) {
+		var query = url.Values{"status": {string(backend.Ready), backend.NoReadyTasks}, "limit": {"10"}}
+		w := serveV2(http.MethodGet, "/api/v2/expressions?"+query.Encode(), nil)
+		if !assert.Equal(t, http.StatusOK, w.Code) {
+			return
+		}
+		var page backend.ExpressionsJsonTitleStub
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.Equal(t, []int{0}, idsOfExpressionStubs(page.Expressions))
+	})
+	t.Run("ExpressionsBadQuery", func(t *testing.T) {
+		for _, query := range []string{"limit=many", "submittedFrom=yesterday", "order=random"} {
+			w := serveV2(http.MethodGet, "/api/v2/expressions?"+query, nil)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+	t.Run("Expression", func(t *testing.T) {
+		w := serveV2(http.MethodGet, "/api/v2/expressions/0", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"expression":"2+2*2"`)
+		assert.Equal(t, http.StatusNotFound, serveV2(http.MethodGet, "/api/v2/expressions/1", nil).Code)
+		assert.Equal(t, http.StatusBadRequest, serveV2(http.MethodGet, "/api/v2/expressions/abc", nil).Code)
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		w := serveV2(http.MethodDelete, "/api/v2/expressions/0", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"Отменено"`)
+		assert.Equal(t, http.StatusConflict, serveV2(http.MethodDelete, "/api/v2/expressions/0", nil).Code)
+	})
+	t.Run("WrongMethod", func(t *testing.T) {
+		var cases = map[string]string{"/api/v2/calculate": "POST", "/api/v2/expressions": "GET, HEAD",
+			"/api/v2/expressions/0": "DELETE, GET, HEAD", "/api/v2/login": "POST"}
+		for target, allow := range cases {
+			w := serveV2(http.MethodPut, target, nil)
+			assert.Equal(t, http.StatusMethodNotAllowed, w.Code, target)
+			assert.Equal(t, allow, w.Header().Get("Allow"), target)
+		}
+	})
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, header := range []string{"", "Bearer", "Bearer not.a.jwt", "Basic " + token, token} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v2/expressions", nil)
+			req.Header.Set("Authorization", header)
+			getHandler().ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+			assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+		}
+	})
+	t.Run("V1StillWorks", func(t *testing.T) {
+		reqBuf, _ := (&JwtTokenJsonWrapper{Token: token}).Marshal()
+		w := serveV2(http.MethodPost, "/api/v1/expressions", bytes.NewReader(reqBuf))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"id":0`)
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode -- машиночитаемый код ошибки HTTP API.
+type ErrorCode string
+
+const (
+	ErrorBadJson              ErrorCode = "bad_json"
+	ErrorInvalidParams        ErrorCode = "invalid_params"
+	ErrorInvalidId            ErrorCode = "invalid_id"
+	ErrorUnauthorized         ErrorCode = "unauthorized"
+	ErrorWrongPassword        ErrorCode = "wrong_password"
+	ErrorForbidden            ErrorCode = "forbidden"
+	ErrorAccountDisabled      ErrorCode = "account_disabled"
+	ErrorNotFound             ErrorCode = "not_found"
+	ErrorMethodNotAllowed     ErrorCode = "method_not_allowed"
+	ErrorInvalidCredentials   ErrorCode = "invalid_credentials"
+	ErrorLoginTaken           ErrorCode = "login_taken"
+	ErrorExpressionFinished   ErrorCode = "expression_finished"
+	ErrorTooManyAttempts      ErrorCode = "too_many_attempts"
+	ErrorUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	ErrorInvalidExpression    ErrorCode = "invalid_expression" // Details -- pkg.ParseError.
+	ErrorInternal             ErrorCode = "internal"
+)
+
+/*
+ErrorJson -- тело любого ответа HTTP API со статусом 4xx или 5xx. Message предназначен для человека, по Code
+клиент различает ошибки, а Details содержит подробности, если они есть у данного Code.
+*/
+type ErrorJson struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Details any       `json:"details,omitempty"`
+}
+
+func (e *ErrorJson) Marshal() (result []byte, err error) {
+	return json.Marshal(e)
+}
+
+// writeError отвечает статусом status и ErrorJson.
+func writeError(w http.ResponseWriter, status int, code ErrorCode, message string, details any) {
+	var errorJson = ErrorJson{Code: code, Message: message, Details: details}
+	errorInBytes, err := errorJson.Marshal()
+	if err != nil {
+		log.Panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(errorInBytes); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeInternalServerError(w http.ResponseWriter) {
+	writeError(w, http.StatusInternalServerError, ErrorInternal, "внутренняя ошибка сервера", nil)
+}
+
+func writeNotFound(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusNotFound, ErrorNotFound, message, nil)
+}
+
+// writeRouteNotFound отвечает 404 на запрос к несуществующему маршруту или на неподходящий метод в API v1.
+func writeRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeNotFound(w, "маршрут "+r.Method+" "+r.URL.Path+" не найден")
+}
+
+func writeUnsupportedMediaType(w http.ResponseWriter) {
+	writeError(w, http.StatusUnsupportedMediaType, ErrorUnsupportedMediaType, "ожидается Content-Type: "+
+		"application/json", nil)
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, ErrorUnauthorized, "требуется действительный токен", nil)
+}
+
+func writeBadJson(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, ErrorBadJson, "тело запроса не является корректным JSON: "+err.Error(), nil)
+}
+
+/*
+hasJsonBody сообщает, что тело запроса объявлено как JSON (параметры вроде charset допускаются). В API v1
+Content-Type не проверяется: v1 остаётся совместимым со скриптами, которые присылают JSON без этого заголовка или,
+как curl -d, с application/x-www-form-urlencoded.
+*/
+func hasJsonBody(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+/*
+muxErrorsMiddleware заменяет текстовые ответы, которые http.ServeMux отдаёт на неизвестный путь (404) и неподходящий
+метод (405), на ErrorJson. Заголовок Allow у 405 сохраняется.
+*/
+func muxErrorsMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		var capture = muxErrorCapture{header: make(http.Header)}
+		handler.ServeHTTP(&capture, r)
+		if capture.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", capture.header.Get("Allow"))
+			writeError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "метод "+r.Method+
+				" не поддерживается", nil)
+			return
+		}
+		writeRouteNotFound(w, r)
+	})
+}
+
+// muxErrorCapture запоминает статус и заголовки ответа http.ServeMux, отбрасывая тело.
+type muxErrorCapture struct {
+	header http.Header
+	status int
+}
+
+func (m *muxErrorCapture) Header() http.Header {
+	return m.header
+}
+
+func (m *muxErrorCapture) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (m *muxErrorCapture) WriteHeader(status int) {
+	m.status = status
+}
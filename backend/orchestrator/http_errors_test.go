@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveWithBody отправляет в getHandler запрос с телом body и Content-Type: application/json.
+func serveWithBody(method string, target string, body string) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	getHandler().ServeHTTP(w, req)
+	return
+}
+
+// serveWithBearer отправляет в getHandler запрос с токеном accessToken в заголовке Authorization.
+func serveWithBearer(method string, target string, accessToken string, body string) (w *httptest.ResponseRecorder) {
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	getHandler().ServeHTTP(w, req)
+	return
+}
+
+// assertErrorJson проверяет статус ответа и код ErrorJson в его теле.
+func assertErrorJson(t *testing.T, w *httptest.ResponseRecorder, status int, code ErrorCode) {
+	t.Helper()
+	assert.Equal(t, status, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var errorJson ErrorJson
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &errorJson), w.Body.String()) {
+		assert.Equal(t, code, errorJson.Code)
+		assert.NotEmpty(t, errorJson.Message)
+	}
+}
+
+func TestErrorJson(t *testing.T) {
+	t.Cleanup(func() {
+		exprsList = CallEmptyExpressionListFabric()
+	})
+	db = callStubDbWithRegisteredUserFabric(testUser)
+	exprsList = CallEmptyExpressionListFabric()
+
+	t.Run("BadJson", func(t *testing.T) {
+		for _, target := range []string{"/api/v1/register", "/api/v1/login", "/api/v1/calculate",
+			"/api/v1/expressions", "/api/v1/expressions/0"} {
+			t.Run(target, func(t *testing.T) {
+				assertErrorJson(t, serveWithBody(http.MethodPost, target, "{"), http.StatusBadRequest, ErrorBadJson)
+			})
+		}
+		w := serveV2(http.MethodPost, "/api/v2/calculate", strings.NewReader(`{"expression": 5}`))
+		assertErrorJson(t, w, http.StatusBadRequest, ErrorBadJson)
+	})
+	t.Run("LoginTaken", func(t *testing.T) {
+		var body = `{"login": "taken", "password": "qwerty"}`
+		assert.Equal(t, http.StatusCreated, serveWithBody(http.MethodPost, "/api/v1/register", body).Code)
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v2/register", body), http.StatusConflict,
+			ErrorLoginTaken)
+	})
+	t.Run("InvalidId", func(t *testing.T) {
+		var body = `{"token": "` + token + `"}`
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/expressions/abc", body), http.StatusBadRequest,
+			ErrorInvalidId)
+		assertErrorJson(t, serveV2(http.MethodDelete, "/api/v2/expressions/1.5", nil), http.StatusBadRequest,
+			ErrorInvalidId)
+	})
+	t.Run("InvalidParams", func(t *testing.T) {
+		var body = `{"token": "` + token + `", "limit": -1}`
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/expressions", body), http.StatusBadRequest,
+			ErrorInvalidParams)
+	})
+	t.Run("InvalidExpression", func(t *testing.T) {
+		var body = `{"token": "` + token + `", "expression": "2+"}`
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/calculate", body),
+			http.StatusUnprocessableEntity, ErrorInvalidExpression)
+	})
+	t.Run("UnsupportedMediaType", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/register", strings.NewReader("login=a"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		getHandler().ServeHTTP(w, req)
+		assertErrorJson(t, w, http.StatusUnsupportedMediaType, ErrorUnsupportedMediaType)
+	})
+	t.Run("V1IgnoresContentType", func(t *testing.T) {
+		for _, contentType := range []string{"", "application/x-www-form-urlencoded"} {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/login",
+				strings.NewReader(`{"login": "test", "password": "qwerty"}`))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			getHandler().ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, contentType)
+		}
+	})
+	t.Run("Unauthorized", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/expressions", `{"token": "x"}`),
+			http.StatusUnauthorized, ErrorUnauthorized)
+	})
+	t.Run("UnknownRoute", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodGet, "/api/v3/expressions", ""), http.StatusNotFound,
+			ErrorNotFound)
+	})
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		w := serveV2(http.MethodPatch, "/api/v2/expressions", nil)
+		assertErrorJson(t, w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed)
+		assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+	})
+	t.Run("Internal", func(t *testing.T) {
+		var (
+			w       = httptest.NewRecorder()
+			handler = panicMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				panic(errors.New("сбой"))
+			}))
+		)
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil))
+		assertErrorJson(t, w, http.StatusInternalServerError, ErrorInternal)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/golang-jwt/jwt/v5"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// devJwtSecret -- ключ, которым подписываются токены, если JWT_KEYS не задан. Годится только для разработки.
+const devJwtSecret = "not_under_deploy_not_under_deploy"
+
+/*
+JwtKey -- ключ подписи токенов. Id попадает в заголовок kid выпущенного ключом токена. У ключа, загруженного из
+открытого ключа PEM, нет signKey: такой ключ только проверяет подписи.
+*/
+type JwtKey struct {
+	Id        string
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+func (k *JwtKey) CanSign() bool {
+	return k.signKey != nil
+}
+
+func CallHmacJwtKeyFabric(kid string, secret string) *JwtKey {
+	return &JwtKey{Id: kid, method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+}
+
+/*
+LoadPemJwtKey читает ключ алгоритма alg (RS256 или EdDSA) из PEM-файла path. Файл может содержать закрытый ключ
+(ключ подписывает и проверяет) или открытый (только проверяет).
+*/
+func LoadPemJwtKey(kid string, alg string, path string) (key *JwtKey, err error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	key = &JwtKey{Id: kid}
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		key.method = jwt.SigningMethodRS256
+		if private, privateErr := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); privateErr == nil {
+			key.signKey, key.verifyKey = private, &private.PublicKey
+		} else if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pemBytes); err != nil {
+			return nil, fmt.Errorf("%s не содержит ключ RSA: %w", path, errors.Join(privateErr, err))
+		}
+	case jwt.SigningMethodEdDSA.Alg():
+		key.method = jwt.SigningMethodEdDSA
+		var private crypto.PrivateKey
+		if private, err = jwt.ParseEdPrivateKeyFromPEM(pemBytes); err == nil {
+			key.signKey, key.verifyKey = private, private.(ed25519.PrivateKey).Public()
+		} else if key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(pemBytes); err != nil {
+			return nil, fmt.Errorf("%s не содержит ключ Ed25519: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("алгоритм %s не поддерживается для PEM-файлов", alg)
+	}
+	return key, nil
+}
+
+/*
+parseJwtKeys разбирает список ключей вида kid=HS256:секрет,kid=RS256:путь.pem,kid=EdDSA:путь.pem (формат JWT_KEYS).
+*/
+func parseJwtKeys(spec string) (keys []*JwtKey, err error) {
+	for _, entry := range strings.Split(spec, ",") {
+		kid, algAndValue, found := strings.Cut(strings.TrimSpace(entry), "=")
+		alg, value, foundAlg := strings.Cut(algAndValue, ":")
+		if !found || !foundAlg || kid == "" || value == "" {
+			return nil, fmt.Errorf("ключ %q должен иметь вид kid=алгоритм:значение", entry)
+		}
+		var key *JwtKey
+		if alg == jwt.SigningMethodHS256.Alg() {
+			key = CallHmacJwtKeyFabric(kid, value)
+		} else if key, err = LoadPemJwtKey(kid, alg, value); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+/*
+JwtKeyring -- активные ключи токенов. Новые токены подписываются ключом signing, а проверяются все токены, чей kid
+есть в keys. Поэтому для ротации новый ключ добавляется и делается подписывающим, а старый остаётся в списке, пока
+не истекут выпущенные им токены.
+*/
+type JwtKeyring struct {
+	keys    map[string]*JwtKey
+	signing *JwtKey
+	ttl     time.Duration
+}
+
+func CallJwtKeyringFabric(signingKid string, ttl time.Duration, keys ...*JwtKey) (*JwtKeyring, error) {
+	var keyring = &JwtKeyring{keys: make(map[string]*JwtKey), ttl: ttl}
+	for _, key := range keys {
+		if _, ok := keyring.keys[key.Id]; ok {
+			return nil, fmt.Errorf("kid %s повторяется", key.Id)
+		}
+		keyring.keys[key.Id] = key
+	}
+	var ok bool
+	if keyring.signing, ok = keyring.keys[signingKid]; !ok {
+		return nil, fmt.Errorf("подписывающего ключа %s нет среди ключей", signingKid)
+	}
+	if !keyring.signing.CanSign() {
+		return nil, fmt.Errorf("ключ %s задан открытым ключом и не может подписывать", signingKid)
+	}
+	return keyring, nil
+}
+
+/*
+CallDefaultJwtKeyringFabric создаёт JwtKeyring из JWT_KEYS, JWT_SIGNING_KID (по умолчанию первый ключ JWT_KEYS) и
+JWT_TTL (по умолчанию 10m). Без JWT_KEYS используется devJwtSecret.
+*/
+func CallDefaultJwtKeyringFabric() *JwtKeyring {
+	var (
+		spec, specOk = backend.CallEnvVarFabric("JWT_KEYS", "").Get()
+		ttl          = getDurationEnv("JWT_TTL", "10m")
+		keys         []*JwtKey
+		err          error
+	)
+	if specOk {
+		if keys, err = parseJwtKeys(spec); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		log.Println("JWT_KEYS не задан: токены подписываются ключом для разработки")
+		keys = []*JwtKey{CallHmacJwtKeyFabric("dev", devJwtSecret)}
+	}
+	var signingKid, _ = backend.CallEnvVarFabric("JWT_SIGNING_KID", keys[0].Id).Get()
+	keyring, err := CallJwtKeyringFabric(signingKid, ttl, keys...)
+	if err != nil {
+		log.Panic(err)
+	}
+	return keyring
+}
+
+// Sign выпускает токен с claims, подписанный текущим подписывающим ключом.
+func (k *JwtKeyring) Sign(claims jwt.MapClaims) (token string, err error) {
+	var jwtInstance = jwt.NewWithClaims(k.signing.method, claims)
+	jwtInstance.Header["kid"] = k.signing.Id
+	return jwtInstance.SignedString(k.signing.signKey)
+}
+
+/*
+keyFunc выбирает ключ проверки по kid токена. Токены без kid, выпущенные до появления ротации, проверяются
+подписывающим ключом. Алгоритм токена должен совпадать с алгоритмом ключа.
+*/
+func (k *JwtKeyring) keyFunc(token *jwt.Token) (any, error) {
+	var key = k.signing
+	if kid, ok := token.Header["kid"]; ok {
+		kidString, _ := kid.(string)
+		if key, ok = k.keys[kidString]; !ok {
+			return nil, fmt.Errorf("ключ токена %v не найден", kid)
+		}
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("метод подписи токена %v не ожидается", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useJwtKeyring подменяет jwtKeyring на время теста.
+func useJwtKeyring(t *testing.T, keyring *JwtKeyring) {
+	var previous = jwtKeyring
+	t.Cleanup(func() {
+		jwtKeyring = previous
+	})
+	jwtKeyring = keyring
+}
+
+// writePem записывает в каталог теста PEM-файл name с блоком blockType.
+func writePem(t *testing.T, name string, blockType string, der []byte) (path string) {
+	path = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func mustKeyring(t *testing.T, signingKid string, keys ...*JwtKey) *JwtKeyring {
+	keyring, err := CallJwtKeyringFabric(signingKid, time.Minute, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestJwtKeyring(t *testing.T) {
+	var (
+		oldKey = CallHmacJwtKeyFabric("old", "old-secret")
+		newKey = CallHmacJwtKeyFabric("new", "new-secret")
+	)
+	t.Run("Rotation", func(t *testing.T) {
+		useJwtKeyring(t, mustKeyring(t, "old", oldKey))
+		oldToken, _ := GenerateJwt(&testUser, RoleUser, 0)
+
+		useJwtKeyring(t, mustKeyring(t, "new", oldKey, newKey))
+		user, err := ParseJwt(oldToken)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testUser.GetLogin(), user.GetLogin())
+		}
+		newToken, _ := GenerateJwt(&testUser, RoleUser, 0)
+		parsed, _, err := jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "new", parsed.Header["kid"])
+		}
+
+		useJwtKeyring(t, mustKeyring(t, "new", newKey))
+		_, err = ParseJwt(oldToken)
+		assert.Error(t, err)
+		_, err = ParseJwt(newToken)
+		assert.NoError(t, err)
+	})
+	t.Run("TokenWithoutKid", func(t *testing.T) {
+		useJwtKeyring(t, mustKeyring(t, "new", oldKey, newKey))
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"login": "test", "id": 1}).
+			SignedString([]byte("new-secret"))
+		_, err := ParseJwt(token)
+		assert.NoError(t, err)
+	})
+	t.Run("Ttl", func(t *testing.T) {
+		t.Setenv("JWT_TTL", "1h")
+		useJwtKeyring(t, CallDefaultJwtKeyringFabric())
+		token, _ := GenerateJwt(&testUser, RoleUser, 0)
+		parsed, _, _ := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		exp, err := parsed.Claims.GetExpirationTime()
+		if assert.NoError(t, err) {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), exp.Time, time.Minute)
+		}
+	})
+	t.Run("Rsa", func(t *testing.T) {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicDer, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+		privateKey, err := LoadPemJwtKey("rsa", "RS256", writePem(t, "rsa.pem", "RSA PRIVATE KEY",
+			x509.MarshalPKCS1PrivateKey(private)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		publicKey, err := LoadPemJwtKey("rsa", "RS256", writePem(t, "rsa.pub", "PUBLIC KEY", publicDer))
+		if !assert.NoError(t, err) {
+			return
+		}
+		useJwtKeyring(t, mustKeyring(t, "rsa", privateKey))
+		token, _ := GenerateJwt(&testUser, RoleUser, 0)
+
+		_, err = CallJwtKeyringFabric("rsa", time.Minute, publicKey)
+		assert.Error(t, err)
+		useJwtKeyring(t, mustKeyring(t, "hs", CallHmacJwtKeyFabric("hs", "secret"), publicKey))
+		_, err = ParseJwt(token)
+		assert.NoError(t, err)
+
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"login": "test", "id": 1})
+		forged.Header["kid"] = "rsa"
+		forgedToken, _ := forged.SignedString(publicDer)
+		_, err = ParseJwt(forgedToken)
+		assert.Error(t, err)
+	})
+	t.Run("EdDsa", func(t *testing.T) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateDer, _ := x509.MarshalPKCS8PrivateKey(private)
+		keys, err := parseJwtKeys("ed=EdDSA:" + writePem(t, "ed.pem", "PRIVATE KEY", privateDer))
+		if !assert.NoError(t, err) {
+			return
+		}
+		useJwtKeyring(t, mustKeyring(t, "ed", keys...))
+		token, _ := GenerateJwt(&testUser, RoleUser, 0)
+		user, err := ParseJwt(token)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testUser.GetId(), user.GetId())
+		}
+	})
+	t.Run("BadConfig", func(t *testing.T) {
+		for _, spec := range []string{"a", "a=HS256", "=HS256:s", "a=ES256:key.pem", "a=RS256:missing.pem",
+			"a=HS256:s,a=HS256:t"} {
+			keys, err := parseJwtKeys(spec)
+			if err == nil {
+				_, err = CallJwtKeyringFabric("a", time.Minute, keys...)
+			}
+			assert.Error(t, err, spec)
+		}
+		t.Setenv("JWT_KEYS", "a=HS256:s")
+		t.Setenv("JWT_SIGNING_KID", "b")
+		assert.Panics(t, func() { CallDefaultJwtKeyringFabric() })
+	})
+}
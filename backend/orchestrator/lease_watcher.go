@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// leaseCheckInterval -- как часто проверяются Task-и, выданные агентам.
+const leaseCheckInterval = 500 * time.Millisecond
+
+/*
+requeueExpiredTasks возвращает в очередь Task-и, результат которых так и не пришёл за допустимое время.
+Выражения, чьи Task-и исчерпали все попытки, отправляются в БД и удаляются из exprsList.
+*/
+func requeueExpiredTasks(now time.Time) {
+	for _, expr := range exprsList.GetAll() {
+		if err := expr.RequeueExpiredTasks(now); err != nil { // выражение завершилось именно сейчас.
+			log.Println(err)
+			if err = finishExpr(expr); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+}
+
+func UpLeaseWatcher() {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		requeueExpiredTasks(now)
+	}
+}
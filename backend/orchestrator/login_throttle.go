@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// loginFailures -- неудачные попытки входа по одному логину или с одного IP.
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+/*
+LoginThrottler ограничивает подбор паролей. Неудачные попытки считаются отдельно по логину и по IP; после
+freeAttempts неудач логин (после ipFreeAttempts -- IP) блокируется на lockoutBase, и каждая следующая неудача
+удваивает блокировку вплоть до lockoutMax. Успешный вход сбрасывает счётчик логина, счётчик IP сбрасывается, только
+если с IP не было неудач дольше lockoutMax. Счётчики хранятся в памяти реплики, и каждый из них ограничен maxKeys
+записями.
+*/
+type LoginThrottler struct {
+	mut            sync.Mutex
+	byLogin        map[string]*loginFailures
+	byIp           map[string]*loginFailures
+	freeAttempts   int
+	ipFreeAttempts int
+	lockoutBase    time.Duration
+	lockoutMax     time.Duration
+	maxKeys        int
+}
+
+// loginThrottlerMaxKeys -- сколько логинов и сколько IP с неудачными попытками LoginThrottler хранит одновременно.
+const loginThrottlerMaxKeys = 100_000
+
+func CallLoginThrottlerFabric(freeAttempts int, ipFreeAttempts int, lockoutBase time.Duration,
+	lockoutMax time.Duration) *LoginThrottler {
+	return &LoginThrottler{byLogin: make(map[string]*loginFailures), byIp: make(map[string]*loginFailures),
+		freeAttempts: freeAttempts, ipFreeAttempts: ipFreeAttempts, lockoutBase: lockoutBase, lockoutMax: lockoutMax,
+		maxKeys: loginThrottlerMaxKeys}
+}
+
+/*
+CallDefaultLoginThrottlerFabric создаёт LoginThrottler из LOGIN_FREE_ATTEMPTS (по умолчанию 5), LOGIN_IP_FREE_ATTEMPTS
+(50), LOGIN_LOCKOUT_BASE (1s) и LOGIN_LOCKOUT_MAX (15m).
+*/
+func CallDefaultLoginThrottlerFabric() *LoginThrottler {
+	return CallLoginThrottlerFabric(getIntEnv("LOGIN_FREE_ATTEMPTS", "5"), getIntEnv("LOGIN_IP_FREE_ATTEMPTS", "50"),
+		getDurationEnv("LOGIN_LOCKOUT_BASE", "1s"), getDurationEnv("LOGIN_LOCKOUT_MAX", "15m"))
+}
+
+/*
+LockedFor возвращает, сколько ещё заблокированы попытки входа под login с ip. 0 означает, что попытку можно
+проверять.
+*/
+func (l *LoginThrottler) LockedFor(login string, ip string, now time.Time) time.Duration {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	var lockedUntil time.Time
+	for _, failures := range []*loginFailures{l.actual(l.byLogin, login, now), l.actual(l.byIp, ip, now)} {
+		if failures != nil && failures.lockedUntil.After(lockedUntil) {
+			lockedUntil = failures.lockedUntil
+		}
+	}
+	return max(lockedUntil.Sub(now), 0)
+}
+
+// RecordFailure учитывает неудачную попытку и возвращает её номер для login.
+func (l *LoginThrottler) RecordFailure(login string, ip string, now time.Time) (attempt int) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	attempt = l.record(l.byLogin, login, l.freeAttempts, now)
+	l.record(l.byIp, ip, l.ipFreeAttempts, now)
+	return
+}
+
+// RecordSuccess сбрасывает счётчик неудач login.
+func (l *LoginThrottler) RecordSuccess(login string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	delete(l.byLogin, login)
+}
+
+/*
+actual возвращает неудачи по key или nil, если их не было дольше lockoutMax: такие записи удаляются, чтобы счётчики
+не росли бесконечно. Вызывается под mut.
+*/
+func (l *LoginThrottler) actual(failuresByKey map[string]*loginFailures, key string, now time.Time) *loginFailures {
+	failures, ok := failuresByKey[key]
+	if ok && now.Sub(failures.lastFailure) > l.lockoutMax && !failures.lockedUntil.After(now) {
+		delete(failuresByKey, key)
+		return nil
+	}
+	return failures
+}
+
+func (l *LoginThrottler) record(failuresByKey map[string]*loginFailures, key string, freeAttempts int,
+	now time.Time) int {
+	var failures = l.actual(failuresByKey, key, now)
+	if failures == nil {
+		if len(failuresByKey) >= l.maxKeys {
+			l.sweep(failuresByKey, now)
+		}
+		failures = &loginFailures{}
+		failuresByKey[key] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if extra := failures.count - freeAttempts + 1; extra > 0 {
+		failures.lockedUntil = now.Add(l.lockout(extra))
+	}
+	return failures.count
+}
+
+/*
+sweep удаляет из failuresByKey устаревшие записи. Если после этого занято больше половины maxKeys, удаляются записи
+с самыми давними неудачами, даже если блокировка ещё действует: при подборе с множества логинов или IP память
+важнее. Освобождается половина мест, поэтому sweep вызывается редко. Вызывается под mut.
+*/
+func (l *LoginThrottler) sweep(failuresByKey map[string]*loginFailures, now time.Time) {
+	for key := range failuresByKey {
+		l.actual(failuresByKey, key, now)
+	}
+	if len(failuresByKey) <= l.maxKeys/2 {
+		return
+	}
+	var keys = slices.Collect(maps.Keys(failuresByKey))
+	slices.SortFunc(keys, func(a string, b string) int {
+		return failuresByKey[a].lastFailure.Compare(failuresByKey[b].lastFailure)
+	})
+	for _, key := range keys[:len(keys)-l.maxKeys/2] {
+		delete(failuresByKey, key)
+	}
+}
+
+/*
+lockout возвращает длительность блокировки после extra-й неудачи, начиная с последней бесплатной: lockoutBase *
+2^(extra-1).
+*/
+func (l *LoginThrottler) lockout(extra int) time.Duration {
+	var factor = math.Pow(2, float64(extra-1))
+	if float64(l.lockoutBase)*factor >= float64(l.lockoutMax) {
+		return l.lockoutMax
+	}
+	return time.Duration(float64(l.lockoutBase) * factor)
+}
+
+/*
+auditLog -- журнал неудачных попыток входа. Пишется в LOGIN_AUDIT_LOG (по умолчанию в стандартный поток ошибок).
+*/
+var auditLog = callAuditLoggerFabric()
+
+func callAuditLoggerFabric() *log.Logger {
+	var path, ok = backend.CallEnvVarFabric("LOGIN_AUDIT_LOG", "").Get()
+	if !ok {
+		return log.New(os.Stderr, "audit: ", log.LstdFlags)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	return log.New(file, "", log.LstdFlags)
+}
+
+/*
+dummyPasswordHash -- хеш случайного пароля. С ним сравнивается пароль при входе под несуществующим логином, чтобы
+такой вход занимал столько же времени, сколько вход с неверным паролем.
+*/
+var dummyPasswordHash = sync.OnceValue(func() string {
+	user, err := backend.WrapIntoDbUser(&backend.JsonUser{Password: rand.Text()})
+	if err != nil {
+		log.Panic(err)
+	}
+	return user.GetHashedPassword()
+})
+
+// failureReason описывает для auditLog причину неудачного входа. err -- ошибка SelectUser.
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "логин не найден"
+	case err != nil:
+		return err.Error()
+	}
+	return "неверный пароль"
+}
+
+/*
+clientIp возвращает IP клиента из адреса соединения. X-Forwarded-For не учитывается: его может подделать любой
+клиент.
+*/
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeTooManyAttempts отвечает 429 с заголовком Retry-After в секундах.
+func writeTooManyAttempts(w http.ResponseWriter, lockedFor time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, ErrorTooManyAttempts, "слишком много неудачных попыток ввода пароля, "+
+		"повторите позже", nil)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useLoginThrottler подменяет loginThrottler на время теста.
+func useLoginThrottler(t *testing.T, throttler *LoginThrottler) {
+	var previous = loginThrottler
+	t.Cleanup(func() {
+		loginThrottler = previous
+	})
+	loginThrottler = throttler
+}
+
+func TestLoginThrottler(t *testing.T) {
+	var now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	t.Run("ExponentialLockout", func(t *testing.T) {
+		var throttler = CallLoginThrottlerFabric(2, 100, time.Second, 5*time.Second)
+		for _, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second,
+			5 * time.Second} {
+			throttler.RecordFailure("user", "10.0.0.1", now)
+			assert.Equal(t, expected, throttler.LockedFor("user", "10.0.0.2", now))
+		}
+		assert.Equal(t, 2*time.Second, throttler.LockedFor("user", "10.0.0.2", now.Add(3*time.Second)))
+		assert.Zero(t, throttler.LockedFor("other", "10.0.0.2", now))
+	})
+	t.Run("LockoutByIp", func(t *testing.T) {
+		var throttler = CallLoginThrottlerFabric(100, 3, time.Second, time.Minute)
+		for _, login := range []string{"a", "b"} {
+			throttler.RecordFailure(login, "10.0.0.1", now)
+		}
+		assert.Zero(t, throttler.LockedFor("d", "10.0.0.1", now))
+		throttler.RecordFailure("c", "10.0.0.1", now)
+		assert.Equal(t, time.Second, throttler.LockedFor("e", "10.0.0.1", now))
+		assert.Zero(t, throttler.LockedFor("e", "10.0.0.2", now))
+	})
+	t.Run("RecordSuccess", func(t *testing.T) {
+		var throttler = CallLoginThrottlerFabric(2, 100, time.Second, time.Minute)
+		throttler.RecordFailure("user", "10.0.0.1", now)
+		throttler.RecordSuccess("user")
+		assert.Equal(t, 1, throttler.RecordFailure("user", "10.0.0.1", now))
+		assert.Zero(t, throttler.LockedFor("user", "10.0.0.1", now))
+	})
+	t.Run("StaleFailuresForgotten", func(t *testing.T) {
+		var throttler = CallLoginThrottlerFabric(1, 100, time.Second, time.Minute)
+		throttler.RecordFailure("user", "10.0.0.1", now)
+		throttler.RecordFailure("user", "10.0.0.1", now)
+		var later = now.Add(2 * time.Minute)
+		assert.Zero(t, throttler.LockedFor("user", "10.0.0.1", later))
+		assert.Empty(t, throttler.byLogin)
+		assert.Empty(t, throttler.byIp)
+		assert.Equal(t, 1, throttler.RecordFailure("user", "10.0.0.1", later))
+	})
+	t.Run("MapsBounded", func(t *testing.T) {
+		var throttler = CallLoginThrottlerFabric(1, 1, time.Second, time.Minute)
+		throttler.maxKeys = 4
+		for i := range 4 {
+			throttler.RecordFailure(strconv.Itoa(i), "10.0.0."+strconv.Itoa(i), now)
+		}
+		var later = now.Add(2 * time.Minute)
+		throttler.RecordFailure("stale sweep", "10.0.1.0", later)
+		assert.Len(t, throttler.byLogin, 1)
+		assert.Len(t, throttler.byIp, 1)
+
+		for i := range 10 {
+			throttler.RecordFailure("login"+strconv.Itoa(i), "10.0.2."+strconv.Itoa(i), later.Add(time.Duration(i)))
+			assert.LessOrEqual(t, len(throttler.byLogin), throttler.maxKeys)
+			assert.LessOrEqual(t, len(throttler.byIp), throttler.maxKeys)
+		}
+		assert.Equal(t, time.Second, throttler.LockedFor("login9", "10.0.0.1", later.Add(9)))
+		assert.Zero(t, throttler.LockedFor("stale sweep", "10.0.0.1", later)) // самая давняя запись вытеснена.
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	t.Cleanup(func() {
+		db = callStubDbWithRegisteredUserFabric(testUser)
+	})
+	db = callStubDbWithRegisteredUserFabric(testUser)
+	useLoginThrottler(t, CallLoginThrottlerFabric(2, 100, time.Minute, time.Hour))
+	assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login", `{"login": "test", "password": "wrong"}`),
+		http.StatusUnauthorized, ErrorUnauthorized)
+	assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login", `{"login": "test", "password": "wrong"}`),
+		http.StatusUnauthorized, ErrorUnauthorized)
+
+	w := serveWithBody(http.MethodPost, "/api/v2/login", `{"login": "test", "password": "qwerty"}`)
+	assertErrorJson(t, w, http.StatusTooManyRequests, ErrorTooManyAttempts)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if assert.NoError(t, err) {
+		assert.InDelta(t, 60, retryAfter, 1) // с момента неудачной попытки могла пройти секунда.
+	}
+	t.Run("UnknownLogin", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/login", `{"login": "unknown", "password": "x"}`),
+			http.StatusUnauthorized, ErrorUnauthorized)
+		assert.Equal(t, 2, loginThrottler.RecordFailure("unknown", "", time.Now()))
+	})
+	t.Run("UnlockedAfterSuccess", func(t *testing.T) {
+		loginThrottler.RecordSuccess("test")
+		requestTokens(t, "/api/v1/login", `{"login": "test", "password": "qwerty"}`)
+	})
+}
@@ -1,12 +1,49 @@
 package main
 
-import "sync"
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+)
 
 func main() {
 	var (
 		wg  sync.WaitGroup
 		err error
 	)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if GetDefaultDbDsn() == memoryDsn {
+			log.Panic("migrate не применяется к DB_DSN=" + memoryDsn + ": MemoryDb не хранит схему")
+		}
+		innerDb, dialect := GetDefaultSqlServer()
+		defer innerDb.Close()
+		if err = runMigrateCommand(context.TODO(), innerDb, dialect, os.Args[2:], os.Stdout); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		if GetDefaultDbDsn() == memoryDsn {
+			log.Panic("role не применяется к DB_DSN=" + memoryDsn + ": MemoryDb не переживает перезапуск")
+		}
+		var roleDb = callDbFabric(false) // role меняет только данные, схемой управляет migrate.
+		defer roleDb.Close()
+		if err = runRoleCommand(roleDb, os.Args[2:], os.Stdout); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	if err = configureTasks(); err != nil {
+		log.Panic(err)
+	}
+	if err = configureAccounts(); err != nil {
+		log.Panic(err)
+	}
+	db = CallDefaultDbWrapperFabric()
+	if err = restoreExprsList(); err != nil {
+		panic(err)
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -16,6 +53,11 @@ func main() {
 		}
 	}()
 	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		UpLeaseWatcher()
+	}()
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		err = UpHttpServer()
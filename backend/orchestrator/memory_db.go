@@ -0,0 +1,442 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryDsn в DB_DSN выбирает MemoryDb вместо SQLite и PostgreSQL.
+const memoryDsn = "memory://"
+
+// memoryExpr -- строка таблицы exprs в MemoryDb.
+type memoryExpr struct {
+	id         int
+	ownerId    int64
+	status     backend.ExprStatus
+	result     float64
+	reason     string
+	tree       string
+	source     string
+	timestamps backend.ExprTimestamps
+}
+
+/*
+MemoryDb -- DbWrapper, хранящий всё в памяти процесса. Подходит для одноразовых запусков и тестов: данные теряются
+при остановке оркестратора, поэтому незавершённые выражения после перезапуска не восстанавливаются. Поведение
+совпадает с Db: логины уникальны, выражения доступны только владельцу, завершённые выражения не перезаписываются,
+а ненайденные пользователи и выражения возвращают sql.ErrNoRows.
+*/
+type MemoryDb struct {
+	mut        sync.Mutex
+	lastUserId int64
+	lastExprId int
+	users      map[string]*backend.DbUser
+	exprs      map[int]*memoryExpr
+	/*
+		tasks отображает id выражения в результаты его посчитанных Task-ов по pairId.
+	*/
+	tasks    map[int]map[int32]float64
+	sessions memorySessions
+	accounts memoryAccounts
+}
+
+func (m *MemoryDb) InsertUser(user backend.UserWithHashedPassword) (lastId int64, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.users[user.GetLogin()]; ok {
+		return 0, backend.LoginAlreadyExists{Login: user.GetLogin()}
+	}
+	m.lastUserId++
+	m.users[user.GetLogin()] = backend.CallDbUserFabric(m.lastUserId, user.GetLogin(), user.GetHashedPassword())
+	return m.lastUserId, nil
+}
+
+func (m *MemoryDb) InsertExpr(expr backend.CommonExpression) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var stored, ok = m.exprs[expr.GetId()]
+	if ok && stored.status.IsFinished() {
+		return
+	}
+	if !ok {
+		stored = &memoryExpr{id: expr.GetId(), ownerId: expr.GetOwnerId(), tree: ast.Format(expr.GetTree()),
+			source: expr.GetSource()}
+		m.exprs[expr.GetId()] = stored
+	}
+	stored.status, stored.result, stored.reason = expr.GetStatus(), expr.GetResult(), expr.GetReason()
+	var timestamps = expr.GetTimestamps()
+	if !ok {
+		stored.timestamps.SubmittedAt = timestamps.SubmittedAt
+	}
+	stored.timestamps.StartedAt, stored.timestamps.FinishedAt = timestamps.StartedAt, timestamps.FinishedAt
+	return
+}
+
+func (m *MemoryDb) InsertTask(result backend.GrpcResult) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	exprId, _ := pkg.Unpair(int(result.GetPairId()))
+	if m.tasks[exprId] == nil {
+		m.tasks[exprId] = make(map[int32]float64)
+	}
+	m.tasks[exprId][result.GetPairId()] = result.GetResult()
+	return
+}
+
+func (m *MemoryDb) DeleteTasks(exprId int) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	delete(m.tasks, exprId)
+	return
+}
+
+func (m *MemoryDb) SelectRunningExprs() (exprs []StoredExpr, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, stored := range m.sortedExprs() {
+		if stored.status.IsFinished() {
+			continue
+		}
+		exprs = append(exprs, StoredExpr{Id: stored.id, OwnerId: stored.ownerId, Tree: stored.tree,
+			Source: stored.source, Timestamps: backend.ExprTimestamps{SubmittedAt: stored.timestamps.SubmittedAt,
+				StartedAt: stored.timestamps.StartedAt}, CalculatedTasks: maps.Clone(m.tasks[stored.id])})
+		if exprs[len(exprs)-1].CalculatedTasks == nil {
+			exprs[len(exprs)-1].CalculatedTasks = make(map[int32]float64)
+		}
+	}
+	return
+}
+
+func (m *MemoryDb) SelectUser(login string) (user backend.UserWithHashedPassword, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	stored, ok := m.users[login]
+	if !ok {
+		return backend.CallDbUserFabric(0, "", ""), sql.ErrNoRows
+	}
+	return backend.CallDbUserFabric(stored.GetId(), stored.GetLogin(), stored.GetHashedPassword()), nil
+}
+
+func (m *MemoryDb) UpdatePassword(userId int64, hashedPassword string) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for login, stored := range m.users {
+		if stored.GetId() == userId {
+			m.users[login] = backend.CallDbUserFabric(userId, login, hashedPassword)
+			return
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryDb) DeleteUser(userId int64) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for login, stored := range m.users {
+		if stored.GetId() != userId {
+			continue
+		}
+		delete(m.users, login)
+		for exprId, expr := range m.exprs {
+			if expr.ownerId == userId {
+				delete(m.exprs, exprId)
+				delete(m.tasks, exprId)
+			}
+		}
+		m.sessions.deleteUser(userId)
+		m.accounts.deleteUser(userId)
+		return
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryDb) SelectAllExprs(userOwnerId int64, filter ExprsFilter) (exprs []backend.ShortExpression,
+	err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, stored := range m.exprs {
+		if stored.ownerId == userOwnerId {
+			exprs = append(exprs, stored.toShortExpression())
+		}
+	}
+	return filter.Apply(exprs), nil
+}
+
+func (m *MemoryDb) SelectExpr(userOwnerId int64, exprId int) (expr backend.ShortExpression, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	stored, ok := m.exprs[exprId]
+	if !ok || stored.ownerId != userOwnerId {
+		return backend.CallShortExpressionFabric(exprId, userOwnerId, "", 0, "", "", backend.ExprTimestamps{}),
+			sql.ErrNoRows
+	}
+	return stored.toShortExpression(), nil
+}
+
+/*
+Flush удаляет пользователей, выражения и Task-и. Как и у Db, нумерация пользователей и выражений продолжается.
+*/
+func (m *MemoryDb) Flush() (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.users = make(map[string]*backend.DbUser)
+	m.exprs = make(map[int]*memoryExpr)
+	m.tasks = make(map[int]map[int32]float64)
+	m.sessions.flush()
+	m.accounts.flush()
+	return
+}
+
+func (m *MemoryDb) InsertSession(userId int64, refreshHash string, createdAt time.Time, expiresAt time.Time) (
+	sessionId int64, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, user := range m.users {
+		if user.GetId() == userId {
+			return m.sessions.insert(Session{UserId: userId, Login: user.GetLogin(), CreatedAt: createdAt,
+				ExpiresAt: expiresAt}, refreshHash), nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (m *MemoryDb) SelectSession(sessionId int64) (session Session, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.sessions.get(sessionId)
+}
+
+func (m *MemoryDb) RotateSession(oldHash string, newHash string, now time.Time, expiresAt time.Time) (
+	session Session, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.sessions.rotate(oldHash, newHash, now, expiresAt)
+}
+
+func (m *MemoryDb) RevokeSession(refreshHash string, now time.Time) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.sessions.revoke(refreshHash, now)
+}
+
+func (m *MemoryDb) RevokeUserSessions(userId int64, now time.Time) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.sessions.revokeUser(userId, now)
+	return
+}
+
+func (m *MemoryDb) SelectUserSessions(userId int64, now time.Time) (sessions []Session, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.sessions.activeOf(userId, now), nil
+}
+
+func (m *MemoryDb) SelectAccount(userId int64) (account Account, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	user, ok := m.userById(userId)
+	if !ok {
+		return account, sql.ErrNoRows
+	}
+	return m.accounts.of(user), nil
+}
+
+func (m *MemoryDb) SelectAccounts() (accounts []Account, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, user := range m.users {
+		accounts = append(accounts, m.accounts.of(user))
+	}
+	slices.SortFunc(accounts, func(a Account, b Account) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return
+}
+
+func (m *MemoryDb) UpdateRole(userId int64, role Role) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.userById(userId); !ok {
+		return sql.ErrNoRows
+	}
+	m.accounts.row(userId).role = role
+	return
+}
+
+func (m *MemoryDb) UpdateDisabledAt(userId int64, disabledAt time.Time) (err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.userById(userId); !ok {
+		return sql.ErrNoRows
+	}
+	m.accounts.row(userId).disabledAt = disabledAt
+	return
+}
+
+func (m *MemoryDb) ReserveExprId() (result int, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.lastExprId++
+	return m.lastExprId, nil
+}
+
+func (m *MemoryDb) Close() (err error) {
+	return
+}
+
+// userById ищет пользователя по id. Вызывается под mut.
+func (m *MemoryDb) userById(userId int64) (user *backend.DbUser, ok bool) {
+	for _, user = range m.users {
+		if user.GetId() == userId {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// sortedExprs возвращает выражения по возрастанию id. Вызывается под mut.
+func (m *MemoryDb) sortedExprs() []*memoryExpr {
+	return slices.SortedFunc(maps.Values(m.exprs), func(a *memoryExpr, b *memoryExpr) int {
+		return cmp.Compare(a.id, b.id)
+	})
+}
+
+func (e *memoryExpr) toShortExpression() backend.ShortExpression {
+	return backend.CallShortExpressionFabric(e.id, e.ownerId, e.status, e.result, e.reason, e.source, e.timestamps)
+}
+
+// memorySession -- строка таблицы sessions в MemoryDb.
+type memorySession struct {
+	Session
+	refreshHash string
+}
+
+/*
+memorySessions -- таблица sessions для MemoryDb и DbStub. Нулевое значение готово к работе. Методы не
+синхронизированы: MemoryDb вызывает их под mut.
+*/
+type memorySessions struct {
+	lastId int64
+	rows   map[int64]*memorySession
+}
+
+func (m *memorySessions) insert(session Session, refreshHash string) (sessionId int64) {
+	if m.rows == nil {
+		m.rows = make(map[int64]*memorySession)
+	}
+	m.lastId++
+	session.Id = m.lastId
+	m.rows[session.Id] = &memorySession{Session: session, refreshHash: refreshHash}
+	return session.Id
+}
+
+func (m *memorySessions) get(sessionId int64) (session Session, err error) {
+	stored, ok := m.rows[sessionId]
+	if !ok {
+		return session, sql.ErrNoRows
+	}
+	return stored.Session, nil
+}
+
+func (m *memorySessions) rotate(oldHash string, newHash string, now time.Time, expiresAt time.Time) (
+	session Session, err error) {
+	for _, stored := range m.rows {
+		if stored.refreshHash == oldHash && stored.IsActive(now) {
+			stored.refreshHash, stored.ExpiresAt = newHash, expiresAt
+			return stored.Session, nil
+		}
+	}
+	return session, sql.ErrNoRows
+}
+
+func (m *memorySessions) revoke(refreshHash string, now time.Time) (err error) {
+	for _, stored := range m.rows {
+		if stored.refreshHash == refreshHash && stored.RevokedAt.IsZero() {
+			stored.RevokedAt = now
+			return
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memorySessions) revokeUser(userId int64, now time.Time) {
+	for _, stored := range m.rows {
+		if stored.UserId == userId && stored.RevokedAt.IsZero() {
+			stored.RevokedAt = now
+		}
+	}
+}
+
+// activeOf возвращает активные сессии пользователя по возрастанию id.
+func (m *memorySessions) activeOf(userId int64, now time.Time) (sessions []Session) {
+	for _, sessionId := range slices.Sorted(maps.Keys(m.rows)) {
+		if stored := m.rows[sessionId]; stored.UserId == userId && stored.IsActive(now) {
+			sessions = append(sessions, stored.Session)
+		}
+	}
+	return
+}
+
+func (m *memorySessions) deleteUser(userId int64) {
+	maps.DeleteFunc(m.rows, func(_ int64, stored *memorySession) bool {
+		return stored.UserId == userId
+	})
+}
+
+func (m *memorySessions) flush() {
+	m.rows = nil
+}
+
+// memoryAccount -- колонки role и disabledAt строки таблицы users.
+type memoryAccount struct {
+	role       Role
+	disabledAt time.Time
+}
+
+/*
+memoryAccounts -- роли и отключения пользователей для MemoryDb и DbStub. Нулевое значение готово к работе: у
+пользователя без записи роль RoleUser и он не отключён. Методы не синхронизированы: MemoryDb вызывает их под mut.
+*/
+type memoryAccounts struct {
+	rows map[int64]*memoryAccount
+}
+
+func (m *memoryAccounts) of(user backend.CommonUser) Account {
+	var account = Account{Id: user.GetId(), Login: user.GetLogin(), Role: RoleUser}
+	if stored, ok := m.rows[user.GetId()]; ok {
+		account.Role, account.DisabledAt = stored.role, stored.disabledAt
+	}
+	return account
+}
+
+// row возвращает изменяемую запись пользователя, создавая её при необходимости.
+func (m *memoryAccounts) row(userId int64) *memoryAccount {
+	if m.rows == nil {
+		m.rows = make(map[int64]*memoryAccount)
+	}
+	if _, ok := m.rows[userId]; !ok {
+		m.rows[userId] = &memoryAccount{role: RoleUser}
+	}
+	return m.rows[userId]
+}
+
+func (m *memoryAccounts) deleteUser(userId int64) {
+	delete(m.rows, userId)
+}
+
+func (m *memoryAccounts) flush() {
+	m.rows = nil
+}
+
+func CallMemoryDbFabric() *MemoryDb {
+	return &MemoryDb{users: make(map[string]*backend.DbUser), exprs: make(map[int]*memoryExpr),
+		tasks: make(map[int]map[int32]float64)}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDb(t *testing.T) {
+	testDbWrapper(t, CallMemoryDbFabric(), nil)
+}
+
+func TestMemoryDbLoginAlreadyExists(t *testing.T) {
+	var d = CallMemoryDbFabric()
+	user, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "test", Password: "qwerty"})
+	_, err := d.InsertUser(user)
+	assert.NoError(t, err)
+	_, err = d.InsertUser(user)
+	var alreadyExists backend.LoginAlreadyExists
+	if assert.True(t, errors.As(err, &alreadyExists)) {
+		assert.Equal(t, "test", alreadyExists.Login)
+	}
+}
+
+func TestMemoryDbConcurrent(t *testing.T) {
+	const workers = 16
+	var (
+		d       = CallMemoryDbFabric()
+		wg      sync.WaitGroup
+		exprIds = make(chan int, workers)
+		userIds = make(chan int64, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: fmt.Sprintf("user%d", i), Password: "qwerty"})
+			userId, err := d.InsertUser(user)
+			assert.NoError(t, err)
+			userIds <- userId
+			exprId, err := d.ReserveExprId()
+			assert.NoError(t, err)
+			exprIds <- exprId
+			tree, _ := pkg.Parse("1+2")
+			assert.NoError(t, d.InsertExpr(backend.CallExpressionFabric(tree, "1+2", exprId, userId, backend.Ready,
+				backend.CallTasksHandlerFabric())))
+			_, err = d.SelectAllExprs(userId, ExprsFilter{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	close(exprIds)
+	close(userIds)
+	var (
+		uniqueExprIds = make(map[int]bool)
+		uniqueUserIds = make(map[int64]bool)
+	)
+	for id := range exprIds {
+		uniqueExprIds[id] = true
+	}
+	for id := range userIds {
+		uniqueUserIds[id] = true
+		exprs, err := d.SelectAllExprs(id, ExprsFilter{})
+		assert.NoError(t, err)
+		assert.Len(t, exprs, 1)
+	}
+	assert.Len(t, uniqueExprIds, workers)
+	assert.Len(t, uniqueUserIds, workers)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+migration -- одно изменение схемы БД. Миграции применяются по возрастанию version, каждая в своей транзакции, а
+применённые записываются в таблицу schema_migrations. DDL пишется через sqlDialect.ddl, чтобы одна миграция
+подходила и для SQLite, и для PostgreSQL.
+
+БД, созданные до появления schema_migrations, уже могут содержать часть изменений, поэтому up должен быть
+идемпотентным: используйте IF NOT EXISTS и addColumnIfNotExists.
+*/
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx, d sqlDialect) (err error)
+}
+
+/*
+migrations -- все миграции схемы в порядке применения. Новые миграции добавляются только в конец списка, уже
+выпущенные миграции не меняются.
+*/
+var migrations = []migration{
+	{version: 1, description: "таблицы users и exprs", up: func(ctx context.Context, tx *sql.Tx,
+		d sqlDialect) (err error) {
+		const query = `
+	CREATE TABLE IF NOT EXISTS users(
+		id {{serialKey}},
+		login TEXT UNIQUE,
+		password TEXT
+	);
+	CREATE TABLE IF NOT EXISTS exprs(
+	    exprId INTEGER PRIMARY KEY,
+	    ownerId {{bigint}},
+	    status TEXT,
+		_result {{float}},
+		FOREIGN KEY (ownerId) REFERENCES users (id)
+	);
+	`
+		_, err = tx.ExecContext(ctx, d.ddl(query))
+		return
+	}},
+	{version: 2, description: "причина отмены или ошибки выражения", up: func(ctx context.Context,
+		tx *sql.Tx, d sqlDialect) (err error) {
+		return addColumnIfNotExists(ctx, tx, d, "exprs", "reason", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{version: 3, description: "сохранение выполняющихся выражений и посчитанных задач", up: func(ctx context.Context,
+		tx *sql.Tx, d sqlDialect) (err error) {
+		const query = `
+	CREATE TABLE IF NOT EXISTS tasks(
+	    pairId INTEGER PRIMARY KEY,
+	    exprId INTEGER,
+		_result {{float}},
+		FOREIGN KEY (exprId) REFERENCES exprs (exprId)
+	);
+	`
+		if _, err = tx.ExecContext(ctx, d.ddl(query)); err != nil {
+			return
+		}
+		return addColumnIfNotExists(ctx, tx, d, "exprs", "tree", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{version: 4, description: "исходный текст, моменты времени и длительность выражения",
+		up: func(ctx context.Context, tx *sql.Tx, d sqlDialect) (err error) {
+			if err = addColumnIfNotExists(ctx, tx, d, "exprs", "source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return
+			}
+			for _, column := range []string{"submittedAt", "startedAt", "finishedAt", "duration"} {
+				err = addColumnIfNotExists(ctx, tx, d, "exprs", column, d.ddl("{{bigint}} NOT NULL DEFAULT 0"))
+				if err != nil {
+					return
+				}
+			}
+			return
+		}},
+	{version: 5, description: "общие для реплик id выражений и реплика, выполняющая выражение",
+		up: func(ctx context.Context, tx *sql.Tx, d sqlDialect) (err error) {
+			var query string
+			switch d.driverName {
+			case postgresDialect.driverName:
+				query = `
+	CREATE SEQUENCE IF NOT EXISTS expr_ids;
+	SELECT setval('expr_ids', COALESCE(MAX(exprId), 0) + 1, false) FROM exprs;
+	`
+			default: // id продолжают нумерацию сохранённых выражений; WHERE true отделяет ON CONFLICT от SELECT.
+				query = `
+	CREATE TABLE IF NOT EXISTS expr_ids(id INTEGER PRIMARY KEY AUTOINCREMENT);
+	INSERT INTO expr_ids (id) SELECT COALESCE(MAX(exprId), 0) FROM exprs WHERE true ON CONFLICT DO NOTHING;
+	`
+			}
+			if _, err = tx.ExecContext(ctx, query); err != nil {
+				return
+			}
+			return addColumnIfNotExists(ctx, tx, d, "exprs", "replica", "TEXT NOT NULL DEFAULT ''")
+		}},
+	{version: 6, description: "индексы для постраничного вывода выражений", up: func(ctx context.Context,
+		tx *sql.Tx, d sqlDialect) (err error) {
+		const query = `
+	CREATE INDEX IF NOT EXISTS exprs_owner_id ON exprs (ownerId, exprId);
+	CREATE INDEX IF NOT EXISTS exprs_owner_finished ON exprs (ownerId, finishedAt, exprId);
+	`
+		_, err = tx.ExecContext(ctx, query)
+		return
+	}},
+	{version: 7, description: "сессии и токены обновления", up: func(ctx context.Context, tx *sql.Tx,
+		d sqlDialect) (err error) {
+		const query = `
+	CREATE TABLE IF NOT EXISTS sessions(
+		id {{serialKey}},
+		userId {{bigint}} NOT NULL,
+		refreshHash TEXT NOT NULL UNIQUE,
+		createdAt {{bigint}} NOT NULL,
+		expiresAt {{bigint}} NOT NULL,
+		revokedAt {{bigint}} NOT NULL DEFAULT 0,
+		FOREIGN KEY (userId) REFERENCES users (id)
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user ON sessions (userId);
+	`
+		_, err = tx.ExecContext(ctx, d.ddl(query))
+		return
+	}},
+	{version: 8, description: "роли и отключение пользователей", up: func(ctx context.Context, tx *sql.Tx,
+		d sqlDialect) (err error) {
+		if err = addColumnIfNotExists(ctx, tx, d, "users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+			return
+		}
+		return addColumnIfNotExists(ctx, tx, d, "users", "disabledAt", d.ddl("{{bigint}} NOT NULL DEFAULT 0"))
+	}},
+}
+
+// migrationStatus -- состояние миграции в конкретной БД. Нулевой appliedAt означает, что миграция не применена.
+type migrationStatus struct {
+	migration
+	appliedAt time.Time
+}
+
+func createMigrationsTable(ctx context.Context, db *sql.DB, d sqlDialect) (err error) {
+	const query = `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		appliedAt {{bigint}} NOT NULL
+	);
+	`
+	_, err = db.ExecContext(ctx, d.ddl(query))
+	return
+}
+
+/*
+getMigrationsStatus возвращает состояние всех миграций из migrations в порядке их применения. БД не меняется: если
+таблицы schema_migrations ещё нет, все миграции считаются не применёнными.
+*/
+func getMigrationsStatus(ctx context.Context, db *sql.DB, d sqlDialect) (result []migrationStatus, err error) {
+	var (
+		query = `
+	SELECT version, appliedAt FROM schema_migrations
+	`
+		rows          *sql.Rows
+		appliedAt     = make(map[int]time.Time)
+		versionsCount int
+	)
+	err = db.QueryRowContext(ctx, d.hasColumnQuery, "schema_migrations", "version").Scan(&versionsCount)
+	if err != nil {
+		return
+	}
+	if versionsCount == 0 {
+		for _, m := range migrations {
+			result = append(result, migrationStatus{migration: m})
+		}
+		return
+	}
+	if rows, err = db.QueryContext(ctx, query); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			version int
+			moment  int64
+		)
+		if err = rows.Scan(&version, &moment); err != nil {
+			return
+		}
+		appliedAt[version] = timeFromDb(moment)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, m := range migrations {
+		result = append(result, migrationStatus{migration: m, appliedAt: appliedAt[m.version]})
+	}
+	return
+}
+
+/*
+migrate применяет все ещё не применённые миграции и возвращает их. Если миграция завершилась ошибкой, её изменения
+откатываются, а следующие миграции не применяются.
+*/
+func migrate(ctx context.Context, db *sql.DB, d sqlDialect) (applied []migration, err error) {
+	var statuses []migrationStatus
+	if err = createMigrationsTable(ctx, db, d); err != nil {
+		return
+	}
+	if statuses, err = getMigrationsStatus(ctx, db, d); err != nil {
+		return
+	}
+	for _, status := range statuses {
+		if !status.appliedAt.IsZero() {
+			continue
+		}
+		if err = applyMigration(ctx, db, d, status.migration); err != nil {
+			return applied, fmt.Errorf("миграция %d (%s): %w", status.version, status.description, err)
+		}
+		applied = append(applied, status.migration)
+	}
+	return
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, d sqlDialect, m migration) (err error) {
+	var (
+		query = `
+	INSERT INTO schema_migrations (version, description, appliedAt) values ($1, $2, $3)
+	`
+		tx *sql.Tx
+	)
+	if tx, err = db.BeginTx(ctx, nil); err != nil {
+		return
+	}
+	if err = m.up(ctx, tx, d); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	if _, err = tx.ExecContext(ctx, query, m.version, m.description, timeToDb(time.Now())); err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+/*
+isAutoMigrateEnabled сообщает, применяет ли CallDbFabric миграции при запуске оркестратора (MIGRATE_ON_START). Если
+автоматическое применение выключено, миграции применяются командой migrate up.
+*/
+func isAutoMigrateEnabled() bool {
+	return getBoolEnv("MIGRATE_ON_START", "true")
+}
+
+/*
+runMigrateCommand выполняет команду оркестратора migrate:
+  - migrate status -- выводит все миграции и моменты их применения;
+  - migrate up -- применяет все ещё не применённые миграции.
+*/
+func runMigrateCommand(ctx context.Context, db *sql.DB, d sqlDialect, args []string, out io.Writer) (err error) {
+	if len(args) != 1 {
+		return errors.New("использование: migrate status|up")
+	}
+	switch args[0] {
+	case "status":
+		var statuses []migrationStatus
+		if statuses, err = getMigrationsStatus(ctx, db, d); err != nil {
+			return
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, status := range statuses {
+			var appliedAt = "не применена"
+			if !status.appliedAt.IsZero() {
+				appliedAt = status.appliedAt.Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.version, status.description, appliedAt)
+		}
+		return w.Flush()
+	case "up":
+		var applied []migration
+		applied, err = migrate(ctx, db, d)
+		for _, m := range applied {
+			fmt.Fprintf(out, "применена миграция %d: %s\n", m.version, m.description)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "все миграции уже применены")
+		}
+		return
+	default:
+		return fmt.Errorf("неизвестная команда migrate %s, используйте status или up", args[0])
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+/*
+callLegacyTestDbFabric создаёт testCalc.db со схемой, которую создавали версии оркестратора до появления миграций.
+*/
+func callLegacyTestDbFabric(t *testing.T) (innerDb *sql.DB) {
+	const legacySchema = `
+	CREATE TABLE users(
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		login TEXT UNIQUE,
+		password TEXT
+	);
+	CREATE TABLE exprs(
+	    exprId INTEGER PRIMARY KEY,
+	    ownerId INTEGER,
+	    status TEXT,
+		_result INTEGER,
+		FOREIGN KEY (ownerId) REFERENCES users (id)
+	);
+	INSERT INTO users (login, password) values ('test', 'hash');
+	INSERT INTO exprs (exprId, ownerId, status, _result) values (1, 1, 'Выполнено', 4);
+	`
+	innerDb = GetTestSqlServer(t.TempDir())
+	t.Cleanup(func() {
+		innerDb.Close()
+	})
+	if _, err := innerDb.ExecContext(context.TODO(), legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+/*
+callEmptyPostgresTestDbFabric удаляет из PostgreSQL (TEST_POSTGRES_DSN) все таблицы оркестратора. Если
+TEST_POSTGRES_DSN не задана, тест пропускается.
+*/
+func callEmptyPostgresTestDbFabric(t *testing.T) (innerDb *sql.DB) {
+	const dropSchema = `
+	DROP TABLE IF EXISTS tasks, exprs, sessions, users, schema_migrations;
+	DROP SEQUENCE IF EXISTS expr_ids;
+	`
+	var ok bool
+	if innerDb, ok = GetTestPostgresServer(); !ok {
+		t.Skip("TEST_POSTGRES_DSN не задана")
+	}
+	t.Cleanup(func() {
+		innerDb.Close()
+	})
+	if _, err := innerDb.ExecContext(context.TODO(), dropSchema); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	var (
+		ctx     = context.TODO()
+		innerDb = callLegacyTestDbFabric(t)
+	)
+	applied, err := migrate(ctx, innerDb, sqliteDialect)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, applied, len(migrations))
+	var (
+		reason string
+		source string
+		result float64
+	)
+	err = innerDb.QueryRowContext(ctx, `SELECT _result, reason, source FROM exprs WHERE exprId=1`).Scan(&result,
+		&reason, &source)
+	if assert.NoError(t, err) {
+		assert.Equal(t, float64(4), result)
+		assert.Empty(t, reason)
+		assert.Empty(t, source)
+	}
+	applied, err = migrate(ctx, innerDb, sqliteDialect)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+	statuses, err := getMigrationsStatus(ctx, innerDb, sqliteDialect)
+	if assert.NoError(t, err) {
+		for _, status := range statuses {
+			assert.False(t, status.appliedAt.IsZero(), "миграция %d", status.version)
+		}
+	}
+	assert.NoError(t, checkMigrations(ctx, innerDb, sqliteDialect))
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	var (
+		ctx     = context.TODO()
+		innerDb = callLegacyTestDbFabric(t)
+		out     bytes.Buffer
+	)
+	t.Run("StatusBeforeUp", func(t *testing.T) {
+		out.Reset()
+		assert.NoError(t, runMigrateCommand(ctx, innerDb, sqliteDialect, []string{"status"}, &out))
+		assert.Equal(t, len(migrations), bytes.Count(out.Bytes(), []byte("не применена")))
+		assert.Error(t, checkMigrations(ctx, innerDb, sqliteDialect))
+	})
+	t.Run("Up", func(t *testing.T) {
+		out.Reset()
+		assert.NoError(t, runMigrateCommand(ctx, innerDb, sqliteDialect, []string{"up"}, &out))
+		assert.Equal(t, len(migrations), bytes.Count(out.Bytes(), []byte("применена миграция")))
+		out.Reset()
+		assert.NoError(t, runMigrateCommand(ctx, innerDb, sqliteDialect, []string{"up"}, &out))
+		assert.Equal(t, "все миграции уже применены\n", out.String())
+	})
+	t.Run("StatusAfterUp", func(t *testing.T) {
+		out.Reset()
+		assert.NoError(t, runMigrateCommand(ctx, innerDb, sqliteDialect, []string{"status"}, &out))
+		assert.NotContains(t, out.String(), "не применена")
+	})
+	t.Run("WrongArgs", func(t *testing.T) {
+		assert.Error(t, runMigrateCommand(ctx, innerDb, sqliteDialect, []string{"down"}, &out))
+		assert.Error(t, runMigrateCommand(ctx, innerDb, sqliteDialect, nil, &out))
+	})
+}
+
+func TestCallDbFabricAutoMigrate(t *testing.T) {
+	var ctx = context.TODO()
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv("DB_DSN", filepath.Join(t.TempDir(), "calc.db"))
+		var (
+			d   = callDbFabric(false)
+			out bytes.Buffer
+		)
+		defer d.Close()
+		assert.Error(t, checkMigrations(ctx, d.innerDb, d.dialect))
+		assert.NoError(t, runMigrateCommand(ctx, d.innerDb, d.dialect, []string{"status"}, &out))
+		var tablesCount int
+		assert.NoError(t, d.innerDb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table'").Scan(
+			&tablesCount))
+		assert.Zero(t, tablesCount) // ни проверка, ни migrate status схему не создают.
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		t.Setenv("DB_DSN", filepath.Join(t.TempDir(), "calc.db"))
+		var d = CallDbFabric()
+		defer d.Close()
+		assert.NoError(t, checkMigrations(ctx, d.innerDb, d.dialect))
+	})
+}
+
+func TestMigratePostgres(t *testing.T) {
+	var (
+		ctx     = context.TODO()
+		innerDb = callEmptyPostgresTestDbFabric(t)
+	)
+	assert.Error(t, checkMigrations(ctx, innerDb, postgresDialect))
+	applied, err := migrate(ctx, innerDb, postgresDialect)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, applied, len(migrations))
+	applied, err = migrate(ctx, innerDb, postgresDialect)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+	assert.NoError(t, checkMigrations(ctx, innerDb, postgresDialect))
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
 	"iter"
 	"maps"
 	"slices"
 	"sync"
+	"time"
 )
 
 type JwtTokenJsonWrapper struct {
@@ -17,8 +20,18 @@ func (j *JwtTokenJsonWrapper) Marshal() (result []byte, err error) {
 	return json.Marshal(j)
 }
 
+// UserIdJson -- ответ на успешную регистрацию.
+type UserIdJson struct {
+	Id int64 `json:"id"`
+}
+
+func (u *UserIdJson) Marshal() (result []byte, err error) {
+	return json.Marshal(u)
+}
+
 type CommonExpressionsList interface {
-	AddExprFabric(fromUserId int64, postfix []string) (newExpr backend.CommonExpression, newExprId int)
+	AddExprFabric(exprId int, fromUserId int64, source string, tree ast.Node) (newExpr backend.CommonExpression)
+	RestoreExpr(stored StoredExpr, tree ast.Node) (expr backend.CommonExpression)
 	Get(exprId int) (backend.CommonExpression, bool)
 	GetAll() []backend.CommonExpression
 	GetOwned(userOwnerId int64, exprId int) (backend.CommonExpression, bool)
@@ -38,29 +51,39 @@ type ExpressionsList struct {
 		выполняющиеся выражения. Все посчитанные выражения отправляются в БД.
 	*/
 	exprsOwners map[int64][]*backend.Expression
-	/*
-		idForNewExpr используется для нумерации выражений (generateId) согласно последнему выполненному выражению в БД.
-	*/
-	idForNewExpr int
 }
 
-func (e *ExpressionsList) AddExprFabric(fromUserId int64, postfix []string) (newExpr backend.CommonExpression,
-	newExprId int) {
-	newExprId = e.generateId()
+/*
+AddExprFabric разбивает на Task-и новое выражение и добавляет его в список. exprId выдаётся БД (ReserveExprId).
+*/
+func (e *ExpressionsList) AddExprFabric(exprId int, fromUserId int64, source string, tree ast.Node) (
+	newExpr backend.CommonExpression) {
 	newTaskSpace := backend.CallTasksHandlerFabric()
-	newExpr = backend.CallExpressionFabric(postfix, newExprId, fromUserId, backend.Ready, newTaskSpace)
+	newExpr = backend.CallExpressionFabric(tree, source, exprId, fromUserId, backend.Ready, newTaskSpace)
 	newExpr.DivideIntoTasks()
 	toAdd := newExpr.(*backend.Expression)
 	e.mut.Lock()
-	e.exprs[newExprId] = toAdd
+	e.exprs[exprId] = toAdd
 	e.exprsOwners[fromUserId] = append(e.exprsOwners[fromUserId], toAdd)
-	e.idForNewExpr++
 	e.mut.Unlock()
 	return
 }
 
-func (e *ExpressionsList) generateId() (id int) {
-	return e.idForNewExpr
+/*
+RestoreExpr заново разбивает на Task-и выражение, сохранённое в БД до перезапуска оркестратора, и отмечает уже
+посчитанные Task-и. Id выражения не меняется.
+*/
+func (e *ExpressionsList) RestoreExpr(stored StoredExpr, tree ast.Node) (expr backend.CommonExpression) {
+	expr = backend.CallExpressionFabric(tree, stored.Source, stored.Id, stored.OwnerId, backend.Ready,
+		backend.CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	expr.Restore(stored.CalculatedTasks, stored.Timestamps)
+	toAdd := expr.(*backend.Expression)
+	e.mut.Lock()
+	e.exprs[stored.Id] = toAdd
+	e.exprsOwners[stored.OwnerId] = append(e.exprsOwners[stored.OwnerId], toAdd)
+	e.mut.Unlock()
+	return
 }
 
 /*
@@ -146,7 +169,13 @@ func (e *ExpressionsList) GetReadyExpr() (expr backend.CommonExpression) {
 func (e *ExpressionsList) Remove(expr backend.CommonExpression) {
 	e.mut.Lock()
 	defer e.mut.Unlock()
-	delete(e.exprsOwners, expr.GetOwnerId())
+	var ownerId = expr.GetOwnerId()
+	e.exprsOwners[ownerId] = slices.DeleteFunc(e.exprsOwners[ownerId], func(ownedExpr *backend.Expression) bool {
+		return ownedExpr.GetId() == expr.GetId()
+	})
+	if len(e.exprsOwners[ownerId]) == 0 {
+		delete(e.exprsOwners, ownerId)
+	}
 	delete(e.exprs, expr.GetId())
 }
 
@@ -158,13 +187,20 @@ func CallEmptyExpressionListFabric() *ExpressionsList {
 	}
 }
 
-func CallExpressionListWithLastIdFabric(lastId int) *ExpressionsList {
-	return &ExpressionsList{
-		mut:          sync.Mutex{},
-		exprs:        make(map[int]*backend.Expression),
-		exprsOwners:  make(map[int64][]*backend.Expression),
-		idForNewExpr: lastId,
-	}
+// StoredExpr -- выполняющееся выражение в том виде, в котором оно хранится в БД.
+type StoredExpr struct {
+	Id      int
+	OwnerId int64
+	Tree    string // каноническая запись дерева выражения (ast.Format).
+	Source  string
+	/*
+		Timestamps содержит моменты приёма и начала вычисления выражения, FinishedAt всегда нулевой.
+	*/
+	Timestamps backend.ExprTimestamps
+	/*
+		CalculatedTasks отображает pairId уже посчитанных Task-ов в их результаты.
+	*/
+	CalculatedTasks map[int32]float64
 }
 
 type RequestJson struct {
@@ -176,3 +212,70 @@ func (r RequestJson) Marshal() (result []byte, err error) {
 	result, err = json.Marshal(&r)
 	return
 }
+
+/*
+ExpressionsRequestJson -- запрос списка выражений. Все поля, кроме Token, необязательны: по умолчанию возвращаются
+первые defaultExprsLimit выражений по возрастанию id.
+*/
+type ExpressionsRequestJson struct {
+	JwtTokenJsonWrapper
+	Limit         int                  `json:"limit,omitempty"`
+	Cursor        string               `json:"cursor,omitempty"`
+	Statuses      []backend.ExprStatus `json:"status,omitempty"`
+	SubmittedFrom *time.Time           `json:"submittedFrom,omitempty"`
+	SubmittedTo   *time.Time           `json:"submittedTo,omitempty"`
+	Sort          ExprsSort            `json:"sort,omitempty"`
+	Order         string               `json:"order,omitempty"`
+}
+
+func (e *ExpressionsRequestJson) Marshal() (result []byte, err error) {
+	return json.Marshal(e)
+}
+
+// ToFilter проверяет параметры запроса и собирает из них ExprsFilter.
+func (e *ExpressionsRequestJson) ToFilter() (filter ExprsFilter, err error) {
+	var knownStatuses = []backend.ExprStatus{backend.Ready, backend.NoReadyTasks, backend.Completed,
+		backend.Cancelled, backend.Failed}
+	switch {
+	case e.Limit == 0:
+		filter.Limit = defaultExprsLimit
+	case e.Limit > 0 && e.Limit <= maxExprsLimit:
+		filter.Limit = e.Limit
+	default:
+		return filter, fmt.Errorf("limit должен быть от 1 до %d", maxExprsLimit)
+	}
+	for _, status := range e.Statuses {
+		if !slices.Contains(knownStatuses, status) {
+			return filter, fmt.Errorf("неизвестный статус \"%s\"", status)
+		}
+	}
+	filter.Statuses = e.Statuses
+	if e.SubmittedFrom != nil {
+		filter.SubmittedFrom = *e.SubmittedFrom
+	}
+	if e.SubmittedTo != nil {
+		filter.SubmittedTo = *e.SubmittedTo
+	}
+	switch e.Sort {
+	case "", SortById, SortByFinishedAt:
+		filter.SortBy = e.Sort
+	default:
+		return filter, fmt.Errorf("неизвестная сортировка \"%s\", используйте %s или %s", e.Sort, SortById,
+			SortByFinishedAt)
+	}
+	switch e.Order {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, fmt.Errorf("неизвестный порядок \"%s\", используйте asc или desc", e.Order)
+	}
+	if e.Cursor != "" {
+		var cursor ExprsCursor
+		if cursor, err = filter.parseCursor(e.Cursor); err != nil {
+			return
+		}
+		filter.After = &cursor
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+Session -- сессия входа пользователя. Сессия создаётся при входе и хранит хеш текущего токена обновления; токены
+доступа, выпущенные для сессии, содержат её id (claim sid) и перестают приниматься, как только сессия отозвана.
+*/
+type Session struct {
+	Id        int64
+	UserId    int64
+	Login     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+// IsActive сообщает, что по сессии ещё можно обновлять токены.
+func (s Session) IsActive(now time.Time) bool {
+	return s.RevokedAt.IsZero() && now.Before(s.ExpiresAt)
+}
+
+// RefreshTokenJson -- тело запросов /api/v1/refresh и /api/v1/logout.
+type RefreshTokenJson struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// TokensJson -- ответ на вход и обновление токенов.
+type TokensJson struct {
+	JwtTokenJsonWrapper
+	RefreshToken string `json:"refreshToken"`
+}
+
+func (t *TokensJson) Marshal() (result []byte, err error) {
+	return json.Marshal(t)
+}
+
+/*
+generateRefreshToken создаёт случайный токен обновления. В БД хранится только hash: по нему нельзя восстановить
+токен, а высокая энтропия токена делает медленное хеширование (как у паролей) ненужным.
+*/
+func generateRefreshToken() (token string, hash string) {
+	var buf = make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Panic(err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashRefreshToken(token)
+}
+
+func hashRefreshToken(token string) string {
+	var sum = sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetDefaultRefreshTtl читает время жизни токена обновления (JWT_REFRESH_TTL, по умолчанию 720h).
+func GetDefaultRefreshTtl() (ttl time.Duration, err error) {
+	if ttl, err = parseDurationEnv("JWT_REFRESH_TTL", "720h"); err == nil && ttl <= 0 {
+		err = fmt.Errorf("JWT_REFRESH_TTL должен быть положительным, получено %s", ttl)
+	}
+	return
+}
+
+// refreshTtl -- время жизни токена обновления. Оркестратор задаёт его при запуске через configureAccounts.
+var refreshTtl = 720 * time.Hour
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+// requestTokens отправляет body на target и читает TokensJson из ответа со статусом 200.
+func requestTokens(t *testing.T, target string, body string) (tokens TokensJson) {
+	t.Helper()
+	w := serveWithBody(http.MethodPost, target, body)
+	if assert.Equal(t, http.StatusOK, w.Code, w.Body.String()) {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+		assert.NotEmpty(t, tokens.Token)
+		assert.NotEmpty(t, tokens.RefreshToken)
+	}
+	return
+}
+
+// getExpressionsCode отправляет GET /api/v2/expressions с токеном доступа accessToken и возвращает статус ответа.
+func getExpressionsCode(accessToken string) int {
+	return serveWithBearer(http.MethodGet, "/api/v2/expressions", accessToken, "").Code
+}
+
+func TestSessions(t *testing.T) {
+	t.Cleanup(func() {
+		db = callStubDbWithRegisteredUserFabric(testUser)
+	})
+	db = CallMemoryDbFabric()
+	assert.Equal(t, http.StatusCreated, serveWithBody(http.MethodPost, "/api/v1/register",
+		`{"login": "session", "password": "qwerty"}`).Code)
+	var (
+		login  = requestTokens(t, "/api/v1/login", `{"login": "session", "password": "qwerty"}`)
+		second = requestTokens(t, "/api/v2/login", `{"login": "session", "password": "qwerty"}`)
+	)
+	assert.Equal(t, http.StatusOK, getExpressionsCode(login.Token))
+
+	refreshed := requestTokens(t, "/api/v1/refresh", `{"refreshToken": "`+login.RefreshToken+`"}`)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, http.StatusOK, getExpressionsCode(refreshed.Token))
+	t.Run("RotatedRefreshToken", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v2/refresh", `{"refreshToken": "`+
+			login.RefreshToken+`"}`), http.StatusUnauthorized, ErrorUnauthorized)
+	})
+	t.Run("Logout", func(t *testing.T) {
+		w := serveWithBody(http.MethodPost, "/api/v2/logout", `{"refreshToken": "`+refreshed.RefreshToken+`"}`)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(login.Token))
+		assert.Equal(t, http.StatusUnauthorized, getExpressionsCode(refreshed.Token))
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/refresh", `{"refreshToken": "`+
+			refreshed.RefreshToken+`"}`), http.StatusUnauthorized, ErrorUnauthorized)
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/logout", `{"refreshToken": "`+
+			refreshed.RefreshToken+`"}`), http.StatusUnauthorized, ErrorUnauthorized)
+	})
+	t.Run("OtherSessionAlive", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, getExpressionsCode(second.Token))
+		requestTokens(t, "/api/v2/refresh", `{"refreshToken": "`+second.RefreshToken+`"}`)
+	})
+	t.Run("BadRequest", func(t *testing.T) {
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/refresh", "{"), http.StatusBadRequest,
+			ErrorBadJson)
+		assertErrorJson(t, serveWithBody(http.MethodGet, "/api/v1/logout", ""), http.StatusNotFound, ErrorNotFound)
+		assertErrorJson(t, serveWithBody(http.MethodPost, "/api/v1/refresh", `{"refreshToken": "unknown"}`),
+			http.StatusUnauthorized, ErrorUnauthorized)
+	})
+}
@@ -3,51 +3,188 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type DbWrapper interface {
 	InsertUser(user backend.UserWithHashedPassword) (lastId int64, err error)
 	InsertExpr(expr backend.CommonExpression) (err error)
+	InsertTask(result backend.GrpcResult) (err error)
+	DeleteTasks(exprId int) (err error)
+	SelectRunningExprs() (exprs []StoredExpr, err error)
 	SelectUser(login string) (user backend.UserWithHashedPassword, err error)
-	SelectAllExprs(userOwnerId int64) (exprs []backend.ShortExpression, err error)
+	/*
+		UpdatePassword заменяет хеш пароля пользователя. Если пользователя нет, возвращается sql.ErrNoRows.
+	*/
+	UpdatePassword(userId int64, hashedPassword string) (err error)
+	/*
+		DeleteUser удаляет пользователя вместе с его выражениями, их Task-ами и сессиями. Если пользователя нет,
+		возвращается sql.ErrNoRows.
+	*/
+	DeleteUser(userId int64) (err error)
+	/*
+		SelectAllExprs возвращает выражения пользователя, подходящие под filter, в заданном им порядке.
+	*/
+	SelectAllExprs(userOwnerId int64, filter ExprsFilter) (exprs []backend.ShortExpression, err error)
 	SelectExpr(userOwnerId int64, exprId int) (expr backend.ShortExpression, err error)
+	InsertSession(userId int64, refreshHash string, createdAt time.Time, expiresAt time.Time) (sessionId int64,
+		err error)
+	SelectSession(sessionId int64) (session Session, err error)
+	/*
+		RotateSession заменяет у активной сессии хеш токена обновления oldHash на newHash и продлевает её до expiresAt.
+		Если активной сессии с oldHash нет, возвращается sql.ErrNoRows.
+	*/
+	RotateSession(oldHash string, newHash string, now time.Time, expiresAt time.Time) (session Session, err error)
+	/*
+		RevokeSession отзывает сессию с токеном обновления refreshHash. Если неотозванной сессии с таким токеном нет,
+		возвращается sql.ErrNoRows.
+	*/
+	RevokeSession(refreshHash string, now time.Time) (err error)
+	// RevokeUserSessions отзывает все сессии пользователя.
+	RevokeUserSessions(userId int64, now time.Time) (err error)
+	// SelectUserSessions возвращает активные на момент now сессии пользователя по возрастанию id.
+	SelectUserSessions(userId int64, now time.Time) (sessions []Session, err error)
+	// SelectAccount возвращает роль и состояние пользователя. Если пользователя нет, возвращается sql.ErrNoRows.
+	SelectAccount(userId int64) (account Account, err error)
+	// SelectAccounts возвращает всех пользователей по возрастанию id.
+	SelectAccounts() (accounts []Account, err error)
+	// UpdateRole меняет роль пользователя. Если пользователя нет, возвращается sql.ErrNoRows.
+	UpdateRole(userId int64, role Role) (err error)
+	/*
+		UpdateDisabledAt отключает пользователя с момента disabledAt, а нулевой disabledAt снова включает его. Если
+		пользователя нет, возвращается sql.ErrNoRows.
+	*/
+	UpdateDisabledAt(userId int64, disabledAt time.Time) (err error)
 	Flush() (err error)
-	GetLastExprId() (int, error)
+	ReserveExprId() (int, error)
 	Close() (err error)
 }
 
 type Db struct {
 	ctx     context.Context
 	innerDb *sql.DB
+	dialect sqlDialect
+	/*
+		replicaId -- имя реплики оркестратора. Выражения помечаются репликой, которая их выполняет, чтобы после
+		перезапуска реплика не забрала выражения, которые выполняют другие реплики.
+	*/
+	replicaId string
 }
 
 func (d *Db) InsertUser(user backend.UserWithHashedPassword) (lastId int64, err error) {
 	var (
 		query = `
-	INSERT INTO users (login, password) values ($1, $2)
+	INSERT INTO users (login, password) values ($1, $2) RETURNING id
 	`
-		result sql.Result
 	)
-	result, err = d.innerDb.ExecContext(d.ctx, query, user.GetLogin(), user.GetHashedPassword())
+	err = d.innerDb.QueryRowContext(d.ctx, query, user.GetLogin(), user.GetHashedPassword()).Scan(&lastId)
+	if err != nil && d.dialect.isUniqueViolation(err) {
+		return 0, backend.LoginAlreadyExists{Login: user.GetLogin()}
+	}
+	return
+}
+
+func (d *Db) InsertExpr(expr backend.CommonExpression) (err error) {
+	var (
+		query = `
+	INSERT INTO exprs (exprId, ownerId, status, _result, reason, tree, source, submittedAt, startedAt, finishedAt,
+		duration, replica) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	ON CONFLICT (exprId) DO UPDATE SET status=excluded.status, _result=excluded._result, reason=excluded.reason,
+		startedAt=excluded.startedAt, finishedAt=excluded.finishedAt, duration=excluded.duration
+	WHERE exprs.status NOT IN ($13, $14, $15)
+	`
+		timestamps = expr.GetTimestamps()
+	)
+	_, err = d.innerDb.ExecContext(d.ctx, query, expr.GetId(), expr.GetOwnerId(), expr.GetStatus(), expr.GetResult(),
+		expr.GetReason(), ast.Format(expr.GetTree()), expr.GetSource(), timeToDb(timestamps.SubmittedAt),
+		timeToDb(timestamps.StartedAt), timeToDb(timestamps.FinishedAt), timestamps.GetDuration(), d.replicaId,
+		backend.Completed, backend.Cancelled, backend.Failed)
 	if err != nil {
 		return
 	}
-	lastId, err = result.LastInsertId()
 	return
 }
 
-func (d *Db) InsertExpr(expr backend.CommonExpression) (err error) {
+// InsertTask сохраняет результат посчитанного Task-а выполняющегося выражения.
+func (d *Db) InsertTask(result backend.GrpcResult) (err error) {
+	var (
+		query = `
+	INSERT INTO tasks (pairId, exprId, _result) values ($1, $2, $3)
+	ON CONFLICT (pairId) DO UPDATE SET exprId=excluded.exprId, _result=excluded._result
+	`
+		exprId, _ = pkg.Unpair(int(result.GetPairId()))
+	)
+	_, err = d.innerDb.ExecContext(d.ctx, query, result.GetPairId(), exprId, result.GetResult())
+	return
+}
+
+func (d *Db) DeleteTasks(exprId int) (err error) {
 	var (
 		query = `
-	INSERT INTO exprs (exprId, ownerId, status, _result) values ($1, $2, $3, $4)
+	DELETE FROM tasks WHERE exprId=$1
 	`
 	)
-	_, err = d.innerDb.ExecContext(d.ctx, query, expr.GetId(), expr.GetOwnerId(), expr.GetStatus(), expr.GetResult())
+	_, err = d.innerDb.ExecContext(d.ctx, query, exprId)
+	return
+}
+
+/*
+SelectRunningExprs возвращает незавершённые выражения этой реплики вместе с результатами уже посчитанных Task-ов.
+*/
+func (d *Db) SelectRunningExprs() (exprs []StoredExpr, err error) {
+	var (
+		exprsQuery = `
+	SELECT exprId, ownerId, tree, source, submittedAt, startedAt FROM exprs
+	WHERE status NOT IN ($1, $2, $3) AND replica=$4 ORDER BY exprId
+	`
+		tasksQuery = `
+	SELECT pairId, _result FROM tasks WHERE exprId=$1
+	`
+		rows *sql.Rows
+	)
+	rows, err = d.innerDb.QueryContext(d.ctx, exprsQuery, backend.Completed, backend.Cancelled, backend.Failed,
+		d.replicaId)
 	if err != nil {
 		return
 	}
+	for rows.Next() {
+		var (
+			expr                   = StoredExpr{CalculatedTasks: make(map[int32]float64)}
+			submittedAt, startedAt int64
+		)
+		if err = rows.Scan(&expr.Id, &expr.OwnerId, &expr.Tree, &expr.Source, &submittedAt, &startedAt); err != nil {
+			rows.Close()
+			return
+		}
+		expr.Timestamps = backend.ExprTimestamps{SubmittedAt: timeFromDb(submittedAt), StartedAt: timeFromDb(startedAt)}
+		exprs = append(exprs, expr)
+	}
+	rows.Close()
+	for _, expr := range exprs {
+		if rows, err = d.innerDb.QueryContext(d.ctx, tasksQuery, expr.Id); err != nil {
+			return
+		}
+		for rows.Next() {
+			var (
+				pairId int32
+				result float64
+			)
+			if err = rows.Scan(&pairId, &result); err != nil {
+				rows.Close()
+				return
+			}
+			expr.CalculatedTasks[pairId] = result
+		}
+		rows.Close()
+	}
 	return
 }
 
@@ -65,59 +202,335 @@ func (d *Db) SelectUser(login string) (resultedUser backend.UserWithHashedPasswo
 	return
 }
 
-func (d *Db) SelectAllExprs(userOwnerId int64) (exprs []backend.ShortExpression, err error) {
+func (d *Db) UpdatePassword(userId int64, hashedPassword string) (err error) {
 	var (
 		query = `
-	SELECT exprId, status, _result FROM exprs WHERE ownerId=$1 
+	UPDATE users SET password=$1 WHERE id=$2
+	`
+		result sql.Result
+	)
+	if result, err = d.innerDb.ExecContext(d.ctx, query, hashedPassword, userId); err != nil {
+		return
+	}
+	return noRowsIfNotAffected(result)
+}
+
+func (d *Db) DeleteUser(userId int64) (err error) {
+	var (
+		queries = []string{`
+	DELETE FROM tasks WHERE exprId IN (SELECT exprId FROM exprs WHERE ownerId=$1)
+	`, `
+	DELETE FROM exprs WHERE ownerId=$1
+	`, `
+	DELETE FROM sessions WHERE userId=$1
+	`}
+		deleteUserQuery = `
+	DELETE FROM users WHERE id=$1
 	`
+		tx     *sql.Tx
+		result sql.Result
+	)
+	if tx, err = d.innerDb.BeginTx(d.ctx, nil); err != nil {
+		return
+	}
+	for _, query := range queries {
+		if _, err = tx.ExecContext(d.ctx, query, userId); err != nil {
+			return errors.Join(err, tx.Rollback())
+		}
+	}
+	if result, err = tx.ExecContext(d.ctx, deleteUserQuery, userId); err == nil {
+		err = noRowsIfNotAffected(result)
+	}
+	if err != nil {
+		return errors.Join(err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
+func (d *Db) SelectAllExprs(userOwnerId int64, filter ExprsFilter) (exprs []backend.ShortExpression, err error) {
+	var (
+		query = `
+	SELECT exprId, status, _result, reason, source, submittedAt, startedAt, finishedAt FROM exprs WHERE ownerId=$1
+	`
+		args = []any{userOwnerId}
 		rows *sql.Rows
 	)
-	rows, err = d.innerDb.QueryContext(d.ctx, query, userOwnerId)
+	query, args = exprsFilterToSql(filter, query, args)
+	rows, err = d.innerDb.QueryContext(d.ctx, query, args...)
+	if err != nil {
+		return
+	}
 	defer rows.Close()
 	for rows.Next() {
 		var (
 			expr   *backend.Expression
 			id     int
 			status backend.ExprStatus
-			result int64
+			result float64
+			reason string
+			source string
+			times  [3]int64
 		)
-		if err = rows.Scan(&id, &status, &result); err != nil {
+		if err = rows.Scan(&id, &status, &result, &reason, &source, &times[0], &times[1], &times[2]); err != nil {
 			return
 		}
-		expr = backend.CallShortExpressionFabric(id, userOwnerId, status, result)
+		expr = backend.CallShortExpressionFabric(id, userOwnerId, status, result, reason, source,
+			timestampsFromDb(times))
 		exprs = append(exprs, expr)
 	}
-	return
+	return exprs, rows.Err()
+}
+
+/*
+exprsFilterToSql дописывает к запросу выражений (query с параметрами args, оканчивающемуся условием WHERE) условия,
+порядок и ограничение количества из filter.
+*/
+func exprsFilterToSql(filter ExprsFilter, query string, args []any) (string, []any) {
+	var (
+		builder = strings.Builder{}
+		arg     = func(value any) string {
+			args = append(args, value)
+			return "$" + strconv.Itoa(len(args))
+		}
+		order = "ASC"
+		sign  = ">"
+	)
+	if filter.Desc {
+		order, sign = "DESC", "<"
+	}
+	builder.WriteString(strings.TrimRight(query, "\n\t "))
+	if len(filter.Statuses) != 0 {
+		var placeholders []string
+		for _, status := range filter.Statuses {
+			placeholders = append(placeholders, arg(status))
+		}
+		builder.WriteString(" AND status IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+	if !filter.SubmittedFrom.IsZero() {
+		builder.WriteString(" AND submittedAt >= " + arg(timeToDb(filter.SubmittedFrom)))
+	}
+	if !filter.SubmittedTo.IsZero() {
+		builder.WriteString(" AND submittedAt < " + arg(timeToDb(filter.SubmittedTo)))
+	}
+	if filter.SortBy == SortByFinishedAt {
+		if filter.After != nil {
+			builder.WriteString(fmt.Sprintf(" AND (finishedAt, exprId) %s (%s, %s)", sign,
+				arg(timeToDb(filter.After.FinishedAt)), arg(filter.After.Id)))
+		}
+		builder.WriteString(fmt.Sprintf(" ORDER BY finishedAt %s, exprId %s", order, order))
+	} else {
+		if filter.After != nil {
+			builder.WriteString(fmt.Sprintf(" AND exprId %s %s", sign, arg(filter.After.Id)))
+		}
+		builder.WriteString(" ORDER BY exprId " + order)
+	}
+	if filter.Limit > 0 {
+		builder.WriteString(" LIMIT " + arg(filter.Limit))
+	}
+	return builder.String(), args
 }
 
 func (d *Db) SelectExpr(userOwnerId int64, exprId int) (expr backend.ShortExpression, err error) {
 	var (
 		query = `
-	SELECT status, _result FROM exprs WHERE ownerId=$1 AND exprId=$2 
+	SELECT status, _result, reason, source, submittedAt, startedAt, finishedAt FROM exprs WHERE ownerId=$1 AND exprId=$2
 	`
 		status backend.ExprStatus
-		result int64
+		result float64
+		reason string
+		source string
+		times  [3]int64
+	)
+	err = d.innerDb.QueryRowContext(d.ctx, query, userOwnerId, exprId).Scan(&status, &result, &reason, &source,
+		&times[0], &times[1], &times[2])
+	expr = backend.CallShortExpressionFabric(exprId, userOwnerId, status, result, reason, source,
+		timestampsFromDb(times))
+	return
+}
+
+func (d *Db) InsertSession(userId int64, refreshHash string, createdAt time.Time, expiresAt time.Time) (
+	sessionId int64, err error) {
+	var (
+		query = `
+	INSERT INTO sessions (userId, refreshHash, createdAt, expiresAt) values ($1, $2, $3, $4) RETURNING id
+	`
+	)
+	err = d.innerDb.QueryRowContext(d.ctx, query, userId, refreshHash, timeToDb(createdAt),
+		timeToDb(expiresAt)).Scan(&sessionId)
+	return
+}
+
+func (d *Db) SelectSession(sessionId int64) (session Session, err error) {
+	var (
+		query = `
+	SELECT sessions.id, userId, login, createdAt, expiresAt, revokedAt FROM sessions
+	JOIN users ON users.id = sessions.userId WHERE sessions.id=$1
+	`
+	)
+	err = scanSession(d.innerDb.QueryRowContext(d.ctx, query, sessionId), &session)
+	return
+}
+
+func (d *Db) RotateSession(oldHash string, newHash string, now time.Time, expiresAt time.Time) (session Session,
+	err error) {
+	var (
+		query = `
+	UPDATE sessions SET refreshHash=$1, expiresAt=$2 WHERE refreshHash=$3 AND revokedAt=0 AND expiresAt>$4
+	RETURNING id, userId, (SELECT login FROM users WHERE users.id = sessions.userId), createdAt, expiresAt, revokedAt
+	`
+	)
+	err = scanSession(d.innerDb.QueryRowContext(d.ctx, query, newHash, timeToDb(expiresAt), oldHash, timeToDb(now)),
+		&session)
+	return
+}
+
+func (d *Db) RevokeSession(refreshHash string, now time.Time) (err error) {
+	var (
+		query = `
+	UPDATE sessions SET revokedAt=$1 WHERE refreshHash=$2 AND revokedAt=0
+	`
+		result sql.Result
+	)
+	if result, err = d.innerDb.ExecContext(d.ctx, query, timeToDb(now), refreshHash); err != nil {
+		return
+	}
+	return noRowsIfNotAffected(result)
+}
+
+func (d *Db) RevokeUserSessions(userId int64, now time.Time) (err error) {
+	var (
+		query = `
+	UPDATE sessions SET revokedAt=$1 WHERE userId=$2 AND revokedAt=0
+	`
+	)
+	_, err = d.innerDb.ExecContext(d.ctx, query, timeToDb(now), userId)
+	return
+}
+
+func (d *Db) SelectUserSessions(userId int64, now time.Time) (sessions []Session, err error) {
+	var (
+		query = `
+	SELECT sessions.id, userId, login, createdAt, expiresAt, revokedAt FROM sessions
+	JOIN users ON users.id = sessions.userId WHERE userId=$1 AND revokedAt=0 AND expiresAt>$2 ORDER BY sessions.id
+	`
+		rows *sql.Rows
+	)
+	if rows, err = d.innerDb.QueryContext(d.ctx, query, userId, timeToDb(now)); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session Session
+		if err = scanSession(rows, &session); err != nil {
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	err = rows.Err()
+	return
+}
+
+func (d *Db) SelectAccount(userId int64) (account Account, err error) {
+	var (
+		query = `
+	SELECT id, login, role, disabledAt FROM users WHERE id=$1
+	`
 	)
-	err = d.innerDb.QueryRowContext(d.ctx, query, userOwnerId, exprId).Scan(&status, &result)
-	expr = backend.CallShortExpressionFabric(exprId, userOwnerId, status, result)
+	err = scanAccount(d.innerDb.QueryRowContext(d.ctx, query, userId), &account)
 	return
 }
 
-func (d *Db) GetLastExprId() (result int, err error) {
+func (d *Db) SelectAccounts() (accounts []Account, err error) {
 	var (
 		query = `
-	SELECT exprId FROM exprs ORDER BY exprId DESC LIMIT 1;
+	SELECT id, login, role, disabledAt FROM users ORDER BY id
 	`
+		rows *sql.Rows
 	)
-	err = d.innerDb.QueryRowContext(d.ctx, query).Scan(&result)
+	if rows, err = d.innerDb.QueryContext(d.ctx, query); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account Account
+		if err = scanAccount(rows, &account); err != nil {
+			return
+		}
+		accounts = append(accounts, account)
+	}
+	err = rows.Err()
+	return
+}
+
+func (d *Db) UpdateRole(userId int64, role Role) (err error) {
+	var (
+		query = `
+	UPDATE users SET role=$1 WHERE id=$2
+	`
+		result sql.Result
+	)
+	if result, err = d.innerDb.ExecContext(d.ctx, query, role, userId); err != nil {
+		return
+	}
+	return noRowsIfNotAffected(result)
+}
+
+func (d *Db) UpdateDisabledAt(userId int64, disabledAt time.Time) (err error) {
+	var (
+		query = `
+	UPDATE users SET disabledAt=$1 WHERE id=$2
+	`
+		result sql.Result
+	)
+	if result, err = d.innerDb.ExecContext(d.ctx, query, timeToDb(disabledAt), userId); err != nil {
+		return
+	}
+	return noRowsIfNotAffected(result)
+}
+
+// noRowsIfNotAffected возвращает sql.ErrNoRows, если запрос не изменил ни одной строки.
+func noRowsIfNotAffected(result sql.Result) (err error) {
+	var count int64
+	if count, err = result.RowsAffected(); err == nil && count == 0 {
+		err = sql.ErrNoRows
+	}
+	return
+}
+
+// scanSession читает строку id, userId, login, createdAt, expiresAt, revokedAt в session.
+func scanSession(row interface{ Scan(dest ...any) error }, session *Session) (err error) {
+	var times [3]int64
+	if err = row.Scan(&session.Id, &session.UserId, &session.Login, &times[0], &times[1], &times[2]); err != nil {
+		return
+	}
+	session.CreatedAt, session.ExpiresAt, session.RevokedAt = timeFromDb(times[0]), timeFromDb(times[1]),
+		timeFromDb(times[2])
+	return
+}
+
+// scanAccount читает строку id, login, role, disabledAt в account.
+func scanAccount(row interface{ Scan(dest ...any) error }, account *Account) (err error) {
+	var disabledAt int64
+	if err = row.Scan(&account.Id, &account.Login, &account.Role, &disabledAt); err != nil {
+		return
+	}
+	account.DisabledAt = timeFromDb(disabledAt)
+	return
+}
+
+// ReserveExprId выдаёт id для нового выражения. Id не повторяются, даже если с БД работают несколько реплик.
+func (d *Db) ReserveExprId() (result int, err error) {
+	err = d.innerDb.QueryRowContext(d.ctx, d.dialect.reserveExprIdQuery).Scan(&result)
 	return
 }
 
 func (d *Db) Flush() (err error) {
 	var (
 		query = `
-	DELETE FROM users;
+	DELETE FROM tasks;
 	DELETE FROM exprs;
+	DELETE FROM sessions;
+	DELETE FROM users;
 	`
 	)
 	_, err = d.innerDb.ExecContext(d.ctx, query)
@@ -129,39 +542,90 @@ func (d *Db) Close() (err error) {
 }
 
 func CallDbFabric() *Db {
+	return callDbFabric(isAutoMigrateEnabled())
+}
+
+/*
+callDbFabric открывает БД, заданную DB_DSN. Если autoMigrate равен false, миграции не применяются, а только
+проверяются.
+*/
+func callDbFabric(autoMigrate bool) *Db {
 	var (
-		innerDb = GetDefaultSqlServer()
-		ctx     = context.TODO()
-		err     error
+		innerDb, dialect = GetDefaultSqlServer()
+		ctx              = context.TODO()
+		err              error
 	)
 	err = innerDb.PingContext(ctx)
 	if err != nil {
 		log.Panic(err)
 	}
-	err = createBaseTables(ctx, innerDb)
-	if err != nil {
-		log.Panic(err)
+	if autoMigrate {
+		var applied []migration
+		applied, err = migrate(ctx, innerDb, dialect)
+		for _, m := range applied {
+			log.Printf("применена миграция %d: %s", m.version, m.description)
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+	} else if err = checkMigrations(ctx, innerDb, dialect); err != nil {
+		log.Println(err)
 	}
-	return &Db{ctx: ctx, innerDb: innerDb}
+	return &Db{ctx: ctx, innerDb: innerDb, dialect: dialect, replicaId: GetDefaultReplicaId()}
 }
 
-func createBaseTables(ctx context.Context, db *sql.DB) (err error) {
-	const usersTable = `
-	CREATE TABLE IF NOT EXISTS users(
-		id INTEGER PRIMARY KEY AUTOINCREMENT, 
-		login TEXT UNIQUE,
-		password TEXT
-	);
-	CREATE TABLE IF NOT EXISTS exprs(
-	    exprId INTEGER PRIMARY KEY,
-	    ownerId INTEGER,
-	    status TEXT,
-		_result INTEGER,
-		FOREIGN KEY (ownerId) REFERENCES users (id)
-	);
-	`
-	if _, err = db.ExecContext(ctx, usersTable); err != nil {
-		return err
+// checkMigrations возвращает ошибку, если в БД применены не все миграции.
+func checkMigrations(ctx context.Context, db *sql.DB, d sqlDialect) (err error) {
+	var statuses []migrationStatus
+	if statuses, err = getMigrationsStatus(ctx, db, d); err != nil {
+		return
+	}
+	for _, status := range statuses {
+		if status.appliedAt.IsZero() {
+			return fmt.Errorf("миграция %d (%s) не применена, выполните migrate up", status.version,
+				status.description)
+		}
 	}
 	return
 }
+
+// addColumnIfNotExists добавляет колонку в таблицу, созданную до появления этой колонки.
+func addColumnIfNotExists(ctx context.Context, db sqlExecutor, d sqlDialect, table string, column string,
+	definition string) (err error) {
+	var count int
+	if err = db.QueryRowContext(ctx, d.hasColumnQuery, table, column).Scan(&count); err != nil || count != 0 {
+		return
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+	return
+}
+
+// sqlExecutor -- общие методы *sql.DB и *sql.Tx, чтобы вспомогательные функции работали и внутри транзакций.
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+/*
+timeToDb переводит момент времени в наносекунды Unix-времени для хранения в БД. Ещё не наступивший (нулевой)
+момент хранится как 0. Длительности хранятся в наносекундах без преобразования.
+*/
+func timeToDb(moment time.Time) int64 {
+	if moment.IsZero() {
+		return 0
+	}
+	return moment.UnixNano()
+}
+
+func timeFromDb(unixNano int64) time.Time {
+	if unixNano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unixNano)
+}
+
+// timestampsFromDb собирает ExprTimestamps из колонок submittedAt, startedAt и finishedAt.
+func timestampsFromDb(times [3]int64) backend.ExprTimestamps {
+	return backend.ExprTimestamps{SubmittedAt: timeFromDb(times[0]), StartedAt: timeFromDb(times[1]),
+		FinishedAt: timeFromDb(times[2])}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/Debianov/calc-ya-go-24/backend"
+	pb "github.com/Debianov/calc-ya-go-24/backend/proto"
+	"github.com/Debianov/calc-ya-go-24/pkg"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+/*
+testDb проверяет одинаковое поведение Db на SQLite и PostgreSQL: innerDb должна быть пустой, миграции применяются
+здесь же.
+*/
+func testDb(t *testing.T, d *Db) {
+	if _, err := migrate(d.ctx, d.innerDb, d.dialect); err != nil {
+		t.Fatal(err)
+	}
+	testDbWrapper(t, d, &Db{ctx: d.ctx, innerDb: d.innerDb, dialect: d.dialect, replicaId: "other"})
+}
+
+/*
+testDbWrapper проверяет поведение, общее для всех DbWrapper. otherReplica -- то же хранилище от имени другой
+реплики оркестратора; nil, если хранилище не разделяется между репликами.
+*/
+func testDbWrapper(t *testing.T, d DbWrapper, otherReplica DbWrapper) {
+	user, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "test", Password: "qwerty"})
+	userId, err := d.InsertUser(user)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = d.InsertUser(user)
+	var alreadyExists backend.LoginAlreadyExists
+	assert.ErrorAs(t, err, &alreadyExists)
+	savedUser, err := d.SelectUser("test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, userId, savedUser.GetId())
+		assert.Equal(t, user.GetHashedPassword(), savedUser.GetHashedPassword())
+	}
+	_, err = d.SelectUser("nobody")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	exprId, err := d.ReserveExprId()
+	assert.NoError(t, err)
+	nextExprId, err := d.ReserveExprId()
+	assert.NoError(t, err)
+	assert.Greater(t, nextExprId, exprId)
+	if otherReplica != nil {
+		otherExprId, err := otherReplica.ReserveExprId()
+		assert.NoError(t, err)
+		assert.NotEqual(t, exprId, otherExprId)
+		assert.NotEqual(t, nextExprId, otherExprId)
+	}
+
+	tree, _ := pkg.Parse("(1+2)*(3+4)")
+	expr := backend.CallExpressionFabric(tree, "(1+2)*(3+4)", exprId, userId, backend.Ready,
+		backend.CallTasksHandlerFabric())
+	expr.DivideIntoTasks()
+	t.Run("Running", func(t *testing.T) {
+		assert.NoError(t, d.InsertExpr(expr))
+		task, err := expr.GetReadyGrpcTask()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &pb.TaskResult{PairId: task.GetPairId(), Result: 3}
+		assert.NoError(t, expr.UpdateTask(result, time.Now()))
+		assert.NoError(t, d.InsertTask(result))
+		stored, err := d.SelectRunningExprs()
+		if assert.NoError(t, err) && assert.Len(t, stored, 1) {
+			assert.Equal(t, exprId, stored[0].Id)
+			assert.Equal(t, "(1+2)*(3+4)", stored[0].Source)
+			assert.Equal(t, map[int32]float64{task.GetPairId(): 3}, stored[0].CalculatedTasks)
+			assert.True(t, expr.GetTimestamps().SubmittedAt.Equal(stored[0].Timestamps.SubmittedAt))
+		}
+		if otherReplica != nil {
+			stored, err = otherReplica.SelectRunningExprs()
+			assert.NoError(t, err)
+			assert.Empty(t, stored)
+		}
+	})
+	t.Run("Finished", func(t *testing.T) {
+		assert.NoError(t, expr.Cancel("отменено пользователем"))
+		assert.NoError(t, d.InsertExpr(expr))
+		assert.NoError(t, d.DeleteTasks(exprId))
+		stored, err := d.SelectRunningExprs()
+		assert.NoError(t, err)
+		assert.Empty(t, stored)
+		savedExpr, err := d.SelectExpr(userId, exprId)
+		if assert.NoError(t, err) {
+			assert.Equal(t, backend.ExprStatus(backend.Cancelled), savedExpr.GetStatus())
+			assert.Equal(t, "отменено пользователем", savedExpr.GetReason())
+			assert.Equal(t, "(1+2)*(3+4)", savedExpr.GetSource())
+			assert.True(t, expr.GetTimestamps().FinishedAt.Equal(savedExpr.GetTimestamps().FinishedAt))
+		}
+		_, err = d.SelectExpr(userId+1, exprId)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		savedExprs, err := d.SelectAllExprs(userId, ExprsFilter{})
+		if assert.NoError(t, err) {
+			assert.Len(t, savedExprs, 1)
+		}
+		savedExprs, err = d.SelectAllExprs(userId+1, ExprsFilter{})
+		assert.NoError(t, err)
+		assert.Empty(t, savedExprs)
+	})
+	t.Run("Filter", func(t *testing.T) {
+		filterUser, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "filter", Password: "qwerty"})
+		ownerId, err := d.InsertUser(filterUser)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var (
+			base  = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+			specs = []struct {
+				status              backend.ExprStatus
+				submitted, finished time.Duration
+			}{{backend.Completed, 0, 50 * time.Second}, {backend.Failed, 10 * time.Second, 20 * time.Second},
+				{backend.Ready, 20 * time.Second, 0}, {backend.Completed, 30 * time.Second, 40 * time.Second}}
+			ids   []int
+			idsOf = func(exprs []backend.ShortExpression) (result []int) {
+				for _, expr := range exprs {
+					result = append(result, expr.GetId())
+				}
+				return
+			}
+		)
+		for _, spec := range specs {
+			id, err := d.ReserveExprId()
+			if !assert.NoError(t, err) {
+				return
+			}
+			var timestamps = backend.ExprTimestamps{SubmittedAt: base.Add(spec.submitted)}
+			if spec.finished != 0 {
+				timestamps.FinishedAt = base.Add(spec.finished)
+			}
+			assert.NoError(t, d.InsertExpr(backend.CallShortExpressionFabric(id, ownerId, spec.status, 0, "", "1",
+				timestamps)))
+			ids = append(ids, id)
+		}
+		var cases = []struct {
+			name     string
+			filter   ExprsFilter
+			expected []int
+		}{
+			{"Status", ExprsFilter{Statuses: []backend.ExprStatus{backend.Completed}}, []int{ids[0], ids[3]}},
+			{"SubmittedRange", ExprsFilter{SubmittedFrom: base.Add(10 * time.Second),
+				SubmittedTo: base.Add(30 * time.Second)}, []int{ids[1], ids[2]}},
+			{"ByFinishedAt", ExprsFilter{SortBy: SortByFinishedAt}, []int{ids[2], ids[1], ids[3], ids[0]}},
+			{"ByFinishedAtDesc", ExprsFilter{SortBy: SortByFinishedAt, Desc: true},
+				[]int{ids[0], ids[3], ids[1], ids[2]}},
+			{"ByFinishedAtPage", ExprsFilter{SortBy: SortByFinishedAt, Limit: 2,
+				After: &ExprsCursor{Id: ids[1], FinishedAt: base.Add(20 * time.Second)}}, []int{ids[3], ids[0]}},
+			{"ByIdDescPage", ExprsFilter{Desc: true, Limit: 2, After: &ExprsCursor{Id: ids[3]}},
+				[]int{ids[2], ids[1]}},
+		}
+		for _, testCase := range cases {
+			t.Run(testCase.name, func(t *testing.T) {
+				exprs, err := d.SelectAllExprs(ownerId, testCase.filter)
+				if assert.NoError(t, err) {
+					assert.Equal(t, testCase.expected, idsOf(exprs))
+				}
+			})
+		}
+	})
+	t.Run("Sessions", func(t *testing.T) {
+		var (
+			now       = time.Now()
+			expiresAt = now.Add(time.Hour)
+		)
+		sessionId, err := d.InsertSession(userId, "hash1", now, expiresAt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		session, err := d.SelectSession(sessionId)
+		if assert.NoError(t, err) {
+			assert.Equal(t, userId, session.UserId)
+			assert.Equal(t, "test", session.Login)
+			assert.True(t, session.IsActive(now))
+			assert.True(t, expiresAt.Equal(session.ExpiresAt))
+		}
+		_, err = d.SelectSession(sessionId + 1)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		session, err = d.RotateSession("hash1", "hash2", now, expiresAt.Add(time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, sessionId, session.Id)
+			assert.Equal(t, "test", session.Login)
+			assert.True(t, expiresAt.Add(time.Hour).Equal(session.ExpiresAt))
+		}
+		_, err = d.RotateSession("hash1", "hash3", now, expiresAt)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = d.RotateSession("hash2", "hash3", expiresAt.Add(2*time.Hour), expiresAt)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		assert.NoError(t, d.RevokeSession("hash2", now))
+		assert.ErrorIs(t, d.RevokeSession("hash2", now), sql.ErrNoRows)
+		session, err = d.SelectSession(sessionId)
+		if assert.NoError(t, err) {
+			assert.False(t, session.RevokedAt.IsZero())
+		}
+		_, err = d.RotateSession("hash2", "hash3", now, expiresAt)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+	t.Run("Account", func(t *testing.T) {
+		accountUser, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "account", Password: "qwerty"})
+		accountId, err := d.InsertUser(accountUser)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var now = time.Now()
+		for _, hash := range []string{"account1", "account2", "account3"} {
+			_, err = d.InsertSession(accountId, hash, now, now.Add(time.Hour))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, d.RevokeSession("account2", now))
+		sessions, err := d.SelectUserSessions(accountId, now)
+		if assert.NoError(t, err) && assert.Len(t, sessions, 2) {
+			assert.Less(t, sessions[0].Id, sessions[1].Id)
+			assert.Equal(t, "account", sessions[0].Login)
+		}
+		sessions, err = d.SelectUserSessions(accountId, now.Add(2*time.Hour))
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		newPassword, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "account", Password: "newPassword"})
+		assert.NoError(t, d.UpdatePassword(accountId, newPassword.GetHashedPassword()))
+		assert.ErrorIs(t, d.UpdatePassword(accountId+100, newPassword.GetHashedPassword()), sql.ErrNoRows)
+		savedUser, err := d.SelectUser("account")
+		if assert.NoError(t, err) {
+			assert.True(t, savedUser.Is(&backend.JsonUser{Login: "account", Password: "newPassword"}))
+		}
+		assert.NoError(t, d.RevokeUserSessions(accountId, now))
+		sessions, err = d.SelectUserSessions(accountId, now)
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		exprId, _ := d.ReserveExprId()
+		tree, _ := pkg.Parse("1+2")
+		accountExpr := backend.CallExpressionFabric(tree, "1+2", exprId, accountId, backend.Ready,
+			backend.CallTasksHandlerFabric())
+		assert.NoError(t, d.InsertExpr(accountExpr))
+		assert.NoError(t, d.DeleteUser(accountId))
+		assert.ErrorIs(t, d.DeleteUser(accountId), sql.ErrNoRows)
+		_, err = d.SelectUser("account")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = d.SelectExpr(accountId, exprId)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		_, err = d.SelectUser("test")
+		assert.NoError(t, err)
+	})
+	t.Run("Roles", func(t *testing.T) {
+		roleUser, _ := backend.WrapIntoDbUser(&backend.JsonUser{Login: "role", Password: "qwerty"})
+		roleId, err := d.InsertUser(roleUser)
+		if !assert.NoError(t, err) {
+			return
+		}
+		account, err := d.SelectAccount(roleId)
+		if assert.NoError(t, err) {
+			assert.Equal(t, Account{Id: roleId, Login: "role", Role: RoleUser}, account)
+		}
+		var now = time.Now()
+		assert.NoError(t, d.UpdateRole(roleId, RoleAdmin))
+		assert.NoError(t, d.UpdateDisabledAt(roleId, now))
+		accounts, err := d.SelectAccounts()
+		if assert.NoError(t, err) && assert.GreaterOrEqual(t, len(accounts), 2) {
+			assert.Equal(t, userId, accounts[0].Id)
+			assert.Equal(t, RoleUser, accounts[0].Role)
+			assert.False(t, accounts[0].IsDisabled())
+			var last = accounts[len(accounts)-1]
+			assert.Equal(t, roleId, last.Id)
+			assert.Equal(t, RoleAdmin, last.Role)
+			assert.True(t, now.Equal(last.DisabledAt))
+		}
+		assert.NoError(t, d.UpdateDisabledAt(roleId, time.Time{}))
+		account, err = d.SelectAccount(roleId)
+		if assert.NoError(t, err) {
+			assert.False(t, account.IsDisabled())
+		}
+
+		assert.ErrorIs(t, d.UpdateRole(roleId+100, RoleAdmin), sql.ErrNoRows)
+		assert.ErrorIs(t, d.UpdateDisabledAt(roleId+100, now), sql.ErrNoRows)
+		assert.NoError(t, d.DeleteUser(roleId))
+		_, err = d.SelectAccount(roleId)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+	assert.NoError(t, d.Flush())
+}
+
+func TestDbSqlite(t *testing.T) {
+	var innerDb = GetTestSqlServer(t.TempDir())
+	t.Cleanup(func() {
+		innerDb.Close()
+	})
+	testDb(t, &Db{ctx: context.TODO(), innerDb: innerDb, dialect: sqliteDialect})
+}
+
+func TestDbPostgres(t *testing.T) {
+	var innerDb = callEmptyPostgresTestDbFabric(t)
+	testDb(t, &Db{ctx: context.TODO(), innerDb: innerDb, dialect: postgresDialect})
+}
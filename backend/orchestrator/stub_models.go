@@ -1,11 +1,15 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Debianov/calc-ya-go-24/backend"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
 	"log"
+	"slices"
+	"time"
 )
 
 type ExpressionsListStub struct {
@@ -14,7 +18,12 @@ type ExpressionsListStub struct {
 	cursor     int
 }
 
-func (s *ExpressionsListStub) AddExprFabric(fromUserId int64, postfix []string) (newExpr backend.CommonExpression, newExprId int) {
+func (s *ExpressionsListStub) AddExprFabric(exprId int, fromUserId int64, source string, tree ast.Node) (newExpr backend.CommonExpression) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *ExpressionsListStub) RestoreExpr(stored StoredExpr, tree ast.Node) (expr backend.CommonExpression) {
 	//TODO implement me
 	panic("implement me")
 }
@@ -84,6 +93,7 @@ callExprsListStubFabric формирует новый ExpressionsListStub, ко
 func callExprsListStubFabric(ownerId int64, expressions ...backend.ExpressionStub) (result *ExpressionsListStub) {
 	newExprsArray := make([]*backend.ExpressionStub, 0)
 	for _, expr := range expressions {
+		expr.OwnerId = ownerId
 		newExprsArray = append(newExprsArray, &expr)
 	}
 	result = &ExpressionsListStub{buf: newExprsArray,
@@ -96,24 +106,56 @@ func callExprsEmptyListFabric() (result *ExpressionsListStub) {
 }
 
 type DbStub struct {
-	lastId int64
-	users  map[string]backend.UserWithHashedPassword
-	exprs  map[int64][]backend.ExpressionStub
+	lastId     int64
+	nextExprId int
+	users      map[string]backend.UserWithHashedPassword
+	exprs      map[int64][]backend.ExpressionStub
+	sessions   memorySessions
+	accounts   memoryAccounts
 }
 
-func (s *DbStub) GetLastExprId() (int, error) {
-	return 0, nil
+func (s *DbStub) ReserveExprId() (result int, err error) {
+	result = s.nextExprId
+	s.nextExprId++
+	return
 }
 
 func (s *DbStub) InsertExpr(expr backend.CommonExpression) (err error) {
+	var (
+		toInsert = backend.ExpressionStub{Id: expr.GetId(), Expression: expr.GetSource(), Status: expr.GetStatus(),
+			Result: expr.GetResult(), Reason: expr.GetReason(), ExprTimestampsJson: expr.GetTimestamps().ToJson()}
+		ownerExprs = s.exprs[expr.GetOwnerId()]
+		ind        = slices.IndexFunc(ownerExprs, func(stored backend.ExpressionStub) bool {
+			return stored.GetId() == expr.GetId()
+		})
+	)
+	if ind == -1 {
+		s.exprs[expr.GetOwnerId()] = append(ownerExprs, toInsert)
+	} else if !ownerExprs[ind].GetStatus().IsFinished() {
+		ownerExprs[ind] = toInsert
+	}
+	return
+}
+
+func (s *DbStub) InsertTask(_ backend.GrpcResult) (err error) {
+	return
+}
+
+func (s *DbStub) DeleteTasks(_ int) (err error) {
+	return
+}
+
+func (s *DbStub) SelectRunningExprs() (exprs []StoredExpr, err error) {
 	//TODO implement me
 	panic("implement me")
 }
 
 func (s *DbStub) InsertUser(user backend.UserWithHashedPassword) (lastId int64, err error) {
+	if _, ok := s.users[user.GetLogin()]; ok {
+		return 0, backend.LoginAlreadyExists{Login: user.GetLogin()}
+	}
 	s.users[user.GetLogin()] = user
-	lastId++
-	return lastId, nil
+	return int64(len(s.users)), nil
 }
 
 func (s *DbStub) SelectUser(login string) (user backend.UserWithHashedPassword, err error) {
@@ -125,12 +167,35 @@ func (s *DbStub) SelectUser(login string) (user backend.UserWithHashedPassword,
 	return v, nil
 }
 
-func (s *DbStub) SelectAllExprs(userOwnerId int64) (exprs []backend.ShortExpression, err error) {
+func (s *DbStub) UpdatePassword(userId int64, hashedPassword string) (err error) {
+	for login, user := range s.users {
+		if user.GetId() == userId {
+			s.users[login] = backend.CallDbUserFabric(userId, login, hashedPassword)
+			return
+		}
+	}
+	return errors.New("элемент не найден")
+}
+
+func (s *DbStub) DeleteUser(userId int64) (err error) {
+	for login, user := range s.users {
+		if user.GetId() == userId {
+			delete(s.users, login)
+			delete(s.exprs, userId)
+			s.sessions.deleteUser(userId)
+			s.accounts.deleteUser(userId)
+			return
+		}
+	}
+	return errors.New("элемент не найден")
+}
+
+func (s *DbStub) SelectAllExprs(userOwnerId int64, filter ExprsFilter) (exprs []backend.ShortExpression, err error) {
 	fromExprs := s.exprs[userOwnerId]
 	for _, v := range fromExprs {
 		exprs = append(exprs, &v)
 	}
-	return
+	return filter.Apply(exprs), nil
 }
 
 func (s *DbStub) SelectExpr(userOwnerId int64, exprId int) (expr backend.ShortExpression, err error) {
@@ -146,6 +211,74 @@ func (s *DbStub) SelectExpr(userOwnerId int64, exprId int) (expr backend.ShortEx
 func (s *DbStub) Flush() (err error) {
 	s.users = make(map[string]backend.UserWithHashedPassword)
 	s.exprs = make(map[int64][]backend.ExpressionStub)
+	s.sessions.flush()
+	s.accounts.flush()
+	return
+}
+
+func (s *DbStub) InsertSession(userId int64, refreshHash string, createdAt time.Time, expiresAt time.Time) (
+	sessionId int64, err error) {
+	for _, user := range s.users {
+		if user.GetId() == userId {
+			return s.sessions.insert(Session{UserId: userId, Login: user.GetLogin(), CreatedAt: createdAt,
+				ExpiresAt: expiresAt}, refreshHash), nil
+		}
+	}
+	return 0, errors.New("элемент не найден")
+}
+
+func (s *DbStub) SelectSession(sessionId int64) (session Session, err error) {
+	return s.sessions.get(sessionId)
+}
+
+func (s *DbStub) RotateSession(oldHash string, newHash string, now time.Time, expiresAt time.Time) (session Session,
+	err error) {
+	return s.sessions.rotate(oldHash, newHash, now, expiresAt)
+}
+
+func (s *DbStub) RevokeSession(refreshHash string, now time.Time) (err error) {
+	return s.sessions.revoke(refreshHash, now)
+}
+
+func (s *DbStub) RevokeUserSessions(userId int64, now time.Time) (err error) {
+	s.sessions.revokeUser(userId, now)
+	return
+}
+
+func (s *DbStub) SelectUserSessions(userId int64, now time.Time) (sessions []Session, err error) {
+	return s.sessions.activeOf(userId, now), nil
+}
+
+func (s *DbStub) SelectAccount(userId int64) (account Account, err error) {
+	for _, user := range s.users {
+		if user.GetId() == userId {
+			return s.accounts.of(user), nil
+		}
+	}
+	return account, errors.New("элемент не найден")
+}
+
+func (s *DbStub) SelectAccounts() (accounts []Account, err error) {
+	for _, user := range s.users {
+		accounts = append(accounts, s.accounts.of(user))
+	}
+	slices.SortFunc(accounts, func(a Account, b Account) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return
+}
+
+func (s *DbStub) UpdateRole(userId int64, role Role) (err error) {
+	if _, err = s.SelectAccount(userId); err == nil {
+		s.accounts.row(userId).role = role
+	}
+	return
+}
+
+func (s *DbStub) UpdateDisabledAt(userId int64, disabledAt time.Time) (err error) {
+	if _, err = s.SelectAccount(userId); err == nil {
+		s.accounts.row(userId).disabledAt = disabledAt
+	}
 	return
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/Debianov/calc-ya-go-24/backend"
@@ -9,18 +10,26 @@ import (
 	"time"
 )
 
-const TodoSecretToDefendEnv = "not_under_deploy_not_under_deploy"
-
-func GenerateJwt(user backend.CommonUser) (token string, err error) {
-	var currentTime = time.Now()
-	var jwtInstance = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"login": user.GetLogin(),
-		"id":    user.GetId(),
-		"nbf":   currentTime.Unix(),
-		"exp":   currentTime.Add(10 * time.Minute).Unix(),
-		"iat":   currentTime.Unix(),
-	})
-	token, err = jwtInstance.SignedString([]byte(TodoSecretToDefendEnv))
+/*
+GenerateJwt выпускает токен доступа user с ролью role (claim role). Если sessionId не 0, токен привязывается к сессии
+(claim sid) и перестаёт приниматься после её отзыва.
+*/
+func GenerateJwt(user backend.CommonUser, role Role, sessionId int64) (token string, err error) {
+	var (
+		currentTime = time.Now()
+		claims      = jwt.MapClaims{
+			"login": user.GetLogin(),
+			"id":    user.GetId(),
+			"role":  string(role),
+			"nbf":   currentTime.Unix(),
+			"exp":   currentTime.Add(jwtKeyring.ttl).Unix(),
+			"iat":   currentTime.Unix(),
+		}
+	)
+	if sessionId != 0 {
+		claims["sid"] = sessionId
+	}
+	token, err = jwtKeyring.Sign(claims)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -28,14 +37,18 @@ func GenerateJwt(user backend.CommonUser) (token string, err error) {
 }
 
 func ParseJwt(token string) (user backend.CommonUser, err error) {
+	user, _, err = ParseJwtWithRole(token)
+	return
+}
+
+/*
+ParseJwtWithRole, как и ParseJwt, проверяет токен и дополнительно возвращает роль из него. У токенов, выпущенных до
+появления ролей, роль RoleUser.
+*/
+func ParseJwtWithRole(token string) (user backend.CommonUser, role Role, err error) {
 	user = &backend.DbUser{}
 	var tokenFromString *jwt.Token
-	tokenFromString, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			panic(fmt.Errorf("метод подписи токена %v не ожидается", token.Header["alg"]))
-		}
-		return []byte(TodoSecretToDefendEnv), nil
-	})
+	tokenFromString, err = jwt.Parse(token, jwtKeyring.keyFunc)
 	if err != nil {
 		return
 	}
@@ -44,7 +57,31 @@ func ParseJwt(token string) (user backend.CommonUser, err error) {
 		err = errors.New("не удалось прочитать структуру токена")
 		return
 	}
+	if sid, ok := claims["sid"].(float64); ok {
+		if err = checkSessionNotRevoked(int64(sid)); err != nil {
+			return
+		}
+	}
 	user.SetLogin(claims["login"].(string))
 	user.SetId(int64(claims["id"].(float64)))
+	role = RoleUser
+	if claimedRole, ok := claims["role"].(string); ok {
+		role = Role(claimedRole)
+	}
+	return
+}
+
+// checkSessionNotRevoked возвращает ошибку, если сессия токена отозвана или её нет в БД.
+func checkSessionNotRevoked(sessionId int64) (err error) {
+	var session Session
+	session, err = db.SelectSession(sessionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("сессия %d не найдена", sessionId)
+	} else if err != nil {
+		log.Panic(err)
+	}
+	if !session.RevokedAt.IsZero() {
+		return fmt.Errorf("сессия %d отозвана", sessionId)
+	}
 	return
 }
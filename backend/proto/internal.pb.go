@@ -60,10 +60,11 @@ func (*Empty) Descriptor() ([]byte, []int) {
 type TaskToSend struct {
 	state               protoimpl.MessageState `protogen:"open.v1"`
 	PairId              int32                  `protobuf:"varint,1,opt,name=PairId,proto3" json:"PairId,omitempty"`
-	Arg1                int64                  `protobuf:"varint,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
-	Arg2                int64                  `protobuf:"varint,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
+	Arg1                float64                `protobuf:"fixed64,7,opt,name=arg1,proto3" json:"arg1,omitempty"`
+	Arg2                float64                `protobuf:"fixed64,8,opt,name=arg2,proto3" json:"arg2,omitempty"`
 	Operation           string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	PermissibleDuration string                 `protobuf:"bytes,5,opt,name=PermissibleDuration,proto3" json:"PermissibleDuration,omitempty"`
+	Args                []float64              `protobuf:"fixed64,6,rep,packed,name=args,proto3" json:"args,omitempty"` // все аргументы, в т.ч. arg1 и arg2. Для min и max -- единственный источник.
 	unknownFields       protoimpl.UnknownFields
 	sizeCache           protoimpl.SizeCache
 }
@@ -105,14 +106,14 @@ func (x *TaskToSend) GetPairId() int32 {
 	return 0
 }
 
-func (x *TaskToSend) GetArg1() int64 {
+func (x *TaskToSend) GetArg1() float64 {
 	if x != nil {
 		return x.Arg1
 	}
 	return 0
 }
 
-func (x *TaskToSend) GetArg2() int64 {
+func (x *TaskToSend) GetArg2() float64 {
 	if x != nil {
 		return x.Arg2
 	}
@@ -133,10 +134,18 @@ func (x *TaskToSend) GetPermissibleDuration() string {
 	return ""
 }
 
+func (x *TaskToSend) GetArgs() []float64 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
 type TaskResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	PairId        int32                  `protobuf:"varint,1,opt,name=PairId,proto3" json:"PairId,omitempty"`
-	Result        int64                  `protobuf:"varint,2,opt,name=result,proto3" json:"result,omitempty"`
+	Result        float64                `protobuf:"fixed64,4,opt,name=result,proto3" json:"result,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"` // пустая, если агент посчитал задачу. Иначе -- причина, по которой это не удалось.
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -178,30 +187,39 @@ func (x *TaskResult) GetPairId() int32 {
 	return 0
 }
 
-func (x *TaskResult) GetResult() int64 {
+func (x *TaskResult) GetResult() float64 {
 	if x != nil {
 		return x.Result
 	}
 	return 0
 }
 
+func (x *TaskResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
 var File_proto_internal_proto protoreflect.FileDescriptor
 
 const file_proto_internal_proto_rawDesc = "" +
 	"\n" +
 	"\x14proto/internal.proto\x12\x04main\"\a\n" +
-	"\x05Empty\"\x9c\x01\n" +
+	"\x05Empty\"\xbc\x01\n" +
 	"\n" +
 	"TaskToSend\x12\x16\n" +
 	"\x06PairId\x18\x01 \x01(\x05R\x06PairId\x12\x12\n" +
-	"\x04Arg1\x18\x02 \x01(\x03R\x04Arg1\x12\x12\n" +
-	"\x04Arg2\x18\x03 \x01(\x03R\x04Arg2\x12\x1c\n" +
+	"\x04arg1\x18\a \x01(\x01R\x04arg1\x12\x12\n" +
+	"\x04arg2\x18\b \x01(\x01R\x04arg2\x12\x1c\n" +
 	"\toperation\x18\x04 \x01(\tR\toperation\x120\n" +
-	"\x13PermissibleDuration\x18\x05 \x01(\tR\x13PermissibleDuration\"<\n" +
+	"\x13PermissibleDuration\x18\x05 \x01(\tR\x13PermissibleDuration\x12\x12\n" +
+	"\x04args\x18\x06 \x03(\x01R\x04argsJ\x04\b\x02\x10\x03J\x04\b\x03\x10\x04\"X\n" +
 	"\n" +
 	"TaskResult\x12\x16\n" +
 	"\x06PairId\x18\x01 \x01(\x05R\x06PairId\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x03R\x06result2b\n" +
+	"\x06result\x18\x04 \x01(\x01R\x06result\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05errorJ\x04\b\x02\x10\x032b\n" +
 	"\vTaskService\x12(\n" +
 	"\aGetTask\x12\v.main.Empty\x1a\x10.main.TaskToSend\x12)\n" +
 	"\bSendTask\x12\x10.main.TaskResult\x1a\v.main.EmptyB8Z6github.com/Debianov/calc-ya-go-24/backend/orchestratorb\x06proto3"
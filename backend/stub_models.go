@@ -4,14 +4,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
 	"time"
 )
 
 type ExpressionStub struct {
-	Id           int        `json:"id"`
-	Status       ExprStatus `json:"status"`
-	Result       int64      `json:"result"`
-	TasksHandler *TasksHandlerStub
+	Id         int        `json:"id"`
+	Expression string     `json:"expression,omitempty"`
+	Status     ExprStatus `json:"status"`
+	Result     float64    `json:"result"`
+	Reason     string     `json:"reason,omitempty"`
+	ExprTimestampsJson
+	OwnerId      int64             `json:"-"`
+	TasksHandler *TasksHandlerStub `json:"-"`
 }
 
 func (s *ExpressionStub) Marshal() (result []byte, err error) {
@@ -31,12 +36,31 @@ func (s *ExpressionStub) GetStatus() ExprStatus {
 	return s.Status
 }
 
-func (s *ExpressionStub) GetResult() int64 {
-	panic("implement me")
+func (s *ExpressionStub) GetResult() float64 {
+	return s.Result
+}
+
+func (s *ExpressionStub) GetReason() string {
+	return s.Reason
 }
 
 func (s *ExpressionStub) GetOwnerId() int64 {
-	panic("implement me")
+	return s.OwnerId
+}
+
+func (s *ExpressionStub) GetSource() string {
+	return s.Expression
+}
+
+func (s *ExpressionStub) GetTimestamps() ExprTimestamps {
+	var momentOrZero = func(moment *time.Time) time.Time {
+		if moment == nil {
+			return time.Time{}
+		}
+		return *moment
+	}
+	return ExprTimestamps{SubmittedAt: momentOrZero(s.SubmittedAt), StartedAt: momentOrZero(s.StartedAt),
+		FinishedAt: momentOrZero(s.FinishedAt)}
 }
 
 func (s *ExpressionStub) GetReadyGrpcTask() (GrpcTask, error) {
@@ -69,6 +93,26 @@ func (s *ExpressionStub) UpdateTask(result GrpcResult, _ time.Time) (err error)
 	return
 }
 
+func (s *ExpressionStub) RequeueExpiredTasks(_ time.Time) (err error) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *ExpressionStub) Cancel(reason string) (err error) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *ExpressionStub) Restore(calculatedTasks map[int32]float64, timestamps ExprTimestamps) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *ExpressionStub) GetTree() ast.Node {
+	//TODO implement me
+	panic("implement me")
+}
+
 func (s *ExpressionStub) DivideIntoTasks() {
 	//TODO implement me
 	panic("implement me")
@@ -92,12 +136,32 @@ func (s *TasksHandlerStub) Len() int {
 	panic("implement me")
 }
 
-func (s *TasksHandlerStub) RegisterFirst() (task InternalTask) {
+func (s *TasksHandlerStub) PopReady() (task InternalTask, ok bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *TasksHandlerStub) ReadyLen() int {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *TasksHandlerStub) Complete(task InternalTask, result float64) (isRoot bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *TasksHandlerStub) Requeue(task InternalTask) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *TasksHandlerStub) Restore(calculatedTasks map[int32]float64) (isRootCalculated bool) {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (s *TasksHandlerStub) CountUpdatedTask() {
+func (s *TasksHandlerStub) Drop() {
 	//TODO implement me
 	panic("implement me")
 }
@@ -107,6 +171,11 @@ func (s *TasksHandlerStub) PopSentTask(taskId int) (InternalTask, time.Time, boo
 	panic("implement me")
 }
 
+func (s *TasksHandlerStub) PopExpiredTasks(now time.Time) []InternalTask {
+	//TODO implement me
+	panic("implement me")
+}
+
 type TaskWithTimeStub struct {
 	Task      *Task
 	DummyTime time.Time
@@ -120,16 +189,24 @@ func (s *TaskWithTimeStub) GetOperation() string {
 	return s.Task.GetOperation()
 }
 
-func (s *TaskWithTimeStub) GetArg1() int64 {
+func (s *TaskWithTimeStub) GetArg1() float64 {
 	v, _ := s.Task.GetArg1()
 	return v
 }
 
-func (s *TaskWithTimeStub) GetArg2() int64 {
+func (s *TaskWithTimeStub) GetArg2() float64 {
 	v, _ := s.Task.GetArg2()
 	return v
 }
 
+func (s *TaskWithTimeStub) GetArgs() []float64 {
+	var result = make([]float64, s.Task.GetArgsCount())
+	for ind := range result {
+		result[ind], _ = s.Task.GetArg(ind)
+	}
+	return result
+}
+
 func (s *TaskWithTimeStub) GetPermissibleDuration() string {
 	return s.Task.GetPermissibleDuration().String()
 }
@@ -145,6 +222,7 @@ func (e ExpressionJsonStub) Marshal() (result []byte, err error) {
 
 type ExpressionsJsonTitleStub struct {
 	Expressions []ExpressionStub `json:"expressions"`
+	NextCursor  string           `json:"nextCursor,omitempty"`
 }
 
 func (e *ExpressionsJsonTitleStub) Marshal() (result []byte, err error) {
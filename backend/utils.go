@@ -34,13 +34,15 @@ func CallEnvVarFabric(key string, defaultValue string) *EnvVar {
 	}
 }
 
-func convertToInt64Interface(arg interface{}) (result interface{}, err error) {
+func convertToFloat64Interface(arg interface{}) (result interface{}, err error) {
 	switch v := arg.(type) {
 	case int:
-		result = int64(v)
+		result = float64(v)
 	case int32:
-		result = int64(v)
-	case int64, nil:
+		result = float64(v)
+	case int64:
+		result = float64(v)
+	case float64, nil:
 		result = v
 	default:
 		err = errors.New("arg должен быть числом")
@@ -0,0 +1,81 @@
+/*
+Package ast описывает дерево разбора арифметического выражения. Дерево строит pkg.Parse, а используют его
+генерация Task-ов, проверки и форматирование выражений.
+*/
+package ast
+
+// Span -- полуинтервал [Pos, End) в байтах исходной строки выражения.
+type Span struct {
+	Pos int `json:"pos"`
+	End int `json:"end"`
+}
+
+type Node interface {
+	GetSpan() Span
+	String() string
+	node()
+}
+
+// Number -- числовой литерал. Literal хранит запись из исходного выражения (например, ".5").
+type Number struct {
+	Value   float64
+	Literal string
+	Source  Span
+}
+
+// UnaryExpr -- унарный оператор перед X. Op всегда "-": унарный плюс в дерево не попадает.
+type UnaryExpr struct {
+	Op     string
+	X      Node
+	Source Span
+}
+
+type BinaryExpr struct {
+	Op     string
+	X      Node
+	Y      Node
+	Source Span
+}
+
+// CallExpr -- вызов функции. Source охватывает выражение от имени функции до закрывающей скобки.
+type CallExpr struct {
+	Func   string
+	Args   []Node
+	Source Span
+}
+
+func (n *Number) GetSpan() Span     { return n.Source }
+func (n *UnaryExpr) GetSpan() Span  { return n.Source }
+func (n *BinaryExpr) GetSpan() Span { return n.Source }
+func (n *CallExpr) GetSpan() Span   { return n.Source }
+
+func (n *Number) String() string     { return Format(n) }
+func (n *UnaryExpr) String() string  { return Format(n) }
+func (n *BinaryExpr) String() string { return Format(n) }
+func (n *CallExpr) String() string   { return Format(n) }
+
+func (*Number) node()     {}
+func (*UnaryExpr) node()  {}
+func (*BinaryExpr) node() {}
+func (*CallExpr) node()   {}
+
+/*
+Inspect обходит дерево в прямом порядке (сначала узел, потом его дочерние узлы слева направо). Если fn
+возвращает false, дочерние узлы текущего узла не посещаются.
+*/
+func Inspect(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *UnaryExpr:
+		Inspect(n.X, fn)
+	case *BinaryExpr:
+		Inspect(n.X, fn)
+		Inspect(n.Y, fn)
+	case *CallExpr:
+		for _, arg := range n.Args {
+			Inspect(arg, fn)
+		}
+	}
+}
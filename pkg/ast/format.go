@@ -0,0 +1,87 @@
+package ast
+
+import "strings"
+
+// UnaryPrecedence -- приоритет унарного минуса: выше "*", но ниже "^" (-2^2 = -(2^2)).
+const UnaryPrecedence = 3
+
+// atomPrecedence -- приоритет узлов, которые никогда не нужно заключать в скобки.
+const atomPrecedence = 5
+
+// Precedence возвращает приоритет бинарного оператора или 0, если op не бинарный оператор.
+func Precedence(op string) int {
+	switch op {
+	case "+", "-":
+		return 1
+	case "*", "/", "%":
+		return 2
+	case "^":
+		return 4
+	default:
+		return 0
+	}
+}
+
+func IsRightAssociative(op string) bool {
+	return op == "^"
+}
+
+func precedenceOf(node Node) int {
+	switch n := node.(type) {
+	case *BinaryExpr:
+		return Precedence(n.Op)
+	case *UnaryExpr:
+		return UnaryPrecedence
+	default:
+		return atomPrecedence
+	}
+}
+
+/*
+Format возвращает каноническую запись дерева: бинарные операторы отделяются пробелами, скобки ставятся только
+там, где без них изменится порядок вычислений. Результат разбирается pkg.Parse в эквивалентное дерево.
+*/
+func Format(node Node) string {
+	var builder strings.Builder
+	format(&builder, node)
+	return builder.String()
+}
+
+func format(builder *strings.Builder, node Node) {
+	switch n := node.(type) {
+	case *Number:
+		builder.WriteString(n.Literal)
+	case *UnaryExpr:
+		builder.WriteString(n.Op)
+		formatOperand(builder, n.X, precedenceOf(n.X) < UnaryPrecedence)
+	case *BinaryExpr:
+		var (
+			precedence      = Precedence(n.Op)
+			rightAssociated = IsRightAssociative(n.Op)
+			leftPrecedence  = precedenceOf(n.X)
+			rightPrecedence = precedenceOf(n.Y)
+		)
+		formatOperand(builder, n.X, leftPrecedence < precedence || leftPrecedence == precedence && rightAssociated)
+		builder.WriteString(" " + n.Op + " ")
+		formatOperand(builder, n.Y, rightPrecedence < precedence || rightPrecedence == precedence && !rightAssociated)
+	case *CallExpr:
+		builder.WriteString(n.Func + "(")
+		for ind, arg := range n.Args {
+			if ind > 0 {
+				builder.WriteString(", ")
+			}
+			format(builder, arg)
+		}
+		builder.WriteString(")")
+	}
+}
+
+func formatOperand(builder *strings.Builder, node Node, withParentheses bool) {
+	if withParentheses {
+		builder.WriteString("(")
+	}
+	format(builder, node)
+	if withParentheses {
+		builder.WriteString(")")
+	}
+}
@@ -1,116 +1,235 @@
 package pkg
 
 import (
-	"errors"
-	"strings"
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
+	"strconv"
 )
 
-func GeneratePostfix(expression string) (result []string, isValid bool) {
-	if len(expression) == 0 {
-		return nil, true
-	}
+// UnaryMinus -- название операции унарного минуса в Task-ах. Отличается от "-", чтобы агенту не приходилось
+// угадывать арность оператора.
+const UnaryMinus = "~"
+
+/*
+Parse разбирает выражение в дерево. Для пустого выражения возвращается nil без ошибки. Ошибки разбора имеют тип
+*ParseError.
+*/
+func Parse(expression string) (tree ast.Node, err error) {
 	tokens := tokenize(expression)
-	postfix, err := translateToPostfix(tokens)
-	if err != nil {
-		return nil, false
+	if len(tokens) == 0 {
+		return nil, nil
 	}
-	return postfix, true
+	return buildTree(tokens, len(expression))
 }
 
-func tokenize(expr string) []string {
+// token -- лексема выражения вместе с её смещением в байтах от начала строки.
+type token struct {
+	text string
+	pos  int
+}
+
+func (t token) end() int {
+	return t.pos + len(t.text)
+}
+
+func tokenize(expr string) []token {
 	var (
-		tokens       []string
-		currentToken strings.Builder
+		tokens       []token
+		currentToken token
 	)
 
-	for _, char := range expr {
+	for pos, char := range expr {
 		switch char {
 		case ' ':
-			continue
-		case '+', '-', '*', '/', '(', ')':
-			if currentToken.Len() > 0 {
-				tokens = append(tokens, currentToken.String())
-				currentToken.Reset()
+			if currentToken.text != "" {
+				tokens = append(tokens, currentToken)
+				currentToken = token{}
+			}
+		case '+', '-', '*', '/', '^', '%', '(', ')', ',':
+			if currentToken.text != "" {
+				tokens = append(tokens, currentToken)
+				currentToken = token{}
 			}
-			tokens = append(tokens, string(char))
+			tokens = append(tokens, token{text: string(char), pos: pos})
 		default:
-			currentToken.WriteRune(char)
+			if currentToken.text == "" {
+				currentToken.pos = pos
+			}
+			currentToken.text += string(char)
 		}
 	}
 
-	if currentToken.Len() > 0 {
-		tokens = append(tokens, currentToken.String())
+	if currentToken.text != "" {
+		tokens = append(tokens, currentToken)
 	}
 
 	return tokens
 }
 
-func translateToPostfix(tokens []string) ([]string, error) {
+// parenthesis хранит состояние открытой скобки: обычной или скобки вызова функции.
+type parenthesis struct {
+	isCall    bool
+	argsCount int
+	function  token
+}
+
+/*
+buildTree строит дерево алгоритмом сортировочной станции: вместо вывода постфиксной записи операторы сразу
+применяются к узлам на вершине стека operands.
+*/
+func buildTree(tokens []token, exprLen int) (ast.Node, error) {
 	var (
-		output              []string
-		operators           = StackFabric[string]()
-		operandCount        int
-		operatorCount       int
-		firstMustBeOperator bool // после любой ) должен идти только оператор. С помощью этого флага мы будем проверять
-		// на наличие этого условия.
+		operands      = StackFabric[ast.Node]()
+		operators     = StackFabric[token]()
+		parentheses   = StackFabric[parenthesis]()
+		expectOperand = true // true, если следующим токеном должен быть операнд, "(" или унарный оператор.
+		// После операнда и ")" допускаются только бинарные операторы, "," и ")".
+		calledFunction *token // не nil, если предыдущий токен -- имя функции, и следующим обязана быть "(".
+		err            error
 	)
 
-	for _, token := range tokens {
-		if IsNumber(token) {
-			if firstMustBeOperator {
-				return nil, InvalidExpression
+	for _, tok := range tokens {
+		if calledFunction != nil && tok.text != "(" {
+			return nil, newParseError(UnexpectedToken, tok)
+		}
+		if IsNumber(tok.text) {
+			if !expectOperand {
+				return nil, newParseError(UnexpectedToken, tok)
+			}
+			value, _ := strconv.ParseFloat(tok.text, 64)
+			operands.Push(&ast.Number{Value: value, Literal: tok.text, Source: ast.Span{Pos: tok.pos, End: tok.end()}})
+			expectOperand = false
+		} else if IsFunction(tok.text) {
+			if !expectOperand {
+				return nil, newParseError(UnexpectedToken, tok)
+			}
+			calledFunction = &tok
+		} else if tok.text == "(" {
+			if !expectOperand {
+				return nil, newParseError(UnexpectedToken, tok)
 			}
-			output = append(output, token)
-			operandCount++
-		} else if token == "(" {
-			if firstMustBeOperator {
-				return nil, InvalidExpression
+			operators.Push(tok)
+			if calledFunction != nil {
+				parentheses.Push(parenthesis{isCall: true, argsCount: 1, function: *calledFunction})
+				calledFunction = nil
+			} else {
+				parentheses.Push(parenthesis{})
 			}
-			operators.Push(token)
-		} else if token == ")" {
-			for operators.Len() > 0 && operators.GetLast() != "(" {
-				output = append(output, operators.Pop())
+		} else if tok.text == "," {
+			if expectOperand || parentheses.Len() == 0 || !parentheses.GetLast().isCall {
+				return nil, newParseError(UnexpectedToken, tok)
+			}
+			for operators.GetLast().text != "(" {
+				if err = reduce(operands, operators.Pop()); err != nil {
+					return nil, err
+				}
+			}
+			parentheses.GetLastPointer().argsCount++
+			expectOperand = true
+		} else if tok.text == ")" {
+			if expectOperand {
+				return nil, newParseError(UnexpectedToken, tok)
+			}
+			for operators.Len() > 0 && operators.GetLast().text != "(" {
+				if err = reduce(operands, operators.Pop()); err != nil {
+					return nil, err
+				}
 			}
 			if operators.Len() == 0 {
-				return nil, mismatchedParentheses
+				return nil, newParseError(MismatchedParentheses, tok)
 			}
-			firstMustBeOperator = true
 			operators.Pop()
-		} else if IsOperator(token) {
-			if firstMustBeOperator {
-				firstMustBeOperator = false
+			if closed := parentheses.Pop(); closed.isCall {
+				if err = reduceCall(operands, closed, tok); err != nil {
+					return nil, err
+				}
+			}
+		} else if IsOperator(tok.text) && expectOperand {
+			if tok.text != "+" && tok.text != "-" {
+				return nil, newParseError(UnexpectedToken, tok)
 			}
-			for operators.Len() > 0 && getPriority(operators.GetLast()) >= getPriority(token) {
-				output = append(output, operators.Pop())
+			if tok.text == "-" { // унарный плюс ничего не меняет, поэтому в дерево не попадает.
+				operators.Push(token{text: UnaryMinus, pos: tok.pos}) // префиксный оператор ничего не
+				// выталкивает из стека.
 			}
-			operators.Push(token)
-			operatorCount++
+		} else if IsOperator(tok.text) {
+			for operators.Len() > 0 && mustPopBefore(operators.GetLast().text, tok.text) {
+				if err = reduce(operands, operators.Pop()); err != nil {
+					return nil, err
+				}
+			}
+			operators.Push(tok)
+			expectOperand = true
 		} else {
-			return nil, errors.New("invalid operator/operand")
+			return nil, newParseError(UnknownToken, tok)
 		}
 	}
 
+	if expectOperand || calledFunction != nil {
+		return nil, &ParseError{Kind: UnexpectedEnd, Pos: exprLen}
+	}
+
 	for operators.Len() > 0 {
-		if operators.GetLast() == "(" {
-			return nil, mismatchedParentheses
+		if operators.GetLast().text == "(" {
+			return nil, newParseError(MismatchedParentheses, operators.GetLast())
+		}
+		if err = reduce(operands, operators.Pop()); err != nil {
+			return nil, err
 		}
-		output = append(output, operators.Pop())
 	}
 
-	if operatorCount != operandCount-1 {
-		return nil, InvalidExpression
+	if operands.Len() != 1 {
+		return nil, &ParseError{Kind: UnexpectedEnd, Pos: exprLen}
+	}
+
+	return operands.Pop(), nil
+}
+
+// reduce применяет оператор op к узлам на вершине operands и кладёт результат обратно.
+func reduce(operands *Stack[ast.Node], op token) error {
+	if op.text == UnaryMinus {
+		if operands.Len() < 1 {
+			return &ParseError{Kind: UnexpectedToken, Pos: op.pos, Token: "-"}
+		}
+		x := operands.Pop()
+		operands.Push(&ast.UnaryExpr{Op: "-", X: x, Source: ast.Span{Pos: op.pos, End: x.GetSpan().End}})
+		return nil
+	}
+	if operands.Len() < 2 {
+		return newParseError(UnexpectedToken, op)
 	}
+	y := operands.Pop()
+	x := operands.Pop()
+	operands.Push(&ast.BinaryExpr{Op: op.text, X: x, Y: y, Source: ast.Span{Pos: x.GetSpan().Pos,
+		End: y.GetSpan().End}})
+	return nil
+}
 
-	return output, nil
+// reduceCall заменяет аргументы закрытого вызова функции на вершине operands одним узлом ast.CallExpr.
+func reduceCall(operands *Stack[ast.Node], closed parenthesis, closingParenthesis token) error {
+	if !IsValidArgsCount(closed.function.text, closed.argsCount) || operands.Len() < closed.argsCount {
+		return newParseError(InvalidArgsCount, closed.function)
+	}
+	var args = make([]ast.Node, closed.argsCount)
+	for ind := closed.argsCount - 1; ind >= 0; ind-- {
+		args[ind] = operands.Pop()
+	}
+	operands.Push(&ast.CallExpr{Func: closed.function.text, Args: args, Source: ast.Span{Pos: closed.function.pos,
+		End: closingParenthesis.end()}})
+	return nil
 }
 
 func getPriority(op string) int {
-	switch op {
-	case "+", "-":
-		return 1
-	case "*", "/":
-		return 2
-	default:
-		return 0
+	if op == UnaryMinus {
+		return ast.UnaryPrecedence
+	}
+	return ast.Precedence(op)
+}
+
+// mustPopBefore сообщает, должен ли оператор stacked с вершины стека быть применён раньше, чем в стек будет
+// положен incoming. Для правоассоциативных операторов (2^3^2 = 2^(3^2)) равный приоритет не выталкивает.
+func mustPopBefore(stacked string, incoming string) bool {
+	if ast.IsRightAssociative(incoming) {
+		return getPriority(stacked) > getPriority(incoming)
 	}
+	return getPriority(stacked) >= getPriority(incoming)
 }
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"github.com/Debianov/calc-ya-go-24/pkg/ast"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+/*
+testParseThroughFormat сравнивает каноническую запись разобранных выражений с ожидаемой, а также проверяет, что
+каноническая запись разбирается в то же самое дерево.
+*/
+func testParseThroughFormat(t *testing.T, expressions []string, expected []string) {
+	for ind, expression := range expressions {
+		tree, err := Parse(expression)
+		if !assert.NoError(t, err, "case %d", ind) {
+			continue
+		}
+		assert.Equal(t, expected[ind], ast.Format(tree), "case %d", ind)
+		reparsedTree, err := Parse(ast.Format(tree))
+		if assert.NoError(t, err, "case %d", ind) {
+			assert.Equal(t, ast.Format(tree), ast.Format(reparsedTree), "case %d", ind)
+		}
+	}
+}
+
+func testParseUnary(t *testing.T) {
+	var (
+		expressions = []string{"-5+3", "2*(-4)", "3--2", "-(1+2)*4", "+7-+2", "--3", "2*-3"}
+		expected    = []string{"-5 + 3", "2 * -4", "3 - -2", "-(1 + 2) * 4", "7 - 2", "--3", "2 * -3"}
+	)
+	testParseThroughFormat(t, expressions, expected)
+}
+
+func testParseDecimal(t *testing.T) {
+	var (
+		expressions = []string{"1.5*2", "7/2", ".5-0.25"}
+		expected    = []string{"1.5 * 2", "7 / 2", ".5 - 0.25"}
+	)
+	testParseThroughFormat(t, expressions, expected)
+}
+
+func testParsePowerAndModulo(t *testing.T) {
+	var (
+		expressions = []string{"2^3^2", "(2^3)^2", "-2^2", "(-2)^2", "7%3*2", "2^-1", "1-(2-3)", "(1-2)-3",
+			"1+7%3"}
+		expected = []string{"2 ^ 3 ^ 2", "(2 ^ 3) ^ 2", "-2 ^ 2", "(-2) ^ 2", "7 % 3 * 2", "2 ^ (-1)", "1 - (2 - 3)",
+			"1 - 2 - 3", "1 + 7 % 3"}
+	)
+	testParseThroughFormat(t, expressions, expected)
+	tree, _ := Parse("2^3^2")
+	if assert.IsType(t, &ast.BinaryExpr{}, tree) {
+		assert.IsType(t, &ast.BinaryExpr{}, tree.(*ast.BinaryExpr).Y)
+	}
+	tree, _ = Parse("-2^2")
+	assert.IsType(t, &ast.UnaryExpr{}, tree)
+}
+
+func testParseFunctions(t *testing.T) {
+	var (
+		expressions = []string{"sqrt(16)+max(3, 7, 2)", "pow(2, 1+2)", "-abs(-3)", "min(4)", "round(2.5)*2",
+			"max(1, min(2, 3), sqrt(4))"}
+		expected = []string{"sqrt(16) + max(3, 7, 2)", "pow(2, 1 + 2)", "-abs(-3)", "min(4)", "round(2.5) * 2",
+			"max(1, min(2, 3), sqrt(4))"}
+	)
+	testParseThroughFormat(t, expressions, expected)
+}
+
+func testParseSpans(t *testing.T) {
+	tree, err := Parse("2 + sqrt(16)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var spans []ast.Span
+	ast.Inspect(tree, func(node ast.Node) bool {
+		spans = append(spans, node.GetSpan())
+		return true
+	})
+	assert.Equal(t, []ast.Span{{Pos: 0, End: 12}, {Pos: 0, End: 1}, {Pos: 4, End: 12}, {Pos: 9, End: 11}}, spans)
+	tree, _ = Parse("-(1+2)")
+	assert.Equal(t, ast.Span{Pos: 0, End: 5}, tree.GetSpan())
+}
+
+func testParseInvalid(t *testing.T) {
+	var expressions = []string{"2++*4", "4*(2+3", "8+2/3)", "4*()2+3", "-", "5-", "(-)", "2*/3", "(2)(3)",
+		"5*-", "1e5", "Inf+1", "0x10", "1.2.3", "2^^3", "%2", "sqrt(1, 2)", "pow(2)", "max()", "sqrt 4", "foo(1)",
+		"(1, 2)", "1, 2", "sqrt(4)(2)", "max(1,)", "2sqrt(4)", "sqrt", "1 2"}
+	for ind, expression := range expressions {
+		tree, err := Parse(expression)
+		assert.Error(t, err, "case %d", ind)
+		assert.Nil(t, tree, "case %d", ind)
+	}
+}
+
+func testParseErrorPositions(t *testing.T) {
+	var (
+		expressions = []string{"2++*4", "4*(2+3", "8+2/3)", "2 + foo(1)", "sqrt(1, 2)", "5*-", "max(1 2)", "1e5"}
+		expected    = []*ParseError{{Kind: UnexpectedToken, Pos: 3, Token: "*"},
+			{Kind: MismatchedParentheses, Pos: 2, Token: "("}, {Kind: MismatchedParentheses, Pos: 5, Token: ")"},
+			{Kind: UnknownToken, Pos: 4, Token: "foo"}, {Kind: InvalidArgsCount, Pos: 0, Token: "sqrt"},
+			{Kind: UnexpectedEnd, Pos: 3, Token: ""}, {Kind: UnexpectedToken, Pos: 6, Token: "2"},
+			{Kind: UnknownToken, Pos: 0, Token: "1e5"}}
+	)
+	for ind, expression := range expressions {
+		_, err := Parse(expression)
+		var parseErr *ParseError
+		if assert.ErrorAs(t, err, &parseErr, "case %d", ind) {
+			assert.Equal(t, expected[ind], parseErr, "case %d", ind)
+		}
+	}
+	_, err := Parse("(1+2")
+	assert.ErrorIs(t, err, mismatchedParentheses)
+	_, err = Parse("1+")
+	assert.ErrorIs(t, err, InvalidExpression)
+}
+
+func TestParse(t *testing.T) {
+	t.Run("Unary", testParseUnary)
+	t.Run("Decimal", testParseDecimal)
+	t.Run("PowerAndModulo", testParsePowerAndModulo)
+	t.Run("Functions", testParseFunctions)
+	t.Run("Spans", testParseSpans)
+	t.Run("Invalid", testParseInvalid)
+	t.Run("ErrorPositions", testParseErrorPositions)
+}
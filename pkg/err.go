@@ -1,8 +1,57 @@
 package pkg
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
 
 var (
 	mismatchedParentheses = errors.New("mismatched parentheses")
 	InvalidExpression     = errors.New("invalid expression")
 )
+
+// ParseErrorKind -- вид ошибки разбора выражения.
+type ParseErrorKind string
+
+const (
+	MismatchedParentheses ParseErrorKind = "mismatched_parentheses"
+	UnexpectedToken       ParseErrorKind = "unexpected_token"
+	UnknownToken          ParseErrorKind = "unknown_token"
+	UnexpectedEnd         ParseErrorKind = "unexpected_end"
+	InvalidArgsCount      ParseErrorKind = "invalid_args_count"
+)
+
+/*
+ParseError описывает, где и на каком токене разбор выражения завершился ошибкой. Pos -- смещение в байтах от
+начала выражения; для UnexpectedEnd оно равно длине выражения, а Token пуст.
+*/
+type ParseError struct {
+	Kind  ParseErrorKind `json:"kind"`
+	Pos   int            `json:"pos"`
+	Token string         `json:"token"`
+}
+
+func (p *ParseError) Error() string {
+	if p.Kind == UnexpectedEnd {
+		return fmt.Sprintf("%s: unexpected end of expression at %d", p.Unwrap(), p.Pos)
+	}
+	return fmt.Sprintf("%s: %s %q at %d", p.Unwrap(), p.Kind, p.Token, p.Pos)
+}
+
+// Unwrap позволяет сравнивать ParseError с mismatchedParentheses и InvalidExpression через errors.Is.
+func (p *ParseError) Unwrap() error {
+	if p.Kind == MismatchedParentheses {
+		return mismatchedParentheses
+	}
+	return InvalidExpression
+}
+
+func (p *ParseError) Marshal() (result []byte, err error) {
+	result, err = json.Marshal(p)
+	return
+}
+
+func newParseError(kind ParseErrorKind, tok token) *ParseError {
+	return &ParseError{Kind: kind, Pos: tok.pos, Token: tok.text}
+}
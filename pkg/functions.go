@@ -0,0 +1,37 @@
+package pkg
+
+// unlimitedArgsCount -- значение maxArgsCount у функций с переменным числом аргументов.
+const unlimitedArgsCount = -1
+
+type function struct {
+	minArgsCount int
+	maxArgsCount int
+}
+
+var functions = map[string]function{
+	"sqrt":  {1, 1},
+	"abs":   {1, 1},
+	"round": {1, 1},
+	"pow":   {2, 2},
+	"min":   {1, unlimitedArgsCount},
+	"max":   {1, unlimitedArgsCount},
+}
+
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+// IsVariadicFunction сообщает, что функция принимает произвольное число аргументов.
+func IsVariadicFunction(name string) bool {
+	f, ok := functions[name]
+	return ok && f.maxArgsCount == unlimitedArgsCount
+}
+
+func IsValidArgsCount(name string, argsCount int) bool {
+	f, ok := functions[name]
+	if !ok || argsCount < f.minArgsCount {
+		return false
+	}
+	return f.maxArgsCount == unlimitedArgsCount || argsCount <= f.maxArgsCount
+}
@@ -3,10 +3,16 @@ package pkg
 import (
 	"math"
 	"strconv"
+	"strings"
 	"sync"
 )
 
+// IsNumber принимает только десятичную запись (например, "12", "1.5", ".5"). Запись вида "1e5", "0x1p3" или
+// "Inf", которую допускает strconv.ParseFloat, числом не считается.
 func IsNumber(token string) bool {
+	if strings.IndexFunc(token, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }) != -1 {
+		return false
+	}
 	if _, err := strconv.ParseFloat(token, 64); err == nil {
 		return true
 	}
@@ -14,7 +20,11 @@ func IsNumber(token string) bool {
 }
 
 func IsOperator(token string) bool {
-	return token == "+" || token == "-" || token == "*" || token == "/"
+	return token == "+" || token == "-" || token == "*" || token == "/" || token == "^" || token == "%"
+}
+
+func IsUnaryOperator(token string) bool {
+	return token == UnaryMinus
 }
 
 type Stack[T any] struct {
@@ -52,6 +62,12 @@ func (s *Stack[T]) GetLast() T {
 	return s.buf[len(s.buf)-1]
 }
 
+func (s *Stack[T]) GetLastPointer() *T {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return &s.buf[len(s.buf)-1]
+}
+
 func (s *Stack[T]) Pop() T {
 	result := s.GetLast()
 	s.buf = s.buf[:len(s.buf)-1]